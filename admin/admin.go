@@ -35,6 +35,22 @@ func SetAdminRoutes(s *mux.Router){
 		return
 	}
 
+	// CSRF token for the forms calling the API (see checkCSRF) and permissions of the admin
+	globGetters["session"] = func(r *http.Request)(data map[string]interface{}){
+		data = make(map[string]interface{})
+		if session := sessionFrom(r); session != nil {
+			data["username"] = session.Username
+			data["csrf"] = session.CSRFToken
+			// permissions of the admin (to show only the links they can follow)
+			perms := make(map[string]bool)
+			for _, perm := range rolePermissions[session.Role] {
+				perms[string(perm)] = true
+			}
+			data["perms"] = perms
+		}
+		return
+	}
+
 	// login
 	loginHandler := &templateHandler{
 		filename: "login.html",
@@ -68,9 +84,9 @@ func SetAdminRoutes(s *mux.Router){
 				"dish": dish,
 			}
 		},
-		globGetters: []string{"header"},
+		globGetters: []string{"header", "session"},
 	}
-	s.Handle("/dishes/{id:[0-9]+}", mustAuth(dishHandler))
+	s.Handle("/dishes/{id:[0-9]+}", mustAuth(permMenu, dishHandler))
 
 	// order
 	orderHandler := &templateHandler{
@@ -88,9 +104,9 @@ func SetAdminRoutes(s *mux.Router){
 			}
 			return
 		},
-		globGetters: []string{"header"},
+		globGetters: []string{"header", "session"},
 	}
-	s.Handle("/order", mustAuth(orderHandler))
+	s.Handle("/order", mustAuth(permSales, orderHandler))
 
 	// new dish
 	newDishHandler := &templateHandler{
@@ -106,9 +122,63 @@ func SetAdminRoutes(s *mux.Router){
 			data["kinds"] = kinds
 			return
 		},
-		globGetters: []string{"header"},
+		globGetters: []string{"header", "session"},
+	}
+	s.Handle("/new_dish", mustAuth(permMenu, newDishHandler))
+
+	// special offers
+	offersHandler := &templateHandler{
+		filename: "offers.html",
+		getter: func(*http.Request)(data map[string]interface{}){
+			data = make(map[string]interface{})
+
+			offers, err := db.GetOffers(true)
+			if err != nil {
+				logger.Errorf("Error getting list of offers: %v", err)
+				data["error"] = err.Error()
+				return
+			}
+			data["offers"] = offers
+
+			kinds, err := db.GetDishKinds()
+			if err != nil {
+				data["error"] = err.Error()
+				return
+			}
+			data["kinds"] = kinds
+			return
+		},
+		globGetters: []string{"header", "session"},
 	}
-	s.Handle("/new_dish", mustAuth(newDishHandler))
+	s.Handle("/offers", mustAuth(permSales, offersHandler))
+
+	// admins
+	adminsHandler := &templateHandler{
+		filename: "admins.html",
+		getter: func(*http.Request)(data map[string]interface{}){
+			data = make(map[string]interface{})
+
+			admins, err := db.GetAdmins()
+			if err != nil {
+				logger.Errorf("Error getting list of admins: %v", err)
+				data["error"] = err.Error()
+				return
+			}
+			data["admins"] = admins
+			data["roles"] = roleNames()
+			return
+		},
+		globGetters: []string{"header", "session"},
+	}
+	s.Handle("/admins", mustAuth(permAdmins, adminsHandler))
+
+	// password change
+	passwordHandler := &templateHandler{
+		filename: "password.html",
+		getter: nil,
+		globGetters: []string{"header", "session"},
+	}
+	s.Handle("/password", mustAuth(permAny, passwordHandler))
 
 	// home
 	homeHandler := &templateHandler{
@@ -117,9 +187,8 @@ func SetAdminRoutes(s *mux.Router){
 			data = make(map[string]interface{})
 
 			// name of admin
-			username, err := r.Cookie("username")
-			if err == nil {
-				name, err := db.GetAdminName(username.Value)
+			if session := sessionFrom(r); session != nil {
+				name, err := db.GetAdminName(session.Username)
 				if err != nil {
 					logger.Errorf("Error getting admin name: %s", err)
 				} else {
@@ -137,9 +206,9 @@ func SetAdminRoutes(s *mux.Router){
 			}
 			return
 		},
-		globGetters: []string{"header"},
+		globGetters: []string{"header", "session"},
 	}
-	s.Handle("", mustAuth(homeHandler))
+	s.Handle("", mustAuth(permAny, homeHandler))
 
 	return
 }
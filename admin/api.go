@@ -1,13 +1,12 @@
 package admin
 
 import (
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"net/http"
-	"strconv"
+	"strings"
 
 	db "github.com/xopoww/korm/database"
 	. "github.com/xopoww/korm/types"
@@ -37,7 +36,7 @@ func SetApiRoutes (s *mux.Router) {
 				}
 
 				// execute the method
-				response, err := method(r)
+				response, err := method.call(r)
 				if err != nil {
 					// report internal error
 					data["error"] = fmt.Sprintf("internal error: %v", err)
@@ -51,9 +50,21 @@ func SetApiRoutes (s *mux.Router) {
 		},
 	}
 
-	s.Handle("/auth", apiMethod(authMethod))
+	for name, spec := range sessionMethods {
+		if spec.public {
+			s.Handle("/" + name, sessionHandler{spec})
+		} else {
+			s.Handle("/" + name, mustAuthAPI(spec.perm, sessionHandler{spec}))
+		}
+	}
+	s.Handle("/openapi.json", openAPIHandler)
+	// resource-oriented API (see api_v1.go), served alongside Methods during the migration
+	setV1Routes(s.PathPrefix("/v1").Subrouter())
 	// TODO: fix mustAuth to check for "serve_html" value
-	s.Handle("/{method:[a-zA-Z_]+}", mustAuthAPI(handler))
+	for name, spec := range Methods {
+		s.Handle("/{method:" + name + "}", mustAuthAPI(spec.perm, handler))
+	}
+	s.Handle("/{method:[a-zA-Z_]+}", mustAuthAPI(permAny, handler))
 }
 
 // apiHandler wraps templateHandler. When serving a request, it check for URL Query value "serve_html".
@@ -86,7 +97,7 @@ func (h * apiHandler) ServeHTTP(w http.ResponseWriter, r * http.Request) {
 		return
 	}
 
-	method.ServeHTTP(w, r)
+	apiMethod(method.call).ServeHTTP(w, r)
 	return
 }
 
@@ -143,153 +154,588 @@ func respondErrMsg(msg string)(map[string]interface{}, error) {
 }
 
 // Map of all existing API methods
-var Methods = map[string]apiMethod{
-	// add dish record to the database
-	"new_dish": func(r * http.Request)(map[string]interface{}, error) {
-		name := r.Form.Get("name")
-		if name == "" {
-			return respondErrMsg("missing parameter: name")
-		}
+var Methods = map[string]*methodSpec{
+	"new_dish": {
+		summary: "add dish record to the database",
+		perm: permMenu,
+		params: []apiParam{
+			stringParam("name", "name of the dish").required(),
+			stringParam("description", "description of the dish"),
+			intParam("quantity", "number of portions in stock").required().min(0),
+			intParam("kind", "id of the dish kind").required(),
+			intParam("price", "price of a portion (the kind price is used if not set)").min(0),
+		},
+		result: apiFields{"id": 0},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			var price *int
+			if args.Has("price") {
+				price = new(int)
+				*price = args.Int("price")
+			}
+
+			id, err := db.NewDish(args.String("name"), args.String("description"),
+				args.Int("quantity"), args.Int("kind"), price)
+			if err != nil {
+				return nil, err
+			}
 
-		description := r.Form.Get("description")
+			return map[string]interface{}{
+				"ok": true,
+				"id": id,
+			}, nil
+		},
+	},
 
-		quantityS := r.Form.Get("quantity")
-		if quantityS == "" {
-			return respondErrMsg("missing parameter: quantity")
-		}
-		quantity, err := strconv.ParseInt(quantityS, 10, 0)
-		if err != nil {
-			return respondError(err)
-		}
+	"order": {
+		summary: "register a new order",
+		perm: permSales,
+		params: []apiParam{
+			jsonParam("items", "ordered dishes", []OrderItem{}).required(),
+			intParam("offer_id", "id of the special offer the items fill"),
+			// delivery details are optional for the orders made by admins
+			stringParam("address", "delivery address"),
+			stringParam("phone", "phone of the customer"),
+			stringParam("time", "desired delivery time"),
+			stringParam("comment", "comment for the courier"),
+		},
+		result: apiFields{"order_id": 0, "bill": Bill{}},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			order := &Order{
+				Items:   args["items"].([]OrderItem),
+				OfferID: args.Int("offer_id"),
+				Delivery: Delivery{
+					Address: args.String("address"),
+					Phone:   args.String("phone"),
+					Time:    args.String("time"),
+					Comment: args.String("comment"),
+				},
+			}
+
+			bill, err := db.RegisterOrder(order)
+			switch {
+			case err == nil:
+				return map[string]interface{}{
+					"ok": true,
+					"order_id": order.ID,
+					"bill": bill,
+				}, nil
+			case errors.Is(err, db.ErrBadID), errors.Is(err, db.ErrOutOfStock), errors.Is(err, db.ErrBadItems),
+				errors.Is(err, db.ErrOfferMismatch), errors.Is(err, db.ErrOfferExpired):
+				return respondError(err)
+			default:
+				return nil, err
+			}
+		},
+	},
 
-		kindS := r.Form.Get("kind")
-		if kindS == "" {
-			return respondErrMsg("missing parameter: kind")
-		}
-		kind, err := strconv.ParseInt(kindS, 10, 0)
-		if err != nil {
-			return respondError(err)
-		}
+	"add_dish": {
+		summary: "add portions to an existing dish",
+		perm: permMenu,
+		params: []apiParam{
+			intParam("id", "id of the dish").required(),
+			intParam("delta", "number of portions to add (negative to subtract)").required(),
+		},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			err := db.AddDish(args.Int("id"), args.Int("delta"))
+			switch {
+			case err == nil:
+				return map[string]interface{}{
+					"ok": true,
+				}, nil
+			case errors.Is(err, db.ErrBadID), errors.Is(err, db.ErrOutOfStock):
+				return respondError(err)
+			default:
+				return nil, err
+			}
+		},
+	},
 
-		id, err := db.NewDish(name, description, int(quantity), int(kind))
-		if err != nil {
-			return nil, err
-		}
+	"order_status": {
+		summary: "move an order to the next status (the customer is notified by the bot)",
+		perm: permOrders,
+		params: []apiParam{
+			intParam("id", "id of the order").required(),
+			stringParam("status", "new status").required().enum(orderStatusNames()...),
+			stringParam("comment", "comment recorded to the status history"),
+		},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			err := db.SetOrderStatus(args.Int("id"), OrderStatus(args.String("status")),
+				adminActor(r), args.String("comment"))
+			switch {
+			case err == nil:
+				return map[string]interface{}{
+					"ok": true,
+				}, nil
+			case errors.Is(err, db.ErrBadID), errors.Is(err, db.ErrBadTransition):
+				return respondError(err)
+			default:
+				return nil, err
+			}
+		},
+	},
 
-		return map[string]interface{}{
-			"ok": true,
-			"id": id,
-		}, nil
+	"cancel_order": {
+		summary: "cancel a new order and return its items to stock",
+		perm: permOrders,
+		params: []apiParam{
+			intParam("id", "id of the order").required(),
+			stringParam("reason", "reason recorded to the status history"),
+		},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			err := db.CancelOrder(args.Int("id"), adminActor(r), args.String("reason"))
+			switch {
+			case err == nil:
+				return map[string]interface{}{
+					"ok": true,
+				}, nil
+			case errors.Is(err, db.ErrBadID), errors.Is(err, db.ErrCannotCancel):
+				return respondError(err)
+			default:
+				return nil, err
+			}
+		},
 	},
 
-	// register a new order
-	"order": func(r * http.Request)(map[string]interface{}, error) {
-		itemsJSON := r.Form.Get("items")
-		if itemsJSON == "" {
-			return respondErrMsg("missing parameter: items")
-		}
-		var items []OrderItem
-		err := json.Unmarshal([]byte(itemsJSON), &items)
-		if err != nil {
-			return respondError(err)
-		}
+	"offers": {
+		summary: "list special offers",
+		perm: permSales,
+		safe: true,
+		params: []apiParam{
+			boolParam("all", "include expired offers"),
+		},
+		result: apiFields{"offers": []Offer{}},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			offers, err := db.GetOffers(args.Bool("all"))
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"ok": true,
+				"offers": offers,
+			}, nil
+		},
+	},
 
-		err = db.RegisterOrder(&Order{Items: items})
-		switch {
-		case err == nil:
-			return map[string]interface{}{"ok": true}, nil
-		case errors.Is(err, db.ErrBadID), errors.Is(err, db.ErrOutOfStock):
-			return respondError(err)
-		default:
-			return nil, err
-		}
+	"new_offer": {
+		summary: "create a special offer",
+		perm: permSales,
+		params: offerParams,
+		result: apiFields{"id": 0},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			offer, err := offerFromArgs(args)
+			if err != nil {
+				return respondOfferError(err)
+			}
+			id, err := db.NewOffer(offer)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"ok": true,
+				"id": id,
+			}, nil
+		},
 	},
 
-	// add portions to an existing dish
-	"add_dish": func(r * http.Request)(map[string]interface{}, error) {
-		idS := r.Form.Get("id")
-		if idS == "" {
-			return respondErrMsg("missing parameter: id")
-		}
-		id, err := strconv.ParseInt(idS, 10, 0)
-		if err != nil {
-			return respondError(err)
-		}
+	"update_offer": {
+		summary: "replace a special offer and its slots",
+		perm: permSales,
+		params: append([]apiParam{intParam("id", "id of the offer").required()}, offerParams...),
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			offer, err := offerFromArgs(args)
+			if err != nil {
+				return respondOfferError(err)
+			}
+			offer.ID = args.Int("id")
+
+			err = db.UpdateOffer(offer)
+			switch {
+			case err == nil:
+				return map[string]interface{}{
+					"ok": true,
+				}, nil
+			case errors.Is(err, db.ErrBadID):
+				return respondError(err)
+			default:
+				return nil, err
+			}
+		},
+	},
 
-		deltaS := r.Form.Get("delta")
-		if deltaS == "" {
-			return respondErrMsg("missing parameter: delta")
-		}
-		delta, err := strconv.ParseInt(deltaS, 10, 0)
-		if err != nil {
-			return respondError(err)
-		}
+	"del_offer": {
+		summary: "delete a special offer",
+		perm: permSales,
+		params: []apiParam{
+			intParam("id", "id of the offer").required(),
+		},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			err := db.DelOffer(args.Int("id"))
+			switch {
+			case err == nil:
+				return map[string]interface{}{
+					"ok": true,
+				}, nil
+			case errors.Is(err, db.ErrBadID):
+				return respondError(err)
+			default:
+				return nil, err
+			}
+		},
+	},
 
-		err = db.AddDish(int(id), int(delta))
-		switch {
-		case err == nil:
+	"promos": {
+		summary: "list all promo codes",
+		perm: permSales,
+		safe: true,
+		result: apiFields{"promos": []Promo{}},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			promos, err := db.GetPromos()
+			if err != nil {
+				return nil, err
+			}
 			return map[string]interface{}{
 				"ok": true,
+				"promos": promos,
 			}, nil
-		case errors.Is(err, db.ErrBadID):
-			return respondError(err)
-		default:
-			return nil, err
-		}
+		},
 	},
 
-	// delete a dish record
-	"del_dish": func(r * http.Request)(map[string]interface{}, error) {
-		idS := r.Form.Get("id")
-		if idS == "" {
-			return respondErrMsg("missing parameter: id")
-		}
-		id, err := strconv.ParseInt(idS, 10, 0)
-		if err != nil {
-			return respondError(err)
-		}
+	"new_promo": {
+		summary: "create a promo code",
+		perm: permSales,
+		params: []apiParam{
+			stringParam("code", "the code (case-insensitive)").required(),
+			stringParam("type", "how the discount is computed").required().enum(string(PromoPercent), string(PromoFixed)),
+			intParam("value", "percentage (1-100) or amount of the discount").required().min(1),
+			intParam("min_total", "minimum order total").min(0),
+			timeParam("expires", "expiration time (never expires if not set)"),
+			intParam("max_uses", "limit of uses in total (unlimited if not set)").min(0),
+			intParam("max_uses_per_user", "limit of uses by a single user (unlimited if not set)").min(0),
+			intListParam("kinds", "ids of the dish kinds the discount applies to (all if not set)"),
+		},
+		result: apiFields{"code": ""},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			promo := &Promo{
+				Code:           db.NormalizePromoCode(args.String("code")),
+				Type:           PromoType(args.String("type")),
+				Value:          args.Int("value"),
+				MinTotal:       args.Int("min_total"),
+				Expires:        args.Time("expires"),
+				MaxUses:        args.Int("max_uses"),
+				MaxUsesPerUser: args.Int("max_uses_per_user"),
+			}
+			if promo.Type == PromoPercent && promo.Value > 100 {
+				return respondErrMsg("percentage must not exceed 100")
+			}
+			for _, id := range args.IntList("kinds") {
+				if containsInt(promo.KindIDs, id) {
+					continue
+				}
+				if _, err := db.GetDishKindByID(id); err != nil {
+					if errors.Is(err, db.ErrBadID) {
+						return respondErrMsg(fmt.Sprintf("kind %d: %s", id, err))
+					}
+					return nil, err
+				}
+				promo.KindIDs = append(promo.KindIDs, id)
+			}
+
+			err := db.NewPromo(promo)
+			switch {
+			case err == nil:
+				return map[string]interface{}{
+					"ok": true,
+					"code": promo.Code,
+				}, nil
+			case errors.Is(err, db.ErrPromoExists):
+				return respondError(err)
+			default:
+				return nil, err
+			}
+		},
+	},
+
+	"disable_promo": {
+		summary: "disable a promo code",
+		perm: permSales,
+		params: []apiParam{
+			stringParam("code", "the code").required(),
+		},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			err := db.DisablePromo(args.String("code"))
+			switch {
+			case err == nil:
+				return map[string]interface{}{
+					"ok": true,
+				}, nil
+			case errors.Is(err, db.ErrPromoUnknown):
+				return respondError(err)
+			default:
+				return nil, err
+			}
+		},
+	},
 
-		err = db.DelDish(int(id))
-		switch {
-		case err == nil:
+	"points": {
+		summary: "get the loyalty points balance and the last ledger entries of a user",
+		perm: permSales,
+		safe: true,
+		params: []apiParam{
+			intParam("uid", "id of the user").required(),
+			intParam("limit", "number of the entries (20 if not set)").min(1),
+		},
+		result: apiFields{"balance": 0, "entries": []PointsEntry{}},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			limit := 20
+			if args.Has("limit") {
+				limit = args.Int("limit")
+			}
+			balance, err := db.GetPointsBalance(args.Int("uid"))
+			if err != nil {
+				return nil, err
+			}
+			entries, err := db.GetPointsHistory(args.Int("uid"), limit)
+			if err != nil {
+				return nil, err
+			}
 			return map[string]interface{}{
 				"ok": true,
+				"balance": balance,
+				"entries": entries,
 			}, nil
-		case errors.Is(err, db.ErrBadID):
-			return respondError(err)
-		default:
-			return nil, err
-		}
+		},
 	},
-}
 
-// Process authentication request form login form
-// Separated from other methods because it mustn't go through auth check middleware.
-func authMethod(r * http.Request)(map[string]interface{}, error){
-	err := r.ParseForm()
-	if err != nil {
-		return respondError(err)
-	}
+	"adjust_points": {
+		summary: "credit or debit loyalty points of a user",
+		perm: permSales,
+		params: []apiParam{
+			intParam("uid", "id of the user").required(),
+			intParam("delta", "points to credit (negative to debit)").required(),
+			stringParam("reason", "reason shown to the user").required(),
+		},
+		result: apiFields{"balance": 0},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			if args.Int("delta") == 0 {
+				return respondErrMsg("delta must not be zero")
+			}
+			reason := strings.TrimSpace(args.String("reason"))
+			if reason == "" {
+				return respondErrMsg("missing parameter: reason")
+			}
+
+			balance, err := db.AdjustPoints(args.Int("uid"), args.Int("delta"), adminActor(r), reason)
+			switch {
+			case err == nil:
+				return map[string]interface{}{
+					"ok": true,
+					"balance": balance,
+				}, nil
+			case errors.Is(err, db.ErrBadID), errors.Is(err, db.ErrNotEnoughPoints):
+				return respondError(err)
+			default:
+				return nil, err
+			}
+		},
+	},
 
-	username := r.Form.Get("username")
-	password := r.Form.Get("password")
+	"del_dish": {
+		summary: "delete a dish record",
+		perm: permMenu,
+		params: []apiParam{
+			intParam("id", "id of the dish").required(),
+		},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			err := db.DelDish(args.Int("id"))
+			switch {
+			case err == nil:
+				return map[string]interface{}{
+					"ok": true,
+				}, nil
+			case errors.Is(err, db.ErrBadID):
+				return respondError(err)
+			default:
+				return nil, err
+			}
+		},
+	},
+
+	"admins": {
+		summary: "list all admins",
+		perm: permAdmins,
+		safe: true,
+		result: apiFields{"admins": []Admin{}},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			admins, err := db.GetAdmins()
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"ok": true,
+				"admins": admins,
+			}, nil
+		},
+	},
+
+	"invite_admin": {
+		summary: "create an admin account with a random password (the admin is to change it)",
+		perm: permAdmins,
+		params: []apiParam{
+			stringParam("username", "username of the new admin").required(),
+			stringParam("name", "name of the new admin").required(),
+			stringParam("role", "role of the new admin").required().enum(roleNames()...),
+		},
+		result: apiFields{"password": ""},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			password, err := db.GeneratePassword()
+			if err != nil {
+				return nil, err
+			}
+			err = db.AddAdmin(args.String("username"), password, args.String("name"), AdminRole(args.String("role")))
+			switch {
+			case err == nil:
+				return map[string]interface{}{
+					"ok": true,
+					"password": password,
+				}, nil
+			case errors.Is(err, db.ErrAdminExists):
+				return respondError(err)
+			default:
+				return nil, err
+			}
+		},
+	},
+
+	"set_admin_role": {
+		summary: "change the role of an admin",
+		perm: permAdmins,
+		params: []apiParam{
+			stringParam("username", "username of the admin").required(),
+			stringParam("role", "new role").required().enum(roleNames()...),
+		},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			return respondAdminUpdate(db.SetAdminRole(args.String("username"), AdminRole(args.String("role"))))
+		},
+	},
+
+	"disable_admin": {
+		summary: "disable an admin (the admin is logged out and cannot log in)",
+		perm: permAdmins,
+		params: []apiParam{
+			stringParam("username", "username of the admin").required(),
+		},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			return respondAdminUpdate(db.SetAdminDisabled(args.String("username"), true))
+		},
+	},
+
+	"enable_admin": {
+		summary: "enable a disabled admin",
+		perm: permAdmins,
+		params: []apiParam{
+			stringParam("username", "username of the admin").required(),
+		},
+		handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+			return respondAdminUpdate(db.SetAdminDisabled(args.String("username"), false))
+		},
+	},
+}
 
-	err = db.CheckAdmin(username, password)
+// Response of the methods updating an admin.
+func respondAdminUpdate(err error)(map[string]interface{}, error) {
 	switch {
 	case err == nil:
-		break
-	case errors.Is(err, db.ErrBadAdmin):
+		return map[string]interface{}{
+			"ok": true,
+		}, nil
+	case errors.Is(err, db.ErrUnknownAdmin), errors.Is(err, db.ErrLastOwner):
 		return respondError(err)
 	default:
 		return nil, err
 	}
+}
 
-	token := createAuthToken(username)
-	tokenHex := make([]byte, hex.EncodedLen(len(token)))
-	hex.Encode(tokenHex, token)
+// Names of all admin roles
+func roleNames() []string {
+	return []string{string(RoleOwner), string(RoleManager), string(RoleCook), string(RoleCourier)}
+}
 
-	return map[string]interface{}{
-		"ok": true,
-		"token": string(tokenHex),
-	}, nil
-}
\ No newline at end of file
+// Format of the time parameters (as sent by datetime-local input)
+const offerExpiresFormat = "2006-01-02T15:04"
+
+// Parameters of new_offer and update_offer
+var offerParams = []apiParam{
+	stringParam("name", "name of the offer").required(),
+	intParam("price", "price of the offer").required().min(0),
+	timeParam("expires", "expiration time (never expires if not set)"),
+	jsonParam("items", "slots of the offer, e.g. [{\"kind_id\": 1, \"quantity\": 2}]", []offerSlotV1{}).required(),
+}
+
+// Error of the offer made from the arguments (client's fault)
+var errBadOffer = errors.New("invalid offer")
+
+// 	Make the offer from the arguments of new_offer or update_offer.
+// If the arguments are invalid, errBadOffer or db.ErrBadID (of a dish kind) is returned,
+// other errors are internal (see respondOfferError).
+func offerFromArgs(args apiArgs) (*Offer, error) {
+	offer := &Offer{
+		Name:    args.String("name"),
+		Price:   args.Int("price"),
+		Expires: args.Time("expires"),
+	}
+	slots := args["items"].([]offerSlotV1)
+	if len(slots) == 0 {
+		return nil, fmt.Errorf("%w: must have at least one slot", errBadOffer)
+	}
+	kindIDs := make([]int, 0, len(slots))
+	for _, slot := range slots {
+		if slot.Quantity <= 0 {
+			return nil, fmt.Errorf("%w: invalid quantity of kind %d: %d", errBadOffer, slot.KindID, slot.Quantity)
+		}
+		if containsInt(kindIDs, slot.KindID) {
+			return nil, fmt.Errorf("%w: kind %d is in more than one slot", errBadOffer, slot.KindID)
+		}
+		kindIDs = append(kindIDs, slot.KindID)
+		kind, err := db.GetDishKindByID(slot.KindID)
+		if err != nil {
+			return nil, fmt.Errorf("kind %d: %w", slot.KindID, err)
+		}
+		offer.Items = append(offer.Items, OfferItem{Kind: kind, Quantity: slot.Quantity})
+	}
+	return offer, nil
+}
+
+// Response of new_offer and update_offer to the error of offerFromArgs.
+func respondOfferError(err error)(map[string]interface{}, error) {
+	if errors.Is(err, errBadOffer) || errors.Is(err, db.ErrBadID) {
+		return respondError(err)
+	}
+	return nil, err
+}
+
+// Names of all order statuses
+func orderStatusNames() []string {
+	names := make([]string, 0, len(orderStatuses))
+	for _, status := range orderStatuses {
+		names = append(names, string(status))
+	}
+	return names
+}
+
+func containsInt(s []int, x int) bool {
+	for _, v := range s {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the actor for the records made by the admin that issued the request.
+func adminActor(r *http.Request) string {
+	session := sessionFrom(r)
+	if session == nil {
+		return "admin"
+	}
+	return "admin:" + session.Username
+}
@@ -0,0 +1,497 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ======== method declarations ========
+
+// methodSpec declares an API method: its parameters, the fields of its response and the handler.
+// The parameters are parsed and validated before the handler is called,
+// and the OpenAPI document (/api/openapi.json) is generated from the declarations.
+type methodSpec struct {
+	summary		string
+	// the method doesn't change anything, so the CSRF token isn't required
+	safe		bool
+	// the method is called without a session (neither the session nor the CSRF token is required)
+	public		bool
+	// the method must be called with POST
+	postOnly	bool
+	// permission the admin needs to call the method
+	perm		permission
+	params		[]apiParam
+	// sample values of the response fields (besides "ok"), their types describe the response
+	result		apiFields
+	handler		func(r *http.Request, args apiArgs)(map[string]interface{}, error)
+}
+
+type apiFields map[string]interface{}
+
+// Call the method: check the request, parse the parameters and (if they are valid) call the handler.
+// Its signature is the one of apiMethod.
+func (m *methodSpec) call(r *http.Request)(map[string]interface{}, error) {
+	if m.postOnly && r.Method != http.MethodPost {
+		return respondErrMsg("the method must be called with POST")
+	}
+	if !m.safe && !m.public {
+		if err := checkCSRF(r); err != nil {
+			return respondError(err)
+		}
+	}
+	args, err := m.parseArgs(r)
+	if err != nil {
+		return respondError(err)
+	}
+	return m.handler(r, args)
+}
+
+// ======== parameters ========
+
+type paramType int
+
+const (
+	paramString paramType = iota
+	paramInt
+	paramBool
+	// offerExpiresFormat in local time (as sent by datetime-local input)
+	paramTime
+	// comma-separated list of integers
+	paramIntList
+	// JSON value of the type of apiParam.sample
+	paramJSON
+)
+
+// apiParam is a declaration of a method parameter.
+// Use the constructors (intParam, stringParam etc.) and modifiers (required, min, enum).
+// Empty values are treated as missing (HTML forms send empty optional fields).
+type apiParam struct {
+	name		string
+	typ			paramType
+	description	string
+	isRequired	bool
+	minimum		*int
+	values		[]string
+	sample		interface{}
+}
+
+func stringParam(name, description string) apiParam {
+	return apiParam{name: name, typ: paramString, description: description}
+}
+
+func intParam(name, description string) apiParam {
+	return apiParam{name: name, typ: paramInt, description: description}
+}
+
+func boolParam(name, description string) apiParam {
+	return apiParam{name: name, typ: paramBool, description: description}
+}
+
+func timeParam(name, description string) apiParam {
+	return apiParam{name: name, typ: paramTime, description: description}
+}
+
+func intListParam(name, description string) apiParam {
+	return apiParam{name: name, typ: paramIntList, description: description}
+}
+
+// jsonParam declares a parameter holding a JSON value that is decoded to the type of sample.
+func jsonParam(name, description string, sample interface{}) apiParam {
+	return apiParam{name: name, typ: paramJSON, description: description, sample: sample}
+}
+
+func (p apiParam) required() apiParam {
+	p.isRequired = true
+	return p
+}
+
+func (p apiParam) min(value int) apiParam {
+	p.minimum = &value
+	return p
+}
+
+func (p apiParam) enum(values ...string) apiParam {
+	p.values = values
+	return p
+}
+
+// Parse the value of the parameter (valueS is not empty).
+func (p *apiParam) parse(valueS string) (interface{}, error) {
+	switch p.typ {
+	case paramString:
+		if len(p.values) != 0 && !containsString(p.values, valueS) {
+			return nil, fmt.Errorf("invalid %s: %q (must be one of: %s)", p.name, valueS, strings.Join(p.values, ", "))
+		}
+		return valueS, nil
+	case paramInt:
+		value, err := strconv.ParseInt(valueS, 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: must be an integer", p.name)
+		}
+		if p.minimum != nil && int(value) < *p.minimum {
+			if *p.minimum == 0 {
+				return nil, fmt.Errorf("%s must not be negative", p.name)
+			}
+			return nil, fmt.Errorf("%s must be at least %d", p.name, *p.minimum)
+		}
+		return int(value), nil
+	case paramBool:
+		value, err := strconv.ParseBool(valueS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: must be true or false", p.name)
+		}
+		return value, nil
+	case paramTime:
+		value, err := time.ParseInLocation(offerExpiresFormat, valueS, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: must be in format %s", p.name, offerExpiresFormat)
+		}
+		return value, nil
+	case paramIntList:
+		var values []int
+		for _, s := range strings.Split(valueS, ",") {
+			value, err := strconv.ParseInt(strings.TrimSpace(s), 10, 0)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: must be a comma-separated list of integers", p.name)
+			}
+			values = append(values, int(value))
+		}
+		return values, nil
+	case paramJSON:
+		value := reflect.New(reflect.TypeOf(p.sample))
+		if err := json.Unmarshal([]byte(valueS), value.Interface()); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", p.name, err)
+		}
+		return value.Elem().Interface(), nil
+	default:
+		return nil, fmt.Errorf("unknown type of parameter %s", p.name)
+	}
+}
+
+// apiArgs holds the parsed parameters of a method call.
+// Getters return zero values for the parameters that were not passed.
+type apiArgs map[string]interface{}
+
+func (m *methodSpec) parseArgs(r *http.Request) (apiArgs, error) {
+	args := make(apiArgs, len(m.params))
+	for i := range m.params {
+		p := &m.params[i]
+		valueS := r.Form.Get(p.name)
+		if valueS == "" {
+			if p.isRequired {
+				return nil, fmt.Errorf("missing parameter: %s", p.name)
+			}
+			continue
+		}
+		value, err := p.parse(valueS)
+		if err != nil {
+			return nil, err
+		}
+		args[p.name] = value
+	}
+	return args, nil
+}
+
+func (a apiArgs) Has(name string) bool {
+	_, found := a[name]
+	return found
+}
+
+func (a apiArgs) String(name string) string {
+	value, _ := a[name].(string)
+	return value
+}
+
+func (a apiArgs) Int(name string) int {
+	value, _ := a[name].(int)
+	return value
+}
+
+func (a apiArgs) Bool(name string) bool {
+	value, _ := a[name].(bool)
+	return value
+}
+
+func (a apiArgs) Time(name string) time.Time {
+	value, _ := a[name].(time.Time)
+	return value
+}
+
+func (a apiArgs) IntList(name string) []int {
+	value, _ := a[name].([]int)
+	return value
+}
+
+func containsString(s []string, x string) bool {
+	for _, v := range s {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
+
+// ======== OpenAPI ========
+
+// openAPIHandler serves the OpenAPI 3 document describing Methods and the session methods.
+var openAPIHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIDoc, openAPIErr = json.MarshalIndent(openAPISpec(), "", "  ")
+	})
+	if openAPIErr != nil {
+		http.Error(w, openAPIErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(openAPIDoc)
+})
+
+var (
+	openAPIOnce	sync.Once
+	openAPIDoc	[]byte
+	openAPIErr	error
+)
+
+type object = map[string]interface{}
+
+func openAPISpec() object {
+	schemas := make(object)
+	paths := make(object)
+	for name, method := range Methods {
+		paths["/api/" + name] = methodPath(name, method, schemas)
+	}
+	for name, method := range sessionMethods {
+		paths["/api/" + name] = methodPath(name, method, schemas)
+	}
+
+	schemas["Error"] = object{
+		"type": "object",
+		"required": []string{"ok", "error"},
+		"properties": object{
+			"ok": object{"type": "boolean", "enum": []bool{false}},
+			"error": object{"type": "string", "description": "explanation of the client's error"},
+		},
+	}
+
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title": "korm admin API",
+			"version": "1",
+			"description": "Every method accepts its parameters either in the URL query (GET) or in a form (POST). " +
+				"Client errors are reported with status 200 and the Error object. " +
+				"Methods that change anything require the CSRF token of the session (returned by auth) " +
+				"in the X-CSRF-Token header or in the csrf_token parameter. " +
+				"Pass serve_html=true to get the result as an HTML page.",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": schemas,
+			"securitySchemes": object{
+				"cookieAuth": object{"type": "apiKey", "in": "cookie", "name": sessionCookie},
+			},
+		},
+		"security": []object{{"cookieAuth": []string{}}},
+	}
+}
+
+// Describe the method as GET and POST operations (only POST for postOnly methods).
+func methodPath(name string, m *methodSpec, schemas object) object {
+	success := object{"ok": object{"type": "boolean", "enum": []bool{true}}}
+	required := []string{"ok"}
+	for field, sample := range m.result {
+		success[field] = schemaOf(reflect.TypeOf(sample), schemas)
+		required = append(required, field)
+	}
+	sort.Strings(required)
+	responses := object{
+		"200": object{
+			"description": "result of the call (or the client's error)",
+			"content": object{"application/json": object{"schema": object{
+				"oneOf": []object{
+					{"type": "object", "required": required, "properties": success},
+					{"$ref": "#/components/schemas/Error"},
+				},
+			}}},
+		},
+		"500": object{
+			"description": "internal error",
+			"content": object{"text/plain": object{"schema": object{"type": "string"}}},
+		},
+	}
+	if !m.public {
+		responses["403"] = object{"description": "the client is not authenticated or doesn't have the permission"}
+	}
+
+	params := m.params
+	if !m.safe && !m.public {
+		params = append([]apiParam{
+			stringParam("csrf_token", "CSRF token of the session (if not sent in the X-CSRF-Token header)"),
+		}, params...)
+	}
+	queryParams := make([]object, 0, len(params))
+	formProps := make(object)
+	formRequired := make([]string, 0)
+	for i := range params {
+		p := &params[i]
+		schema := p.schema(schemas)
+		queryParams = append(queryParams, object{
+			"name": p.name,
+			"in": "query",
+			"description": p.description,
+			"required": p.isRequired,
+			"schema": schema,
+		})
+		withDescription := object{"description": p.description}
+		for k, v := range schema {
+			withDescription[k] = v
+		}
+		formProps[p.name] = withDescription
+		if p.isRequired {
+			formRequired = append(formRequired, p.name)
+		}
+	}
+
+	description := ""
+	if m.perm != permAny {
+		description = "Requires permission: " + string(m.perm) + "."
+	}
+	get := object{
+		"operationId": name + "_get",
+		"summary": m.summary,
+		"description": description,
+		"parameters": queryParams,
+		"responses": responses,
+	}
+	formSchema := object{"type": "object", "properties": formProps}
+	if len(formRequired) != 0 {
+		formSchema["required"] = formRequired
+	}
+	post := object{
+		"operationId": name,
+		"summary": m.summary,
+		"description": description,
+		"requestBody": object{
+			"content": object{"application/x-www-form-urlencoded": object{"schema": formSchema}},
+		},
+		"responses": responses,
+	}
+	if m.public {
+		get["security"] = []object{}
+		post["security"] = []object{}
+	}
+	if m.postOnly {
+		return object{"post": post}
+	}
+	return object{"get": get, "post": post}
+}
+
+// Schema of the parameter value.
+func (p *apiParam) schema(schemas object) object {
+	var schema object
+	switch p.typ {
+	case paramString:
+		schema = object{"type": "string"}
+		if len(p.values) != 0 {
+			schema["enum"] = p.values
+		}
+	case paramInt:
+		schema = object{"type": "integer"}
+		if p.minimum != nil {
+			schema["minimum"] = *p.minimum
+		}
+	case paramBool:
+		schema = object{"type": "boolean"}
+	case paramTime:
+		schema = object{"type": "string", "pattern": `^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}$`, "example": "2021-12-31T23:59"}
+	case paramIntList:
+		schema = object{"type": "string", "pattern": `^\d+(,\d+)*$`, "example": "1,2"}
+	case paramJSON:
+		// the parameter is a string with JSON of the described shape
+		schema = object{
+			"type": "string",
+			"format": "json",
+			"x-json-schema": schemaOf(reflect.TypeOf(p.sample), schemas),
+		}
+	}
+	return schema
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// 	Build the schema of the values of type t as they are encoded by encoding/json.
+// Named structs are put to schemas and referenced.
+func schemaOf(t reflect.Type, schemas object) object {
+	switch {
+	case t == timeType:
+		return object{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		return object{"allOf": []object{schemaOf(t.Elem(), schemas)}, "nullable": true}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		if _, found := schemas[t.Name()]; !found {
+			// reserve the name first in case the type is recursive
+			schemas[t.Name()] = object{}
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return object{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return structSchema(t, schemas)
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return object{"type": "string", "format": "byte"}
+		}
+		return object{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.String:
+		return object{"type": "string"}
+	default:
+		return object{}
+	}
+}
+
+func structSchema(t reflect.Type, schemas object) object {
+	props := make(object)
+	addStructProps(t, props, schemas)
+	return object{"type": "object", "properties": props}
+}
+
+// Add the properties of the struct fields (fields of embedded structs are flattened as encoding/json does).
+func addStructProps(t reflect.Type, props object, schemas object) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Name
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+			name = tagName
+		} else if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addStructProps(field.Type, props, schemas)
+			continue
+		}
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		props[name] = schemaOf(field.Type, schemas)
+	}
+}
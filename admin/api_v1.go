@@ -0,0 +1,263 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	db "github.com/xopoww/korm/database"
+)
+
+// ======== REST API (v1) ========
+//
+// Resource-oriented JSON API served under /api/v1 alongside the Methods map.
+// Requests with a body must have Content-Type: application/json.
+// No CSRF token is required: cross-site requests cannot have such a body or use PATCH/DELETE
+// without a CORS preflight, and the session cookie is SameSite=Strict anyway.
+// Successful responses carry the resource (or a list of resources) as JSON,
+// errors are sent with the appropriate status code and the following body:
+//		{"error": {"code": "not_found", "message": "...", "details": {...}}}
+
+func setV1Routes(s *mux.Router) {
+	s.Handle("/dishes", mustAuthV1(permMenu, restResource{
+		http.MethodGet: listDishes,
+		http.MethodPost: createDish,
+	}))
+	s.Handle("/dishes/{id:[0-9]+}", mustAuthV1(permMenu, restResource{
+		http.MethodGet: getDish,
+		http.MethodPatch: patchDish,
+		http.MethodDelete: deleteDish,
+	}))
+
+	s.Handle("/kinds", mustAuthV1(permMenu, restResource{
+		http.MethodGet: listKinds,
+		http.MethodPost: createKind,
+	}))
+	s.Handle("/kinds/{id:[0-9]+}", mustAuthV1(permMenu, restResource{
+		http.MethodGet: getKind,
+		http.MethodPatch: patchKind,
+		http.MethodDelete: deleteKind,
+	}))
+
+	s.Handle("/orders", mustAuthV1(permOrders, restResource{
+		http.MethodGet: listOrders,
+		// the orders are made by those who can sell, not by everyone who handles them
+		http.MethodPost: requirePerm(permSales, createOrder),
+	}))
+	s.Handle("/orders/{id:[0-9]+}", mustAuthV1(permOrders, restResource{
+		http.MethodGet: getOrder,
+		http.MethodPatch: patchOrder,
+	}))
+
+	s.Handle("/offers", mustAuthV1(permSales, restResource{
+		http.MethodGet: listOffers,
+		http.MethodPost: createOffer,
+	}))
+	s.Handle("/offers/{id:[0-9]+}", mustAuthV1(permSales, restResource{
+		http.MethodGet: getOffer,
+		http.MethodPatch: patchOffer,
+		http.MethodDelete: deleteOffer,
+	}))
+
+	s.NotFoundHandler = restHandler(func(r *http.Request) (int, interface{}, error) {
+		return 0, nil, newRestError(http.StatusNotFound, "not_found", "no such resource: %s", r.URL.Path)
+	})
+}
+
+// restError is an error of the client that is sent in the error envelope.
+type restError struct {
+	Status	int			`json:"-"`
+	Code	string		`json:"code"`
+	Message	string		`json:"message"`
+	Details	interface{}	`json:"details,omitempty"`
+}
+
+func (e *restError) Error() string {
+	return e.Message
+}
+
+func newRestError(status int, code, format string, args ...interface{}) *restError {
+	return &restError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Client errors of package database and the way they are reported.
+// ErrBadID of the resource itself means 404, but the handlers report ErrBadID of the referenced
+// resources (e.g. the kind of a new dish) as 422 themselves.
+var restDBErrors = []struct{
+	err		error
+	status	int
+	code	string
+}{
+	{db.ErrBadID, http.StatusNotFound, "not_found"},
+	{db.ErrOutOfStock, http.StatusConflict, "out_of_stock"},
+	{db.ErrBadTransition, http.StatusConflict, "bad_transition"},
+	{db.ErrCannotCancel, http.StatusConflict, "cannot_cancel"},
+	{db.ErrKindInUse, http.StatusConflict, "kind_in_use"},
+	{db.ErrKindExists, http.StatusConflict, "kind_exists"},
+	{db.ErrOfferExpired, http.StatusUnprocessableEntity, "offer_expired"},
+	{db.ErrOfferMismatch, http.StatusUnprocessableEntity, "offer_mismatch"},
+	{db.ErrBadItems, http.StatusUnprocessableEntity, "invalid_items"},
+	{db.ErrPromoUnknown, http.StatusUnprocessableEntity, "promo_unknown"},
+	{db.ErrPromoExpired, http.StatusUnprocessableEntity, "promo_expired"},
+	{db.ErrPromoUsedUp, http.StatusUnprocessableEntity, "promo_used_up"},
+	{db.ErrPromoMinTotal, http.StatusUnprocessableEntity, "promo_min_total"},
+	{db.ErrPromoNotApplicable, http.StatusUnprocessableEntity, "promo_not_applicable"},
+	{db.ErrNotEnoughPoints, http.StatusUnprocessableEntity, "not_enough_points"},
+}
+
+// 	Convert a client error of package database to *restError.
+// Other errors are returned as is (and reported as internal).
+func restDBError(err error) error {
+	for _, e := range restDBErrors {
+		if errors.Is(err, e.err) {
+			return &restError{Status: e.status, Code: e.code, Message: err.Error()}
+		}
+	}
+	return err
+}
+
+// 	restHandler is the underlying function type for REST API handlers.
+// It returns the status code and the response body (nil for no body).
+// If the error is a *restError, it is sent to the client, other errors are reported as internal.
+type restHandler func(r *http.Request) (int, interface{}, error)
+
+func (h restHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status, body, err := h(r)
+	if err != nil {
+		var restErr *restError
+		if !errors.As(err, &restErr) {
+			restErr = &restError{Status: http.StatusInternalServerError, Code: "internal", Message: err.Error()}
+		}
+		writeJSON(w, restErr.Status, map[string]interface{}{"error": restErr})
+		return
+	}
+	if body == nil {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// restResource dispatches requests to the handlers by HTTP method.
+type restResource map[string]restHandler
+
+func (res restResource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, found := res[r.Method]; found {
+		h.ServeHTTP(w, r)
+		return
+	}
+	allowed := make([]string, 0, len(res))
+	for method := range res {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	restHandler(func(r *http.Request) (int, interface{}, error) {
+		return 0, nil, newRestError(http.StatusMethodNotAllowed, "method_not_allowed",
+			"method %s is not allowed (allowed: %s)", r.Method, strings.Join(allowed, ", "))
+	}).ServeHTTP(w, r)
+}
+
+// 	Wrap a handler so that unauthorized clients get 401 in the error envelope
+// and the admins without the permission get 403.
+func mustAuthV1(perm permission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := checkAuthCookie(r)
+		switch err {
+		case nil:
+			if !allowed(session.Role, perm) {
+				restHandler(func(*http.Request) (int, interface{}, error) {
+					return 0, nil, errForbidden(perm)
+				}).ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, withSession(r, session))
+		case http.ErrNoCookie:
+			restHandler(func(*http.Request) (int, interface{}, error) {
+				return 0, nil, newRestError(http.StatusUnauthorized, "unauthorized", "authentication required")
+			}).ServeHTTP(w, r)
+		default:
+			restHandler(func(*http.Request) (int, interface{}, error) {
+				return 0, nil, err
+			}).ServeHTTP(w, r)
+		}
+	})
+}
+
+// 	Wrap a handler so that the admins without the permission get 403.
+// The request must have gone through mustAuthV1.
+func requirePerm(perm permission, h restHandler) restHandler {
+	return func(r *http.Request) (int, interface{}, error) {
+		if session := sessionFrom(r); session == nil || !allowed(session.Role, perm) {
+			return 0, nil, errForbidden(perm)
+		}
+		return h(r)
+	}
+}
+
+func errForbidden(perm permission) error {
+	return newRestError(http.StatusForbidden, "forbidden", "permission denied: %s", perm)
+}
+
+// 	Decode the JSON body of the request to dst.
+// Unknown fields are rejected so that misspelled fields are not silently ignored.
+func decodeBody(r *http.Request, dst interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return newRestError(http.StatusUnsupportedMediaType, "unsupported_media_type",
+			"request body must be application/json")
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(dst); err != nil {
+		return newRestError(http.StatusBadRequest, "invalid_body", "cannot decode request body: %s", err)
+	}
+	return nil
+}
+
+// Get the id of the resource from the path.
+func pathID(r *http.Request) (int, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		return 0, newRestError(http.StatusNotFound, "not_found", "invalid id: %s", mux.Vars(r)["id"])
+	}
+	return int(id), nil
+}
+
+// 	Get an optional non-negative integer query parameter.
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	valueS := r.URL.Query().Get(name)
+	if valueS == "" {
+		return def, nil
+	}
+	value, err := strconv.ParseInt(valueS, 10, 0)
+	if err != nil || value < 0 {
+		return 0, invalidParam(name, "must be a non-negative integer")
+	}
+	return int(value), nil
+}
+
+// Report an invalid parameter (query parameter or body field).
+func invalidParam(name, format string, args ...interface{}) error {
+	err := newRestError(http.StatusBadRequest, "invalid_parameter", "%s: " + format,
+		append([]interface{}{name}, args...)...)
+	err.Details = map[string]string{"parameter": name}
+	return err
+}
@@ -0,0 +1,643 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	db "github.com/xopoww/korm/database"
+	. "github.com/xopoww/korm/types"
+)
+
+// Default and maximum number of orders in a page of GET /orders
+const (
+	defaultOrdersLimit = 50
+	maxOrdersLimit = 200
+)
+
+// ======== representations ========
+
+type dishV1 struct {
+	ID			int		`json:"id"`
+	Name		string	`json:"name"`
+	Description	string	`json:"description"`
+	Quantity	int		`json:"quantity"`
+	KindID		int		`json:"kind_id"`
+	// own price of the dish (null if the kind price is used)
+	Price		*int	`json:"price"`
+	UnitPrice	int		`json:"unit_price"`
+}
+
+func newDishV1(dish *Dish) dishV1 {
+	return dishV1{
+		ID:          dish.ID,
+		Name:        dish.Name,
+		Description: dish.Description,
+		Quantity:    dish.Quantity,
+		KindID:      dish.Kind.ID,
+		Price:       dish.Price,
+		UnitPrice:   dish.UnitPrice(),
+	}
+}
+
+type kindV1 struct {
+	ID		int		`json:"id"`
+	Name	string	`json:"name"`
+	Price	int		`json:"price"`
+}
+
+func newKindV1(kind *DishKind) kindV1 {
+	return kindV1{ID: kind.ID, Name: kind.Repr, Price: kind.Price}
+}
+
+type orderV1 struct {
+	ID			int			`json:"id"`
+	UID			int			`json:"uid"`
+	VK			bool		`json:"vk"`
+	Status		OrderStatus	`json:"status"`
+	Created		time.Time	`json:"created"`
+	Total		int			`json:"total"`
+	OfferID		int			`json:"offer_id,omitempty"`
+	PromoCode	string		`json:"promo_code,omitempty"`
+	Points		int			`json:"points,omitempty"`
+	Items		[]OrderItem	`json:"items"`
+	Delivery	Delivery	`json:"delivery"`
+}
+
+func newOrderV1(order *Order) orderV1 {
+	return orderV1{
+		ID:        order.ID,
+		UID:       order.UID,
+		VK:        order.VK,
+		Status:    order.Status,
+		Created:   order.Created,
+		Total:     order.Total,
+		OfferID:   order.OfferID,
+		PromoCode: order.PromoCode,
+		Points:    order.Points,
+		Items:     order.Items,
+		Delivery:  order.Delivery,
+	}
+}
+
+type offerSlotV1 struct {
+	KindID		int		`json:"kind_id"`
+	Quantity	int		`json:"quantity"`
+}
+
+type offerV1 struct {
+	ID		int				`json:"id"`
+	Name	string			`json:"name"`
+	Price	int				`json:"price"`
+	// null if the offer never expires
+	Expires	*time.Time		`json:"expires"`
+	Items	[]offerSlotV1	`json:"items"`
+}
+
+func newOfferV1(offer *Offer) offerV1 {
+	res := offerV1{ID: offer.ID, Name: offer.Name, Price: offer.Price, Items: make([]offerSlotV1, 0, len(offer.Items))}
+	if !offer.Expires.IsZero() {
+		expires := offer.Expires
+		res.Expires = &expires
+	}
+	for _, item := range offer.Items {
+		res.Items = append(res.Items, offerSlotV1{KindID: item.Kind.ID, Quantity: item.Quantity})
+	}
+	return res
+}
+
+// Get the kind referenced by the request body (422 if there is no such kind).
+func referencedKind(id int) (*DishKind, error) {
+	kind, err := db.GetDishKindByID(id)
+	if errors.Is(err, db.ErrBadID) {
+		restErr := newRestError(http.StatusUnprocessableEntity, "unknown_kind", "there is no dish kind %d", id)
+		restErr.Details = map[string]int{"kind_id": id}
+		return nil, restErr
+	}
+	return kind, err
+}
+
+// ======== dishes ========
+
+func listDishes(*http.Request) (int, interface{}, error) {
+	dishes, err := db.GetDishes()
+	if err != nil {
+		return 0, nil, err
+	}
+	res := make([]dishV1, 0, len(dishes))
+	for i := range dishes {
+		res = append(res, newDishV1(&dishes[i]))
+	}
+	return http.StatusOK, map[string]interface{}{"dishes": res}, nil
+}
+
+func getDish(r *http.Request) (int, interface{}, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	dish, err := db.GetDishByID(id)
+	if err != nil {
+		return 0, nil, restDBError(err)
+	}
+	return http.StatusOK, newDishV1(dish), nil
+}
+
+func createDish(r *http.Request) (int, interface{}, error) {
+	var req struct{
+		Name		string	`json:"name"`
+		Description	string	`json:"description"`
+		Quantity	int		`json:"quantity"`
+		KindID		*int	`json:"kind_id"`
+		Price		*int	`json:"price"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		return 0, nil, err
+	}
+	switch {
+	case strings.TrimSpace(req.Name) == "":
+		return 0, nil, invalidParam("name", "must not be empty")
+	case req.Quantity < 0:
+		return 0, nil, invalidParam("quantity", "must not be negative")
+	case req.KindID == nil:
+		return 0, nil, invalidParam("kind_id", "is required")
+	case req.Price != nil && *req.Price < 0:
+		return 0, nil, invalidParam("price", "must not be negative")
+	}
+	if _, err := referencedKind(*req.KindID); err != nil {
+		return 0, nil, err
+	}
+
+	id, err := db.NewDish(req.Name, req.Description, req.Quantity, *req.KindID, req.Price)
+	if err != nil {
+		return 0, nil, err
+	}
+	dish, err := db.GetDishByID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, newDishV1(dish), nil
+}
+
+func patchDish(r *http.Request) (int, interface{}, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	var req struct{
+		Name		*string			`json:"name"`
+		Description	*string			`json:"description"`
+		Quantity	*int			`json:"quantity"`
+		KindID		*int			`json:"kind_id"`
+		// null resets the price to the kind price
+		Price		json.RawMessage	`json:"price"`
+	}
+	if err = decodeBody(r, &req); err != nil {
+		return 0, nil, err
+	}
+	dish, err := db.GetDishByID(id)
+	if err != nil {
+		return 0, nil, restDBError(err)
+	}
+
+	if req.Name != nil {
+		if strings.TrimSpace(*req.Name) == "" {
+			return 0, nil, invalidParam("name", "must not be empty")
+		}
+		dish.Name = *req.Name
+	}
+	if req.Description != nil {
+		dish.Description = *req.Description
+	}
+	if req.Quantity != nil {
+		if *req.Quantity < 0 {
+			return 0, nil, invalidParam("quantity", "must not be negative")
+		}
+		dish.Quantity = *req.Quantity
+	}
+	if req.KindID != nil {
+		if dish.Kind, err = referencedKind(*req.KindID); err != nil {
+			return 0, nil, err
+		}
+	}
+	if req.Price != nil {
+		var price *int
+		if err = json.Unmarshal(req.Price, &price); err != nil {
+			return 0, nil, invalidParam("price", "must be an integer or null")
+		}
+		if price != nil && *price < 0 {
+			return 0, nil, invalidParam("price", "must not be negative")
+		}
+		dish.Price = price
+	}
+
+	if err = db.UpdateDish(dish); err != nil {
+		return 0, nil, restDBError(err)
+	}
+	if dish, err = db.GetDishByID(id); err != nil {
+		return 0, nil, restDBError(err)
+	}
+	return http.StatusOK, newDishV1(dish), nil
+}
+
+func deleteDish(r *http.Request) (int, interface{}, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = db.DelDish(id); err != nil {
+		return 0, nil, restDBError(err)
+	}
+	return http.StatusNoContent, nil, nil
+}
+
+// ======== dish kinds ========
+
+func listKinds(*http.Request) (int, interface{}, error) {
+	kinds, err := db.GetDishKinds()
+	if err != nil {
+		return 0, nil, err
+	}
+	res := make([]kindV1, 0, len(kinds))
+	for i := range kinds {
+		res = append(res, newKindV1(&kinds[i]))
+	}
+	return http.StatusOK, map[string]interface{}{"kinds": res}, nil
+}
+
+func getKind(r *http.Request) (int, interface{}, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	kind, err := db.GetDishKindByID(id)
+	if err != nil {
+		return 0, nil, restDBError(err)
+	}
+	return http.StatusOK, newKindV1(kind), nil
+}
+
+func createKind(r *http.Request) (int, interface{}, error) {
+	var req struct{
+		Name	string	`json:"name"`
+		Price	*int	`json:"price"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		return 0, nil, err
+	}
+	switch {
+	case strings.TrimSpace(req.Name) == "":
+		return 0, nil, invalidParam("name", "must not be empty")
+	case req.Price == nil:
+		return 0, nil, invalidParam("price", "is required")
+	case *req.Price < 0:
+		return 0, nil, invalidParam("price", "must not be negative")
+	}
+
+	id, err := db.NewDishKind(req.Name, *req.Price)
+	if err != nil {
+		return 0, nil, restDBError(err)
+	}
+	return http.StatusCreated, kindV1{ID: id, Name: req.Name, Price: *req.Price}, nil
+}
+
+func patchKind(r *http.Request) (int, interface{}, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	var req struct{
+		Name	*string	`json:"name"`
+		Price	*int	`json:"price"`
+	}
+	if err = decodeBody(r, &req); err != nil {
+		return 0, nil, err
+	}
+	kind, err := db.GetDishKindByID(id)
+	if err != nil {
+		return 0, nil, restDBError(err)
+	}
+	if req.Name != nil {
+		if strings.TrimSpace(*req.Name) == "" {
+			return 0, nil, invalidParam("name", "must not be empty")
+		}
+		kind.Repr = *req.Name
+	}
+	if req.Price != nil {
+		if *req.Price < 0 {
+			return 0, nil, invalidParam("price", "must not be negative")
+		}
+		kind.Price = *req.Price
+	}
+	if err = db.UpdateDishKind(kind); err != nil {
+		return 0, nil, restDBError(err)
+	}
+	return http.StatusOK, newKindV1(kind), nil
+}
+
+func deleteKind(r *http.Request) (int, interface{}, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = db.DelDishKind(id); err != nil {
+		return 0, nil, restDBError(err)
+	}
+	return http.StatusNoContent, nil, nil
+}
+
+// ======== orders ========
+
+// Statuses that can be set through the API
+var orderStatuses = []OrderStatus{
+	StatusNew, StatusAccepted, StatusCooking, StatusDelivering, StatusDelivered, StatusCancelled,
+}
+
+func validStatus(status OrderStatus) bool {
+	for _, s := range orderStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func listOrders(r *http.Request) (int, interface{}, error) {
+	status := OrderStatus(r.URL.Query().Get("status"))
+	if status != "" && !validStatus(status) {
+		return 0, nil, invalidParam("status", "unknown status %q", status)
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	limit, err := queryInt(r, "limit", defaultOrdersLimit)
+	if err != nil {
+		return 0, nil, err
+	}
+	if limit == 0 || limit > maxOrdersLimit {
+		return 0, nil, invalidParam("limit", "must be between 1 and %d", maxOrdersLimit)
+	}
+
+	orders, total, err := db.GetOrders(status, offset, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	res := make([]orderV1, 0, len(orders))
+	for i := range orders {
+		res = append(res, newOrderV1(&orders[i]))
+	}
+	return http.StatusOK, map[string]interface{}{
+		"orders": res,
+		"total": total,
+		"offset": offset,
+		"limit": limit,
+	}, nil
+}
+
+func getOrder(r *http.Request) (int, interface{}, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	order, err := db.GetOrder(id)
+	if err != nil {
+		return 0, nil, restDBError(err)
+	}
+	return http.StatusOK, newOrderV1(order), nil
+}
+
+func createOrder(r *http.Request) (int, interface{}, error) {
+	var req struct{
+		Items		[]OrderItem	`json:"items"`
+		OfferID		int			`json:"offer_id"`
+		PromoCode	string		`json:"promo_code"`
+		// delivery details are optional for the orders made by admins
+		Delivery	Delivery	`json:"delivery"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if len(req.Items) == 0 {
+		return 0, nil, invalidParam("items", "must not be empty")
+	}
+	for _, item := range req.Items {
+		if item.Quantity <= 0 {
+			return 0, nil, invalidParam("items", "invalid quantity of dish %d: %d", item.DishID, item.Quantity)
+		}
+		// prices are set by the server
+		if item.Price != 0 {
+			return 0, nil, invalidParam("items", "price must not be set")
+		}
+	}
+
+	order := &Order{Items: req.Items, OfferID: req.OfferID, PromoCode: req.PromoCode, Delivery: req.Delivery}
+	bill, err := db.RegisterOrder(order)
+	var orderErr *db.OrderError
+	switch {
+	case err == nil:
+		break
+	case errors.As(err, &orderErr):
+		restErr := &restError{
+			Status:  http.StatusConflict,
+			Code:    "out_of_stock",
+			Message: err.Error(),
+			Details: map[string]int{"dish_id": orderErr.DishID},
+		}
+		if errors.Is(err, db.ErrBadID) {
+			restErr.Status, restErr.Code = http.StatusUnprocessableEntity, "unknown_dish"
+		}
+		return 0, nil, restErr
+	// the only other resource referenced by id
+	case errors.Is(err, db.ErrBadID):
+		return 0, nil, newRestError(http.StatusUnprocessableEntity, "unknown_offer", "there is no offer %d", req.OfferID)
+	default:
+		return 0, nil, restDBError(err)
+	}
+
+	created, err := db.GetOrder(order.ID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, map[string]interface{}{
+		"order": newOrderV1(created),
+		"bill": bill,
+	}, nil
+}
+
+func patchOrder(r *http.Request) (int, interface{}, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	var req struct{
+		Status	OrderStatus	`json:"status"`
+		// recorded to the status history
+		Comment	string		`json:"comment"`
+	}
+	if err = decodeBody(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if !validStatus(req.Status) {
+		return 0, nil, invalidParam("status", "unknown status %q", req.Status)
+	}
+
+	if err = db.SetOrderStatus(id, req.Status, adminActor(r), req.Comment); err != nil {
+		return 0, nil, restDBError(err)
+	}
+	order, err := db.GetOrder(id)
+	if err != nil {
+		return 0, nil, restDBError(err)
+	}
+	return http.StatusOK, newOrderV1(order), nil
+}
+
+// ======== offers ========
+
+func listOffers(r *http.Request) (int, interface{}, error) {
+	offers, err := db.GetOffers(r.URL.Query().Get("all") == "true")
+	if err != nil {
+		return 0, nil, err
+	}
+	res := make([]offerV1, 0, len(offers))
+	for i := range offers {
+		res = append(res, newOfferV1(&offers[i]))
+	}
+	return http.StatusOK, map[string]interface{}{"offers": res}, nil
+}
+
+func getOffer(r *http.Request) (int, interface{}, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	offer, err := db.GetOffer(id)
+	if err != nil {
+		return 0, nil, restDBError(err)
+	}
+	return http.StatusOK, newOfferV1(offer), nil
+}
+
+// Convert the slots from the request body to the offer items.
+func offerItemsV1(slots []offerSlotV1) ([]OfferItem, error) {
+	if len(slots) == 0 {
+		return nil, invalidParam("items", "offer must have at least one slot")
+	}
+	items := make([]OfferItem, 0, len(slots))
+	kindIDs := make([]int, 0, len(slots))
+	for _, slot := range slots {
+		if slot.Quantity <= 0 {
+			return nil, invalidParam("items", "invalid quantity of kind %d: %d", slot.KindID, slot.Quantity)
+		}
+		if containsInt(kindIDs, slot.KindID) {
+			return nil, invalidParam("items", "kind %d is in more than one slot", slot.KindID)
+		}
+		kindIDs = append(kindIDs, slot.KindID)
+		kind, err := referencedKind(slot.KindID)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, OfferItem{Kind: kind, Quantity: slot.Quantity})
+	}
+	return items, nil
+}
+
+func createOffer(r *http.Request) (int, interface{}, error) {
+	var req struct{
+		Name	string			`json:"name"`
+		Price	*int			`json:"price"`
+		Expires	*time.Time		`json:"expires"`
+		Items	[]offerSlotV1	`json:"items"`
+	}
+	if err := decodeBody(r, &req); err != nil {
+		return 0, nil, err
+	}
+	switch {
+	case strings.TrimSpace(req.Name) == "":
+		return 0, nil, invalidParam("name", "must not be empty")
+	case req.Price == nil:
+		return 0, nil, invalidParam("price", "is required")
+	case *req.Price < 0:
+		return 0, nil, invalidParam("price", "must not be negative")
+	}
+	offer := &Offer{Name: req.Name, Price: *req.Price}
+	if req.Expires != nil {
+		offer.Expires = *req.Expires
+	}
+	var err error
+	if offer.Items, err = offerItemsV1(req.Items); err != nil {
+		return 0, nil, err
+	}
+
+	if offer.ID, err = db.NewOffer(offer); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, newOfferV1(offer), nil
+}
+
+func patchOffer(r *http.Request) (int, interface{}, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	var req struct{
+		Name	*string			`json:"name"`
+		Price	*int			`json:"price"`
+		// null makes the offer permanent
+		Expires	json.RawMessage	`json:"expires"`
+		Items	[]offerSlotV1	`json:"items"`
+	}
+	if err = decodeBody(r, &req); err != nil {
+		return 0, nil, err
+	}
+	offer, err := db.GetOffer(id)
+	if err != nil {
+		return 0, nil, restDBError(err)
+	}
+
+	if req.Name != nil {
+		if strings.TrimSpace(*req.Name) == "" {
+			return 0, nil, invalidParam("name", "must not be empty")
+		}
+		offer.Name = *req.Name
+	}
+	if req.Price != nil {
+		if *req.Price < 0 {
+			return 0, nil, invalidParam("price", "must not be negative")
+		}
+		offer.Price = *req.Price
+	}
+	if req.Expires != nil {
+		var expires *time.Time
+		if err = json.Unmarshal(req.Expires, &expires); err != nil {
+			return 0, nil, invalidParam("expires", "must be an RFC 3339 time or null")
+		}
+		offer.Expires = time.Time{}
+		if expires != nil {
+			offer.Expires = *expires
+		}
+	}
+	if req.Items != nil {
+		if offer.Items, err = offerItemsV1(req.Items); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if err = db.UpdateOffer(offer); err != nil {
+		return 0, nil, restDBError(err)
+	}
+	return http.StatusOK, newOfferV1(offer), nil
+}
+
+func deleteOffer(r *http.Request) (int, interface{}, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = db.DelOffer(id); err != nil {
+		return 0, nil, restDBError(err)
+	}
+	return http.StatusNoContent, nil, nil
+}
@@ -1,66 +1,151 @@
 package admin
 
 import (
-	"bytes"
-	"crypto/sha1"
-	"encoding/hex"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"net/http"
+
+	db "github.com/xopoww/korm/database"
+	. "github.com/xopoww/korm/types"
 )
 
+// Name of the cookie holding the session token
+const sessionCookie = "session"
+
+// 	If InsecureCookies is true, the session cookie is sent without the Secure attribute.
+// It is meant only for local development over plain HTTP.
+var InsecureCookies = false
+
 // 	Check whether the client is authorized
 // Returns:
 //
-// - nil, if the client is authorized;
+// - the session, if the client is authorized;
 //
-// - http.ErrNoCookie, if the client is not authorized;
+// - http.ErrNoCookie, if the client is not authorized (or the session has expired);
 //
 // - other error, if something went wrong
-func checkAuthCookie(r *http.Request)error {
-	username, err := r.Cookie("username")
+func checkAuthCookie(r *http.Request) (*AdminSession, error) {
+	cookie, err := r.Cookie(sessionCookie)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	token, err := r.Cookie("auth")
-	if err != nil {
-		return err
+	session, err := db.GetSession(cookie.Value)
+	if errors.Is(err, db.ErrNoSession) {
+		return nil, http.ErrNoCookie
 	}
+	return session, err
+}
 
-	tokenBytes := make([]byte, hex.DecodedLen(len(token.Value)))
-	_, err = hex.Decode(tokenBytes, []byte(token.Value))
-	if err != nil {
-		return err
+// 	Send the session cookie to the client.
+// If token is empty, the cookie is deleted.
+func setSessionCookie(w http.ResponseWriter, token string) {
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(db.SessionLifetime.Seconds()),
+		Secure:   !InsecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
 	}
-	if bytes.Equal(tokenBytes, createAuthToken(username.Value)) {
-		return nil
-	} else {
-		return http.ErrNoCookie
+	if token == "" {
+		cookie.MaxAge = -1
 	}
+	http.SetCookie(w, cookie)
+}
+
+type sessionKey struct{}
+
+// Attach the session to the request context.
+func withSession(r *http.Request, session *AdminSession) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionKey{}, session))
 }
 
+// 	Get the session of the request (nil if the request hasn't gone through authHandler).
+func sessionFrom(r *http.Request) *AdminSession {
+	session, _ := r.Context().Value(sessionKey{}).(*AdminSession)
+	return session
+}
 
-// 	Create auth cookie value for user session
-func createAuthToken(username string)[]byte {
-	hash := sha1.New()
-	hash.Write([]byte(username))
-	// TODO: figure out a better way to add key
-	return hash.Sum(authTokenKey)
+// 	Check the CSRF token of the request. The token is taken from the X-CSRF-Token header
+// or, if there is no such header, from the "csrf_token" parameter.
+func checkCSRF(r *http.Request) error {
+	session := sessionFrom(r)
+	if session == nil {
+		return errors.New("not authenticated")
+	}
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.Form.Get("csrf_token")
+	}
+	if token == "" {
+		return errors.New("missing CSRF token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+		return errors.New("invalid CSRF token")
+	}
+	return nil
 }
-var authTokenKey = []byte("can be literally anything")
 
+// ======== permissions ========
 
-// authHandler wraps another http.Handler inside of it. It checks client's "username" and "auth"
-// cookies and, if they aren't present / have invalid values, either redirects to login page
+// permission is a right to use a part of the admin panel.
+type permission string
+
+const (
+	// any admin may do it
+	permAny permission = ""
+	// managing dishes and dish kinds
+	permMenu permission = "menu"
+	// viewing orders and changing their statuses
+	permOrders permission = "orders"
+	// making orders, special offers, promo codes and loyalty points
+	permSales permission = "sales"
+	// managing other admins
+	permAdmins permission = "admins"
+)
+
+var rolePermissions = map[AdminRole][]permission{
+	RoleOwner:   {permMenu, permOrders, permSales, permAdmins},
+	RoleManager: {permMenu, permOrders, permSales},
+	RoleCook:    {permMenu, permOrders},
+	RoleCourier: {permOrders},
+}
+
+// Check whether the admin with the role has the permission.
+func allowed(role AdminRole, perm permission) bool {
+	if perm == permAny {
+		return true
+	}
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// authHandler wraps another http.Handler inside of it. It checks client's session cookie
+// and, if it isn't present / the session has expired, either redirects to login page
 // or returns http.StatusForbidden (depends on redirect field).
+// If the admin's role doesn't have the permission perm, http.StatusForbidden is returned.
+// The session is passed to the next handler in the request context (see sessionFrom).
 type authHandler struct {
 	next http.Handler
 	redirect bool
+	perm permission
 }
 func (h authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	err := checkAuthCookie(r)
+	session, err := checkAuthCookie(r)
 	switch err {
 	case nil:
 		// authenticated
-		h.next.ServeHTTP(w, r)
+		if !allowed(session.Role, h.perm) {
+			http.Error(w, "permission denied: " + string(h.perm), http.StatusForbidden)
+			return
+		}
+		h.next.ServeHTTP(w, withSession(r, session))
 		return
 	case http.ErrNoCookie:
 		// not authenticated
@@ -79,10 +164,153 @@ func (h authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // 	Wrap a handler into authHandler
-func mustAuth(next http.Handler)http.Handler {
-	return authHandler{next: next, redirect: true}
+func mustAuth(perm permission, next http.Handler)http.Handler {
+	return authHandler{next: next, redirect: true, perm: perm}
+}
+
+func mustAuthAPI(perm permission, next http.Handler) http.Handler {
+	return authHandler{next: next, redirect: false, perm: perm}
 }
 
-func mustAuthAPI(next http.Handler) http.Handler {
-	return authHandler{next: next, redirect: false}
-}
\ No newline at end of file
+// ======== session methods ========
+
+// Field of the session methods' responses holding the new session token.
+// It is moved to the cookie by sessionHandler and is never sent in the body.
+const sessionTokenField = "session_token"
+
+// 	sessionHandler serves a method that manages the session cookie.
+// If the method puts sessionTokenField into the response, the cookie is set to its value
+// (or deleted, if the value is empty).
+type sessionHandler struct {
+	spec *methodSpec
+}
+
+func (h sessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	apiMethod(func(r *http.Request)(map[string]interface{}, error) {
+		if err := r.ParseForm(); err != nil {
+			return respondError(err)
+		}
+		response, err := h.spec.call(r)
+		if token, found := response[sessionTokenField].(string); found && err == nil {
+			delete(response, sessionTokenField)
+			setSessionCookie(w, token)
+		}
+		return response, err
+	}).ServeHTTP(w, r)
+}
+
+// Log in: check the credentials and start a new session.
+var authSpec = &methodSpec{
+	summary: "log in (the session cookie is set on success)",
+	public: true,
+	postOnly: true,
+	params: []apiParam{
+		stringParam("username", "username of the admin").required(),
+		stringParam("password", "password of the admin").required(),
+	},
+	result: apiFields{"csrf_token": ""},
+	handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+		username := args.String("username")
+		err := db.CheckAdmin(username, args.String("password"))
+		switch {
+		case err == nil:
+			break
+		case errors.Is(err, db.ErrBadAdmin):
+			return respondError(err)
+		default:
+			return nil, err
+		}
+
+		token, session, err := db.NewSession(username)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"ok": true,
+			"csrf_token": session.CSRFToken,
+			sessionTokenField: token,
+		}, nil
+	},
+}
+
+// Log out: end the current session.
+var logoutSpec = &methodSpec{
+	summary: "log out (end the current session)",
+	postOnly: true,
+	handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+		// the cookie has been checked by authHandler
+		cookie, err := r.Cookie(sessionCookie)
+		if err != nil {
+			return nil, err
+		}
+		if err = db.DeleteSession(cookie.Value); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"ok": true,
+			sessionTokenField: "",
+		}, nil
+	},
+}
+
+// Log out everywhere: end all sessions of the admin.
+var logoutAllSpec = &methodSpec{
+	summary: "log out everywhere (end all sessions of the admin)",
+	postOnly: true,
+	result: apiFields{"sessions": 0},
+	handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+		n, err := db.DeleteAdminSessions(sessionFrom(r).Username)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"ok": true,
+			"sessions": n,
+			sessionTokenField: "",
+		}, nil
+	},
+}
+
+// Change the password of the admin. All sessions of the admin are ended and a new one is started.
+var changePasswordSpec = &methodSpec{
+	summary: "change the password of the current admin (all other sessions are ended)",
+	postOnly: true,
+	params: []apiParam{
+		stringParam("old_password", "current password").required(),
+		stringParam("new_password", "new password").required(),
+	},
+	result: apiFields{"csrf_token": ""},
+	handler: func(r *http.Request, args apiArgs)(map[string]interface{}, error) {
+		username := sessionFrom(r).Username
+		err := db.ChangeAdminPassword(username, args.String("old_password"), args.String("new_password"))
+		switch {
+		case err == nil:
+			break
+		case errors.Is(err, db.ErrBadAdmin), errors.Is(err, db.ErrWeakPassword):
+			return respondError(err)
+		default:
+			return nil, err
+		}
+
+		if _, err = db.DeleteAdminSessions(username); err != nil {
+			return nil, err
+		}
+		token, session, err := db.NewSession(username)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"ok": true,
+			"csrf_token": session.CSRFToken,
+			sessionTokenField: token,
+		}, nil
+	},
+}
+
+// Session methods by name (they are served apart from Methods because they set the cookie).
+var sessionMethods = map[string]*methodSpec{
+	"auth": authSpec,
+	"logout": logoutSpec,
+	"logout_all": logoutAllSpec,
+	"change_password": changePasswordSpec,
+}
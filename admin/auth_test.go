@@ -0,0 +1,193 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	db "github.com/xopoww/korm/database"
+	. "github.com/xopoww/korm/types"
+)
+
+// Add an admin with the role and start a session of theirs.
+func addTestSession(t *testing.T, username string, role AdminRole) (string, *AdminSession) {
+	t.Helper()
+	if err := db.AddAdmin(username, "password", "Test Admin", role); err != nil {
+		t.Fatalf("add admin %s: %s", username, err)
+	}
+	token, session, err := db.NewSession(username)
+	if err != nil {
+		t.Fatalf("new session of %s: %s", username, err)
+	}
+	return token, session
+}
+
+func TestCheckCSRF(t *testing.T) {
+	session := &AdminSession{Username: "csrf", Role: RoleOwner, CSRFToken: "right"}
+	tests := []struct {
+		name    string
+		session *AdminSession
+		header  string
+		form    string
+		wantErr bool
+	}{
+		{"no session", nil, "right", "", true},
+		{"no token", session, "", "", true},
+		{"wrong header", session, "wrong", "", true},
+		{"wrong form", session, "", "wrong", true},
+		{"header", session, "right", "", false},
+		{"form", session, "", "right", false},
+		// the header takes precedence
+		{"right header, wrong form", session, "right", "wrong", false},
+		{"wrong header, right form", session, "wrong", "right", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := url.Values{}
+			if tt.form != "" {
+				body.Set("csrf_token", tt.form)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/api/test", strings.NewReader(body.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.header != "" {
+				r.Header.Set("X-CSRF-Token", tt.header)
+			}
+			if err := r.ParseForm(); err != nil {
+				t.Fatalf("parse form: %s", err)
+			}
+			if tt.session != nil {
+				r = withSession(r, tt.session)
+			}
+			if err := checkCSRF(r); (err != nil) != tt.wantErr {
+				t.Errorf("checkCSRF() = %v, want error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	token, _ := addTestSession(t, "auth_owner", RoleOwner)
+
+	tests := []struct {
+		name     string
+		cookie   string
+		redirect bool
+		wantCode int
+	}{
+		{"no cookie (API)", "", false, http.StatusForbidden},
+		{"no cookie (page)", "", true, http.StatusTemporaryRedirect},
+		{"unknown session", token + "0", false, http.StatusForbidden},
+		{"session", token, false, http.StatusOK},
+		{"session (page)", token, true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var session *AdminSession
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				session = sessionFrom(r)
+			})
+			r := httptest.NewRequest(http.MethodGet, "/api/test", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			authHandler{next: next, redirect: tt.redirect, perm: permAny}.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if reached := session != nil; reached != (tt.wantCode == http.StatusOK) {
+				t.Errorf("next handler reached: %t, want %t", reached, !reached)
+			}
+			if session != nil && session.Username != "auth_owner" {
+				t.Errorf("got session of %s, want auth_owner", session.Username)
+			}
+		})
+	}
+
+	t.Run("logged out", func(t *testing.T) {
+		if err := db.DeleteSession(token); err != nil {
+			t.Fatalf("delete session: %s", err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/api/test", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+		w := httptest.NewRecorder()
+		authHandler{next: http.NotFoundHandler(), perm: permAny}.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+		}
+	})
+}
+
+func TestMethodPermissions(t *testing.T) {
+	tokens := make(map[AdminRole]string)
+	for _, role := range []AdminRole{RoleOwner, RoleManager, RoleCook, RoleCourier} {
+		tokens[role], _ = addTestSession(t, "perm_"+string(role), role)
+	}
+
+	tests := []struct {
+		method string
+		role   AdminRole
+		want   bool
+	}{
+		{"new_dish", RoleOwner, true},
+		{"new_dish", RoleManager, true},
+		{"new_dish", RoleCook, true},
+		{"new_dish", RoleCourier, false},
+		{"order_status", RoleCook, true},
+		{"order_status", RoleCourier, true},
+		{"cancel_order", RoleCourier, true},
+		{"order", RoleManager, true},
+		{"order", RoleCook, false},
+		{"order", RoleCourier, false},
+		{"new_offer", RoleManager, true},
+		{"new_offer", RoleCook, false},
+		{"new_promo", RoleManager, true},
+		{"new_promo", RoleCourier, false},
+		{"adjust_points", RoleManager, true},
+		{"adjust_points", RoleCook, false},
+		{"del_dish", RoleCourier, false},
+		{"admins", RoleOwner, true},
+		{"admins", RoleManager, false},
+		{"invite_admin", RoleOwner, true},
+		{"invite_admin", RoleManager, false},
+		{"set_admin_role", RoleCook, false},
+		{"disable_admin", RoleCourier, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" by "+string(tt.role), func(t *testing.T) {
+			spec, found := Methods[tt.method]
+			if !found {
+				t.Fatalf("no method %s", tt.method)
+			}
+			if got := allowed(tt.role, spec.perm); got != tt.want {
+				t.Errorf("allowed(%s, %q) = %t, want %t", tt.role, spec.perm, got, tt.want)
+			}
+
+			reached := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			})
+			r := httptest.NewRequest(http.MethodPost, "/api/"+tt.method, nil)
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tokens[tt.role]})
+			w := httptest.NewRecorder()
+			mustAuthAPI(spec.perm, next).ServeHTTP(w, r)
+
+			if reached != tt.want {
+				t.Errorf("method reached: %t, want %t", reached, tt.want)
+			}
+			if !tt.want && w.Code != http.StatusForbidden {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+
+	// every method is restricted to some of the roles
+	for name, spec := range Methods {
+		if spec.perm == permAny {
+			t.Errorf("method %s is allowed to any admin", name)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	db "github.com/xopoww/korm/database"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "korm")
+	if err != nil {
+		panic(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	db.Start(&db.Config{
+		Filename:   filepath.Join(dir, "test.db"),
+		InitScript: "../database/database_creation.sql",
+		Logger:     logger,
+	})
+
+	code := m.Run()
+	db.Close()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
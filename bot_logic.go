@@ -1,221 +1,307 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/xopoww/korm/bots"
+	db "github.com/xopoww/korm/database"
 	. "github.com/xopoww/korm/types"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
-const menuText = "Наше меню:"
-
-//type UserSession struct {
-//	MenuKeys		*bots.Keyboard
-//	KindKeys		map[int]*bots.Keyboard
-//	CurrentOrder	*Order
-//}
-//
-//var sessions map[int]UserSession
-
-//func createMenuKeyboard() (*bots.Keyboard, error) {
-//	kinds, err := db.GetDishKinds()
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	keyboard := &bots.Keyboard{}
-//	for _, kind := range kinds {
-//		button := bots.KeyboardButton{
-//			Label: kind.Repr,
-//			Action: "menu",
-//			Argument: fmt.Sprint(kind.ID),
-//		}
-//		keyboard.AddRow(button)
-//	}
-//	return keyboard, nil
-//}
-
-//func createDishesKeyboard(kindID int) (*bots.Keyboard, error) {
-//	dishes, err := db.GetDishesByKind(DishKind{ID: kindID})
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	keyboard := &bots.Keyboard{}
-//	for _, dish := range dishes {
-//		button := bots.KeyboardButton{
-//			Label: fmt.Sprintf("%s (%d)", dish.Name, dish.Quantity),
-//			Action: "doodle",
-//		}
-//		keyboard.AddRow(button)
-//	}
-//	back := bots.KeyboardButton{
-//		Label: "назад",
-//		Action: "menu",
-//		Argument: "back",
-//	}
-//	keyboard.AddRow(back)
-//	return keyboard, nil
-//}
-
-//func menuCallback(bot bots.BotHandle, cq * bots.CallbackQuery) {
-//	var (
-//		keys *bots.Keyboard
-//		err error
-//	)
-//	switch cq.Argument {
-//	case "back":
-//		keys, err = createMenuKeyboard()
-//		if err != nil {
-//			bot.Errorf("Create menu keyboard: %s", err)
-//			return
-//		}
-//	default:
-//		kindID, err := strconv.Atoi(cq.Argument)
-//		if err != nil {
-//			bot.Errorf("Atoi (string %s): %s", cq.Argument, err)
-//			return
-//		}
-//		keys, err = createDishesKeyboard(kindID)
-//		if err != nil {
-//			bot.Errorf("Create dishes keyboard (id %d): %s", kindID, err)
-//			return
-//		}
-//	}
-//	err = bot.EditMessage(cq.From, cq.MessageID, menuText, keys)
-//	if err != nil {
-//		bot.Errorf("Edit message: %s", err)
-//	}
-//}
-
-func createMenuKeyboard() (*bots.Keyboard, error) {
-	keys := bots.Keyboard{};
-	keys.AddRow(bots.KeyboardButton{
-		Label:    "Кормы",
-		Action:   "menu",
-		Argument: "0",
-	})
-	keys.AddRow(bots.KeyboardButton{
-		Label:    "Супы",
-		Action:   "menu",
-		Argument: "1",
-	})
-	keys.AddRow(bots.KeyboardButton{
-		Label:		"Напики",
-		Action:		"menu",
-		Argument:	"2",
-	})
+// Time the user has to reply to a question of the bot
+const convTimeout = 30 * time.Minute
+
+// Pending multi-step dialogs with the users
+var conversations = bots.NewConversations(db.ConvStorage{}, convTimeout)
+
+// Get the text of the message localized for the user.
+func tr(user *User, key string, a ...interface{}) string {
+	return bots.Text(user.Locale, key, a...)
+}
+
+// Create a keyboard with the list of dish kinds and order controls.
+func createMenuKeyboard(user *User) (*bots.Keyboard, error) {
+	kinds, err := db.GetDishKinds()
+	if err != nil {
+		return nil, fmt.Errorf("get dish kinds: %w", err)
+	}
+
+	keys := &bots.Keyboard{}
+	for _, kind := range kinds {
+		keys.AddRow(bots.KeyboardButton{
+			Label:    kind.Repr,
+			Action:   "menu",
+			Argument: fmt.Sprint(kind.ID),
+		})
+	}
+	offers, err := db.GetOffers(false)
+	if err != nil {
+		return nil, fmt.Errorf("get offers: %w", err)
+	}
+	if len(offers) != 0 {
+		keys.AddRow(bots.KeyboardButton{
+			Label:  tr(user, "btn_offers"),
+			Color:  bots.ColorPrimary,
+			Action: "offers",
+		})
+	}
 	keys.AddRow(bots.KeyboardButton{
-		Label:		"Заказать",
+		Label:		tr(user, "btn_order"),
+		Color:		bots.ColorPositive,
 		Action:		"order",
 	}, bots.KeyboardButton{
-		Label: "Сбросить",
+		Label: tr(user, "btn_reset"),
+		Color: bots.ColorNegative,
 		Action: "back",
 		Argument: "cancel",
 	})
-	return &keys, nil
+	return keys, nil
 }
 
-type DishMock struct {
-	name string
-	price int
-	id	int
+// Create a keyboard with the list of dishes of the specific kind.
+// Dishes that are sold out are not shown.
+func createDishesKeyboard(user *User, kindID int) (*bots.Keyboard, error) {
+	kind, err := db.GetDishKindByID(kindID)
+	if err != nil {
+		return nil, fmt.Errorf("get dish kind by id: %w", err)
+	}
+	dishes, err := db.GetDishesByKind(*kind)
+	if err != nil {
+		return nil, fmt.Errorf("get dishes by kind: %w", err)
+	}
+
+	keys := &bots.Keyboard{}
+	for _, dish := range dishes {
+		if dish.Quantity <= 0 {
+			continue
+		}
+		keys.AddRow(bots.KeyboardButton{
+			Label: tr(user, "dish_button", dish.Name, dish.UnitPrice(), dish.Quantity),
+			Action: "add",
+			Argument: fmt.Sprint(dish.ID),
+		})
+	}
+	keys.AddRow(bots.KeyboardButton{Label: tr(user, "btn_back"), Action: "back"})
+	return keys, nil
 }
 
-var (
-	korms = []DishMock{
-	{name: "Курица терияки", price: 185, id: 1},
-	{name: "Паста карбонара", price: 225, id: 2},
-	{name: "Жаркое из свинины", price: 185, id: 3},
+// 	Get the offer chosen for the user's cart (nil if there is none).
+// If the offer has been deleted or has expired, it is removed from the cart.
+func cartOffer(user *User) (*Offer, error) {
+	offerID, err := db.GetCartOffer(user.UID)
+	if err != nil || offerID == 0 {
+		return nil, err
+	}
+	offer, err := db.GetOffer(offerID)
+	if err == nil && (offer.Expires.IsZero() || offer.Expires.After(time.Now())) {
+		return offer, nil
 	}
+	if err != nil && !errors.Is(err, db.ErrBadID) {
+		return nil, fmt.Errorf("get offer (id %d): %w", offerID, err)
+	}
+	return nil, db.SetCartOffer(user.UID, 0)
+}
 
-	soups = []DishMock{
-		{name: "Борщ", price: 105, id: 4},
+// Create a keyboard with the list of active offers.
+func createOffersKeyboard(user *User) (*bots.Keyboard, error) {
+	offers, err := db.GetOffers(false)
+	if err != nil {
+		return nil, fmt.Errorf("get offers: %w", err)
 	}
+	keys := &bots.Keyboard{}
+	for _, offer := range offers {
+		keys.AddRow(bots.KeyboardButton{
+			Label:    tr(user, "offer_button", offer.Name, offer.Price),
+			Action:   "offer",
+			Argument: fmt.Sprint(offer.ID),
+		})
+	}
+	keys.AddRow(bots.KeyboardButton{
+		Label:    tr(user, "btn_no_offer"),
+		Action:   "offer",
+		Argument: "0",
+	})
+	keys.AddRow(bots.KeyboardButton{Label: tr(user, "btn_back"), Action: "back"})
+	return keys, nil
+}
 
-	drinks = []DishMock{
-		{name: "Апельсин-имбирь", price: 50, id: 5},
-		{name: "Ягодный пунш", price: 50, id: 6},
+// List the contents of the user's cart.
+func listCart(user *User) (string, error) {
+	items, err := db.GetCart(user.UID)
+	if err != nil {
+		return "", fmt.Errorf("get cart: %w", err)
 	}
-)
+	offer, err := cartOffer(user)
+	if err != nil {
+		return "", fmt.Errorf("cart offer: %w", err)
+	}
+	msg := ""
+	if offer != nil {
+		msg += tr(user, "cart_offer", offer.Name, offer.Price) + "\n"
+	}
+	if len(items) == 0 {
+		return msg + tr(user, "cart_empty"), nil
+	}
+	// dishes deleted after they had been put to the cart are skipped
+	available := make([]OrderItem, 0, len(items))
+	kindPortions := make(map[int]int)
+	for _, item := range items {
+		dish, err := db.GetDishByID(item.DishID)
+		if errors.Is(err, db.ErrBadID) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("get dish by id (%d): %w", item.DishID, err)
+		}
+		msg += tr(user, "cart_item", dish.Name, item.Quantity) + "\n"
+		available = append(available, item)
+		kindPortions[dish.Kind.ID] += item.Quantity
+	}
+	if len(available) == 0 {
+		return msg + tr(user, "cart_empty"), nil
+	}
+	offerID := 0
+	if offer != nil {
+		// show how the offer slots are filled
+		msg += "\n"
+		for _, slot := range offer.Items {
+			msg += tr(user, "offer_slot", slot.Kind.Repr, kindPortions[slot.Kind.ID], slot.Quantity) + "\n"
+		}
+		offerID = offer.ID
+	}
+	promo, err := db.GetCartPromo(user.UID)
+	if err != nil {
+		return "", fmt.Errorf("get cart promo: %w", err)
+	}
+	points, err := cartPoints(user)
+	if err != nil {
+		return "", fmt.Errorf("cart points: %w", err)
+	}
+	order := &Order{UID: user.UID, Items: available, OfferID: offerID, PromoCode: promo, Points: points}
+	bill, err := db.PriceOrder(order)
+	if text, ok := describePromoError(user, promo, err); ok {
+		// the cart has changed since the code was entered
+		msg += "\n" + text + "\n"
+		order.PromoCode = ""
+		bill, err = db.PriceOrder(order)
+	}
+	if err != nil {
+		return "", fmt.Errorf("price order: %w", err)
+	}
+	if discount := bill.Discount - bill.PromoDiscount - bill.Points; discount > 0 {
+		msg += "\n" + tr(user, "cart_discount", discount)
+	}
+	if bill.PromoCode != "" {
+		msg += "\n" + tr(user, "cart_promo", bill.PromoCode, bill.PromoDiscount)
+	}
+	if bill.Points > 0 {
+		msg += "\n" + tr(user, "cart_points", bill.Points)
+	}
+	msg += "\n" + tr(user, "cart_total", bill.Total)
+	return msg, nil
+}
 
-func getDishMockByID(id int) DishMock {
-	if id > 0 && id < 4 {
-		return korms[id - 1]
+// Replace the message with the list of the user's cart and the menu keyboard.
+func showCart(bot bots.BotHandle, user *User, messageID int) {
+	text, err := listCart(user)
+	if err != nil {
+		bot.Errorf("List cart (uid %d): %s", user.UID, err)
+		return
 	}
-	if id == 4 {
-		return soups[0]
+	keys, err := createMenuKeyboard(user)
+	if err != nil {
+		bot.Errorf("Create menu keyboard: %s", err)
+		return
 	}
-	if id > 4 && id < 7 {
-		return drinks[id - 5]
+	err = bot.EditMessage(user, messageID, text, keys)
+	if err != nil {
+		bot.Errorf("Edit message: %s", err)
 	}
-	return DishMock{}
 }
 
-func createDishKeyboard(kind string) *bots.Keyboard {
-	var dishes []DishMock
-	switch kind {
-	case "0":
-		dishes = korms
-	case "1":
-		dishes = soups
-	case "2":
-		dishes = drinks
-	}
-	keys := bots.Keyboard{}
-	for _, dish := range dishes {
+// Explain to the user why the order could not be made and offer to change the cart.
+func describeOrderError(user *User, orderErr *db.OrderError) (string, *bots.Keyboard) {
+	keys := &bots.Keyboard{}
+	dish, err := db.GetDishByID(orderErr.DishID)
+	if err != nil {
+		// the dish is no longer on the menu
 		keys.AddRow(bots.KeyboardButton{
-			Label: fmt.Sprintf("%s - %dр.", dish.name, dish.price),
-			Action: "add",
-			Argument: fmt.Sprint(dish.id),
+			Label:    tr(user, "btn_remove_dish"),
+			Action:   "remove",
+			Argument: fmt.Sprint(orderErr.DishID),
 		})
+		keys.AddRow(bots.KeyboardButton{Label: tr(user, "btn_change"), Action: "back"})
+		return tr(user, "dish_gone"), keys
 	}
-	keys.AddRow(bots.KeyboardButton{Label: "назад", Action: "back"})
-	return &keys
-}
 
-var OrderMock map[int]int
+	var text string
+	if dish.Quantity > 0 {
+		text = tr(user, "dish_low", dish.Quantity, dish.Name)
+		keys.AddRow(bots.KeyboardButton{
+			Label:    tr(user, "btn_fit", dish.Quantity),
+			Action:   "fit",
+			Argument: fmt.Sprint(dish.ID),
+		})
+	} else {
+		text = tr(user, "dish_sold_out", dish.Name)
+	}
+	keys.AddRow(bots.KeyboardButton{
+		Label:    tr(user, "btn_remove", dish.Name),
+		Action:   "remove",
+		Argument: fmt.Sprint(dish.ID),
+	})
+	keys.AddRow(bots.KeyboardButton{Label: tr(user, "btn_change"), Action: "back"})
+	return text, keys
+}
 
-func ListOrderMock() string {
-	if len(OrderMock) == 0 {
-		return "Ваш заказ пока что пуст. Добавьте блюда при помощи клавиатуры:"
+// Get the number of portions of the dish in the cart.
+func cartQuantity(items []OrderItem, dishID int) int {
+	for _, item := range items {
+		if item.DishID == dishID {
+			return item.Quantity
+		}
 	}
-	msg := ""
-	price := 0
-	for id, quantity := range OrderMock {
-		dish := getDishMockByID(id)
-		msg += fmt.Sprintf("%s - %d шт.\n", dish.name, quantity)
-		price += dish.price * quantity
-	}
-	msg += fmt.Sprintf("\nСтоимость заказа: %dр.", price)
-	return msg
+	return 0
 }
 
 func InitializeBots(handles ...bots.BotHandle) error {
-
-	menuKeys, _ := createMenuKeyboard()
+	addCheckoutSteps()
+	addHistorySteps()
+	db.SetStatusListener(statusNotifier(handles))
+	bots.SetCallbackStorage(db.CallbackStorage{})
 
 	startCommand := bots.Command{
-		Name:	"начать общение с ботом",
+		Name:	"cmd_start",
 		Label:	"start",
 		Action: func(bot bots.BotHandle, user *User) {
-			msg := fmt.Sprintf("Здравствуй, %s! Я - бот КОРМа. Напиши /order, чтобы сделать заказ.",
-				user.FirstName)
-			_, _ = bot.SendMessage(msg, user, nil)
+			// start over: drop the pending dialog (if any)
+			if err := conversations.Cancel(user); err != nil {
+				bot.Errorf("Cancel conversation (uid %d): %s", user.UID, err)
+			}
+			_, _ = bot.SendMessage(tr(user, "hello", user.FirstName), user, nil)
 		},
 	}
 
 	menuCommand := bots.Command{
-		Name:   "сделать заказ",
+		Name:   "cmd_order",
 		Label:  "order",
 		Action: func(bot bots.BotHandle, user *User) {
-			keys, err := createMenuKeyboard()
+			keys, err := createMenuKeyboard(user)
 			if err != nil {
 				bot.Errorf("Create menu keyboard: %s", err)
 				return
 			}
-			OrderMock = nil
-			_, err = bot.SendMessage(ListOrderMock(), user, keys)
+			text, err := listCart(user)
+			if err != nil {
+				bot.Errorf("List cart (uid %d): %s", user.UID, err)
+				return
+			}
+			_, err = bot.SendMessage(text, user, keys)
 			if err != nil {
 				bot.Errorf("Send message: %s", err)
 				return
@@ -223,73 +309,368 @@ func InitializeBots(handles ...bots.BotHandle) error {
 		},
 	}
 
+	syncCommand := bots.Command{
+		Name:   "cmd_sync",
+		Label:  "sync",
+		Action: func(bot bots.BotHandle, user *User) {
+			key, err := db.EmitSyncKey(user.ID, bot.IsVK())
+			switch {
+			case err == nil:
+				break
+			case errors.Is(err, db.ErrAlreadySynced):
+				_, _ = bot.SendMessage(tr(user, "already_synced"), user, nil)
+				return
+			default:
+				bot.Errorf("Emit sync key (id %d): %s", user.ID, err)
+				_, _ = bot.SendMessage(tr(user, "error"), user, nil)
+				return
+			}
+
+			if bot.IsVK() {
+				_, _ = bot.SendMessage(tr(user, "emit_key_vk", key), user, nil)
+			} else {
+				_, _ = bot.SendMessage(tr(user, "emit_key_tg", key), user, nil)
+			}
+		},
+	}
+
+	historyCommand := bots.Command{
+		Name:   "cmd_history",
+		Label:  "history",
+		Action: func(bot bots.BotHandle, user *User) {
+			showHistory(bot, user, 0, 0)
+		},
+	}
+
+	pointsCommand := bots.Command{
+		Name:   "cmd_points",
+		Label:  "points",
+		Action: func(bot bots.BotHandle, user *User) {
+			showPoints(bot, user)
+		},
+	}
+
+	languageCommand := bots.Command{
+		Name:   "cmd_language",
+		Label:  "language",
+		Action: func(bot bots.BotHandle, user *User) {
+			locales := bots.Locales()
+			codes := make([]string, 0, len(locales))
+			for code := range locales {
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+
+			keys := &bots.Keyboard{}
+			for _, code := range codes {
+				keys.AddRow(bots.KeyboardButton{
+					Label:    fmt.Sprintf("%s %s", locales[code], code),
+					Action:   "lang",
+					Argument: code,
+				})
+			}
+			_, err := bot.SendMessage(tr(user, "choose_language"), user, keys)
+			if err != nil {
+				bot.Errorf("Send message: %s", err)
+			}
+		},
+	}
+
 	for _, bot := range handles {
-		err := bot.RegisterCommands(startCommand, menuCommand)
+		bot.Use(CheckOrAddUser)
+
+		err := bot.RegisterCommands(startCommand, menuCommand, historyCommand, pointsCommand, syncCommand, languageCommand)
 		if err != nil {
 			return err
 		}
 
+		conversations.Register(bot)
+		bot.SetDefaultHandler(func(bot bots.BotHandle, m *bots.Message) {
+			if conversations.Handle(bot, m) {
+				return
+			}
+			switch {
+			case syncKeyRegexp.MatchString(m.Text):
+				useSyncKey(bot, m)
+			case strings.HasPrefix(m.Text, "/"):
+				_, _ = bot.SendMessage(tr(m.From, "unknown_command", m.Text), m.From, nil)
+			}
+		})
+
 		bot.AddCallbackHandler("menu", "",
 			func(bot bots.BotHandle, cq *bots.CallbackQuery){
-				_ = bot.EditMessage(cq.From, cq.MessageID, ListOrderMock(), createDishKeyboard(cq.Argument))
+				kindID, err := strconv.Atoi(cq.Argument)
+				if err != nil {
+					bot.Errorf("Atoi (string %s): %s", cq.Argument, err)
+					return
+				}
+				keys, err := createDishesKeyboard(cq.From, kindID)
+				if err != nil {
+					bot.Errorf("Create dishes keyboard (kind id %d): %s", kindID, err)
+					return
+				}
+				text, err := listCart(cq.From)
+				if err != nil {
+					bot.Errorf("List cart (uid %d): %s", cq.From.UID, err)
+					return
+				}
+				if err := bot.EditMessage(cq.From, cq.MessageID, text, keys); err != nil {
+					bot.Errorf("Edit message (menu): %s", err)
+				}
 			})
 
-		bot.AddCallbackHandler("add", "Добавлено в заказ",
+		bot.AddCallbackHandler("add", "added",
 			func(bot bots.BotHandle, cq *bots.CallbackQuery) {
-				if OrderMock == nil {
-					OrderMock = make(map[int]int)
+				uid := cq.From.UID
+				id, err := strconv.Atoi(cq.Argument)
+				if err != nil {
+					bot.Errorf("Atoi (string %s): %s", cq.Argument, err)
+					return
+				}
+				dish, err := db.GetDishByID(id)
+				if err != nil {
+					bot.Errorf("Get dish by id (%d): %s", id, err)
+					return
 				}
-				id, _ := strconv.Atoi(cq.Argument)
-				if _, found := OrderMock[id]; found {
-					OrderMock[id]++
-				} else {
-					OrderMock[id] = 1
+				items, err := db.GetCart(uid)
+				if err != nil {
+					bot.Errorf("Get cart (uid %d): %s", uid, err)
+					return
+				}
+				if dish.Quantity <= cartQuantity(items, id) {
+					bot.Debugf("Dish %d is out of stock, not adding it to the cart.", id)
+					return
 				}
-				_ = bot.EditMessage(cq.From, cq.MessageID, ListOrderMock(), menuKeys)
+				err = db.AddToCart(uid, id, 1)
+				if err != nil {
+					bot.Errorf("Add to cart (uid %d, dish id %d): %s", uid, id, err)
+					return
+				}
+				showCart(bot, cq.From, cq.MessageID)
 			})
 
 		bot.AddCallbackHandler("back", "",
 			func(bot bots.BotHandle, cq *bots.CallbackQuery){
+				// the cart is being changed, so the checkout (if any) is aborted
+				if err := conversations.Cancel(cq.From); err != nil {
+					bot.Errorf("Cancel conversation (uid %d): %s", cq.From.UID, err)
+				}
 				if cq.Argument == "cancel" {
-					OrderMock = nil
+					if err := db.ClearCart(cq.From.UID); err != nil {
+						bot.Errorf("Clear cart (uid %d): %s", cq.From.UID, err)
+						return
+					}
 				}
-				_ = bot.EditMessage(cq.From, cq.MessageID, ListOrderMock(), menuKeys)
+				showCart(bot, cq.From, cq.MessageID)
 			})
 
 		bot.AddCallbackHandler("order", "",
 			func(bot bots.BotHandle, cq *bots.CallbackQuery){
-				if len(OrderMock) == 0 {
+				uid := cq.From.UID
+				items, err := db.GetCart(uid)
+				if err != nil {
+					bot.Errorf("Get cart (uid %d): %s", uid, err)
 					return
 				}
-				_ = bot.EditMessage(cq.From, cq.MessageID, "", nil)
-				_, _ = bot.SendMessage("Ваш заказ успешно оформлен! Ожидайте, наш курьер с вами свяжется.",
-					cq.From, nil)
+				if len(items) == 0 {
+					return
+				}
+				// remove the menu, so that the cart is not changed during the checkout
+				text, err := listCart(cq.From)
+				if err != nil {
+					bot.Errorf("List cart (uid %d): %s", uid, err)
+					return
+				}
+				if err := bot.EditMessage(cq.From, cq.MessageID, text, nil); err != nil {
+					bot.Errorf("Edit message (order): %s", err)
+				}
+				startCheckout(bot, cq.From)
+			})
+
+		bot.AddCallbackHandler("confirm", "", confirmOrder)
+
+		bot.AddCallbackHandler("points", "", toggleUsePoints)
+
+		bot.AddCallbackHandler("offers", "",
+			func(bot bots.BotHandle, cq *bots.CallbackQuery){
+				keys, err := createOffersKeyboard(cq.From)
+				if err != nil {
+					bot.Errorf("Create offers keyboard: %s", err)
+					return
+				}
+				if err := bot.EditMessage(cq.From, cq.MessageID, tr(cq.From, "choose_offer"), keys); err != nil {
+					bot.Errorf("Edit message (offers): %s", err)
+				}
+			})
+
+		bot.AddCallbackHandler("offer", "cart_changed",
+			func(bot bots.BotHandle, cq *bots.CallbackQuery){
+				offerID, err := strconv.Atoi(cq.Argument)
+				if err != nil {
+					bot.Errorf("Atoi (string %s): %s", cq.Argument, err)
+					return
+				}
+				err = db.SetCartOffer(cq.From.UID, offerID)
+				if err != nil && !errors.Is(err, db.ErrBadID) {
+					bot.Errorf("Set cart offer (uid %d, offer id %d): %s", cq.From.UID, offerID, err)
+					return
+				}
+				showCart(bot, cq.From, cq.MessageID)
+			})
+
+		bot.AddCallbackHandler("hist", "",
+			func(bot bots.BotHandle, cq *bots.CallbackQuery){
+				page, err := strconv.Atoi(cq.Argument)
+				if err != nil {
+					bot.Errorf("Atoi (string %s): %s", cq.Argument, err)
+					return
+				}
+				showHistory(bot, cq.From, page, cq.MessageID)
+			})
+
+		bot.AddCallbackHandler("repeat", "added", repeatOrder)
+
+		bot.AddCallbackHandler("cancel", "", askCancelReason)
+
+		bot.AddCallbackHandler("remove", "removed",
+			func(bot bots.BotHandle, cq *bots.CallbackQuery){
+				uid := cq.From.UID
+				id, err := strconv.Atoi(cq.Argument)
+				if err != nil {
+					bot.Errorf("Atoi (string %s): %s", cq.Argument, err)
+					return
+				}
+				err = db.RemoveFromCart(uid, id)
+				if err != nil {
+					bot.Errorf("Remove from cart (uid %d, dish id %d): %s", uid, id, err)
+					return
+				}
+				showCart(bot, cq.From, cq.MessageID)
+			})
+
+		bot.AddCallbackHandler("fit", "cart_changed",
+			func(bot bots.BotHandle, cq *bots.CallbackQuery){
+				uid := cq.From.UID
+				id, err := strconv.Atoi(cq.Argument)
+				if err != nil {
+					bot.Errorf("Atoi (string %s): %s", cq.Argument, err)
+					return
+				}
+				dish, err := db.GetDishByID(id)
+				if err != nil {
+					bot.Errorf("Get dish by id (%d): %s", id, err)
+					return
+				}
+				items, err := db.GetCart(uid)
+				if err != nil {
+					bot.Errorf("Get cart (uid %d): %s", uid, err)
+					return
+				}
+				err = db.AddToCart(uid, id, dish.Quantity - cartQuantity(items, id))
+				if err != nil {
+					bot.Errorf("Add to cart (uid %d, dish id %d): %s", uid, id, err)
+					return
+				}
+				showCart(bot, cq.From, cq.MessageID)
+			})
+
+		bot.AddCallbackHandler("lang", "",
+			func(bot bots.BotHandle, cq *bots.CallbackQuery){
+				if !bots.HasLocale(cq.Argument) {
+					bot.Errorf("Unknown locale: %s", cq.Argument)
+					return
+				}
+				err := db.SetUserLocale(cq.From.ID, bot.IsVK(), cq.Argument)
+				if err != nil {
+					bot.Errorf("Set user locale (id %d): %s", cq.From.ID, err)
+					return
+				}
+				cq.From.Locale = cq.Argument
+				_ = bot.EditMessage(cq.From, cq.MessageID, tr(cq.From, "language_set"), nil)
 			})
 	}
 
 	return nil
 }
 
-//// Wrap a command handler to check if the user is in the database
-//// (and add him if he is not) and populate user.UID field.
-//func CheckOrAddUser(action func(bots.BotHandle, *User)) func(bots.BotHandle, *User) {
-//	return func(bot bots.BotHandle, user *User) {
-//		// TODO: figure out the best way to connect bot handle to database
-//		vk := false
-//
-//		uid, err := db.CheckUser(user.ID, vk)
-//		if err != nil {
-//			bot.Errorf("Check user (id %d): %s", user.ID, err)
-//			return
-//		}
-//		if uid == 0 {
-//			uid, err = db.AddUser(user, vk)
-//			if err != nil {
-//				bot.Errorf("Add user (id %d): %s", user.ID, err)
-//				return
-//			}
-//		}
-//		user.UID = uid
-//		action(bot, user)
-//	}
-//}
+// 	Create a listener that notifies the customers about the status changes of their orders.
+// The notification is sent via the bot (TG or VK) the order was placed with.
+func statusNotifier(handles []bots.BotHandle) func(db.StatusChange) {
+	return func(change db.StatusChange) {
+		for _, bot := range handles {
+			if bot.IsVK() != change.VK {
+				continue
+			}
+			user, err := db.GetNetworkUser(change.UID, change.VK)
+			if err != nil {
+				bot.Errorf("Get network user (uid %d): %s", change.UID, err)
+				return
+			}
+			text := tr(user, "status_" + string(change.To), change.OrderID)
+			if change.Comment != "" {
+				text += "\n" + tr(user, "status_comment", change.Comment)
+			}
+			if change.Points > 0 {
+				text += "\n" + tr(user, "points_credited", change.Points)
+			}
+			if _, err = bot.SendMessage(text, user, nil); err != nil {
+				bot.Errorf("Notify about order %d status: %s", change.OrderID, err)
+			}
+			return
+		}
+	}
+}
+
+// Sync keys emitted by db.EmitSyncKey look like this
+var syncKeyRegexp = regexp.MustCompile(`^[A-Z2-7]{8}$`)
+
+// Merge the user with the account in the other social network the key was emitted for.
+func useSyncKey(bot bots.BotHandle, m *bots.Message) {
+	err := db.UseSyncKey(m.Text, m.From.ID, bot.IsVK())
+	var key string
+	switch {
+	case err == nil:
+		key = "synced"
+	case errors.Is(err, db.ErrUnknownKey):
+		key = "unknown_key"
+	case errors.Is(err, db.ErrAlreadySynced):
+		key = "already_synced"
+	case errors.Is(err, db.ErrSameNetwork):
+		if bot.IsVK() {
+			key = "send_to_tg"
+		} else {
+			key = "send_to_vk"
+		}
+	default:
+		bot.Errorf("Use sync key (id %d): %s", m.From.ID, err)
+		key = "error"
+	}
+	_, _ = bot.SendMessage(tr(m.From, key), m.From, nil)
+}
+
+// Middleware that checks if the user is in the database (and adds him if he is not)
+// and populates user.UID and user.Locale fields.
+func CheckOrAddUser(bot bots.BotHandle, user *User) error {
+	vk := bot.IsVK()
+
+	uid, err := db.CheckUser(user.ID, vk)
+	if err != nil {
+		return fmt.Errorf("check user (id %d): %w", user.ID, err)
+	}
+	if uid == 0 {
+		uid, err = db.AddUser(user, vk)
+		if err != nil {
+			return fmt.Errorf("add user (id %d): %w", user.ID, err)
+		}
+	}
+	user.UID = uid
+
+	locale, err := db.GetUserLocale(user.ID, vk)
+	if err != nil {
+		return fmt.Errorf("get user locale (id %d): %w", user.ID, err)
+	}
+	if locale != "" {
+		user.Locale = locale
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package bots
+
+// Encoding of the callback data attached to the keyboard buttons
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/xopoww/korm/types"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 	Callback data formats:
+//
+// 	"1|<action>|<argument>" - version 1, action and argument are stored inline;
+// 	"r|<token>" - action and argument are stored in CallbackStorage under the token;
+// 	{"act": <action>, "arg": <argument>} - legacy JSON format (buttons sent by the older versions).
+const (
+	callbackVersion = "1"
+	callbackRef = "r"
+	callbackSep = "|"
+)
+
+const (
+	// how long the data of a stored callback is kept since the button was last sent
+	callbackTTL = 30 * 24 * time.Hour
+	// maximum number of callbacks kept by the in-memory storage
+	callbackMemorySize = 10000
+)
+
+var (
+	ErrInvalidAction = errors.New("invalid callback action")
+	ErrCallbackStoreFull = errors.New("callback store is full")
+	ErrCallbackExpired = errors.New("callback data has expired")
+)
+
+// CallbackStorage keeps the callback data that is too large to be sent with the button.
+type CallbackStorage interface {
+	// Save the data under the token. If the token is already saved, its data is replaced.
+	SaveCallback(token string, data *CallbackData) error
+	// Get the data saved under the token. Must return nil if there is none or it has expired.
+	GetCallback(token string) (*CallbackData, error)
+}
+
+// The storage is in memory (and the stored buttons stop working after a restart)
+// unless SetCallbackStorage is called.
+var callbacks CallbackStorage = &memCallbackStorage{entries: map[string]CallbackData{}}
+
+// 	Set the storage of the callback data that does not fit in the buttons.
+// Must be called before the bots are started.
+func SetCallbackStorage(storage CallbackStorage) {
+	callbacks = storage
+}
+
+// 	Encode the action and the argument of a button into callback data.
+// fits reports whether the encoded data satisfies the limits of the network.
+// If inline data does not fit, it is saved to the storage and a reference to it is returned.
+// The reference depends only on the action and the argument, so sending the same button again
+// doesn't take up more space in the storage (it only prolongs the data's life).
+func encodeCallback(action, argument string, fits func(string) bool) (string, error) {
+	if action == "" || strings.Contains(action, callbackSep) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidAction, action)
+	}
+	data := strings.Join([]string{callbackVersion, action, argument}, callbackSep)
+	if fits(data) {
+		return data, nil
+	}
+
+	token := callbackToken(data)
+	err := callbacks.SaveCallback(token, &CallbackData{
+		Action:   action,
+		Argument: argument,
+		Expires:  time.Now().Add(callbackTTL),
+	})
+	if err != nil {
+		return "", fmt.Errorf("store callback (action %s): %w", action, err)
+	}
+	data = callbackRef + callbackSep + token
+	if !fits(data) {
+		return "", fmt.Errorf("callback reference does not fit: %q", data)
+	}
+	return data, nil
+}
+
+// Decode the callback data produced by encodeCallback (or by the legacy JSON encoding).
+func decodeCallback(data string) (action, argument string, err error) {
+	if strings.HasPrefix(data, "{") {
+		var legacy struct {
+			Action		string	`json:"act"`
+			Argument	string	`json:"arg"`
+		}
+		if err = json.Unmarshal([]byte(data), &legacy); err != nil {
+			return "", "", fmt.Errorf("legacy callback data: %w", err)
+		}
+		return legacy.Action, legacy.Argument, nil
+	}
+
+	parts := strings.SplitN(data, callbackSep, 3)
+	switch {
+	case parts[0] == callbackVersion && len(parts) == 3:
+		return parts[1], parts[2], nil
+	case parts[0] == callbackRef && len(parts) == 2:
+		stored, err := callbacks.GetCallback(parts[1])
+		if err != nil {
+			return "", "", fmt.Errorf("get stored callback: %w", err)
+		}
+		if stored == nil {
+			return "", "", ErrCallbackExpired
+		}
+		return stored.Action, stored.Argument, nil
+	default:
+		return "", "", fmt.Errorf("unknown callback data format: %q", data)
+	}
+}
+
+// Token of the stored callback data (a hash of the inline data).
+func callbackToken(data string) string {
+	hash := sha256.Sum256([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(hash[:12])
+}
+
+// memCallbackStorage is the default in-memory CallbackStorage.
+type memCallbackStorage struct {
+	sync.Mutex
+	entries		map[string]CallbackData
+}
+
+func (s *memCallbackStorage) SaveCallback(token string, data *CallbackData) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.entries[token]; !found && len(s.entries) >= callbackMemorySize {
+		s.purge()
+		if len(s.entries) >= callbackMemorySize {
+			return ErrCallbackStoreFull
+		}
+	}
+	s.entries[token] = *data
+	return nil
+}
+
+func (s *memCallbackStorage) GetCallback(token string) (*CallbackData, error) {
+	s.Lock()
+	defer s.Unlock()
+	entry, found := s.entries[token]
+	if !found || time.Now().After(entry.Expires) {
+		delete(s.entries, token)
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+// Remove expired entries. Must be called with the lock held.
+func (s *memCallbackStorage) purge() {
+	now := time.Now()
+	for token, entry := range s.entries {
+		if now.After(entry.Expires) {
+			delete(s.entries, token)
+		}
+	}
+}
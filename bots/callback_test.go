@@ -0,0 +1,148 @@
+package bots
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/xopoww/korm/types"
+)
+
+// Limits of the callback data of the networks (see processKeyboard)
+func fitsBytes(limit int) func(string) bool {
+	return func(data string) bool {
+		return len(data) <= limit
+	}
+}
+
+func TestCallbackRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	tests := []struct {
+		name		string
+		action		string
+		argument	string
+		// whether the data is expected to be stored instead of sent inline
+		stored		bool
+	}{
+		{"no argument", "back", "", false},
+		{"short argument", "add", "42", false},
+		{"separator in argument", "lang", "a|b|c", false},
+		{"fits exactly", "a", strings.Repeat("y", 60), false},
+		{"long argument", "skip", long, true},
+		{"long argument with separator", "skip", long + "|" + long, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := encodeCallback(tt.action, tt.argument, fitsBytes(tgMaxCallbackData))
+			if err != nil {
+				t.Fatalf("encode: %s", err)
+			}
+			if len(data) > tgMaxCallbackData {
+				t.Errorf("encoded data is %d bytes long", len(data))
+			}
+			if stored := strings.HasPrefix(data, callbackRef + callbackSep); stored != tt.stored {
+				t.Errorf("data %q: stored = %t, want %t", data, stored, tt.stored)
+			}
+			action, argument, err := decodeCallback(data)
+			if err != nil {
+				t.Fatalf("decode %q: %s", data, err)
+			}
+			if action != tt.action || argument != tt.argument {
+				t.Errorf("decoded (%q, %q), want (%q, %q)", action, argument, tt.action, tt.argument)
+			}
+		})
+	}
+}
+
+func TestCallbackTokenReuse(t *testing.T) {
+	long := strings.Repeat("z", 100)
+	first, err := encodeCallback("skip", long, fitsBytes(tgMaxCallbackData))
+	if err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+	second, err := encodeCallback("skip", long, fitsBytes(tgMaxCallbackData))
+	if err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+	if first != second {
+		t.Errorf("the same button got different tokens: %q and %q", first, second)
+	}
+	other, err := encodeCallback("skip", long + "!", fitsBytes(tgMaxCallbackData))
+	if err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+	if other == first {
+		t.Errorf("different buttons got the same token: %q", first)
+	}
+}
+
+// errAny stands for any error in the test tables
+var errAny = errors.New("any error")
+
+func TestDecodeCallback(t *testing.T) {
+	tests := []struct {
+		name		string
+		data		string
+		action		string
+		argument	string
+		wantErr		error
+	}{
+		{"inline", "1|add|42", "add", "42", nil},
+		{"legacy JSON", `{"act": "add", "arg": "42"}`, "add", "42", nil},
+		{"unknown token", "r|nosuchtoken", "", "", ErrCallbackExpired},
+		{"unknown version", "2|add|42", "", "", errAny},
+		{"broken legacy JSON", `{"act": `, "", "", errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, argument, err := decodeCallback(tt.data)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("decode: %s", err)
+			case tt.wantErr == errAny && err == nil:
+				t.Fatalf("decode: no error")
+			case tt.wantErr != nil && tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+				t.Fatalf("decode: got %v, want %v", err, tt.wantErr)
+			}
+			if action != tt.action || argument != tt.argument {
+				t.Errorf("decoded (%q, %q), want (%q, %q)", action, argument, tt.action, tt.argument)
+			}
+		})
+	}
+}
+
+func TestEncodeCallbackInvalidAction(t *testing.T) {
+	for _, action := range []string{"", "a|b"} {
+		if _, err := encodeCallback(action, "", fitsBytes(tgMaxCallbackData)); !errors.Is(err, ErrInvalidAction) {
+			t.Errorf("action %q: got %v, want ErrInvalidAction", action, err)
+		}
+	}
+}
+
+func TestMemCallbackStorage(t *testing.T) {
+	s := &memCallbackStorage{entries: map[string]CallbackData{}}
+	expired := &CallbackData{Action: "a", Argument: "old", Expires: time.Now().Add(-time.Minute)}
+	if err := s.SaveCallback("expired", expired); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+	if data, err := s.GetCallback("expired"); err != nil || data != nil {
+		t.Errorf("expired entry: got (%v, %v), want (nil, nil)", data, err)
+	}
+
+	valid := CallbackData{Action: "a", Argument: "new", Expires: time.Now().Add(time.Minute)}
+	for i := 0; i < callbackMemorySize; i++ {
+		token := fmt.Sprint(i)
+		if err := s.SaveCallback(token, &valid); err != nil {
+			t.Fatalf("save %d: %s", i, err)
+		}
+	}
+	if err := s.SaveCallback("one more", &valid); !errors.Is(err, ErrCallbackStoreFull) {
+		t.Errorf("save to the full storage: got %v, want ErrCallbackStoreFull", err)
+	}
+	// saving an existing token doesn't take up more space
+	if err := s.SaveCallback("0", &valid); err != nil {
+		t.Errorf("save an existing token to the full storage: %s", err)
+	}
+}
@@ -1,7 +1,6 @@
 package bots
 
 import (
-	"encoding/json"
 	. "github.com/xopoww/korm/types"
 )
 
@@ -20,18 +19,60 @@ type BotHandle interface{
 	// If text is an empty string, message is deleted.
 	EditMessage(to *User, id int, text string, keyboard *Keyboard) error
 
+	// Send a text message asking the user to share their phone number.
+	// In TG a button with the label is shown that sends the user's contact (see Message.Phone),
+	// in VK the user has to type the number (label is ignored).
+	RequestContact(text string, to *User, label string) (int, error)
+
 	// Register a set of static commands to be available for users.
 	RegisterCommands(commands ...Command) error
 
 	// Add a handler for CallbackQuery with specified action label. Answer will be sent
-	// to a callback query.
+	// to a callback query. Answer is a key of the message (see Text), it is localized
+	// for the user that issued the query.
 	AddCallbackHandler(action, answer string, handler func(BotHandle, *CallbackQuery))
 
+	// Set a handler for text messages that are not commands.
+	SetDefaultHandler(handler func(BotHandle, *Message))
+
+	// Add middleware to the chain that is executed before every command and callback handler.
+	// Middleware is executed in the order it was added.
+	Use(middleware ...Middleware)
+
+	// Returns true if the bot works with VK and false if with Telegram.
+	IsVK() bool
+
 	// logging methods
 	Debugf(string, ...interface{})
 	Errorf(string, ...interface{})
 }
 
+// Middleware is called with the user that issued an update before the update is handled.
+// It may modify the user (e.g. populate User.UID). If it returns an error,
+// the rest of the chain and the handler itself are not executed.
+type Middleware func(BotHandle, *User) error
+
+// Run the middleware chain for the user.
+func runMiddleware(bot BotHandle, chain []Middleware, user *User) error {
+	for _, mw := range chain {
+		if err := mw(bot, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A text message sent by user to the bot.
+type Message struct {
+	From		*User
+	ID			int
+	Text		string
+	// Set if the user pressed "skip" instead of replying to a conversation step (see Conversations)
+	Skipped		bool
+	// TG only. Phone number of the user if they shared their contact (see RequestContact)
+	Phone		string
+}
+
 // An object that is sent to the KeyboardButton Action when the button is pressed.
 // If an optional argument was provided bu callback query issuer (e.g. a button),
 // it will be in Argument field
@@ -56,7 +97,7 @@ func (k * Keyboard) AddRow(row ...KeyboardButton) {
 type KeyboardButton struct {
 	// Text of the button
 	Label		string
-	// VK only
+	// VK only. One of the Color* constants (if empty, VK default is used).
 	Color		string
 	// Unique action label that will be put into callback data.
 	// The shorter - the better.
@@ -65,19 +106,19 @@ type KeyboardButton struct {
 	Argument	string
 }
 
+// Colors of VK keyboard buttons
+const (
+	ColorPrimary	= "primary"
+	ColorSecondary	= "secondary"
+	ColorNegative	= "negative"
+	ColorPositive	= "positive"
+)
+
 // Command represents a static (i.e. without variable arguments) bot command.
 type Command struct {
-	// Command name. In TG will serve as a command description.
+	// Key of the command name message (see Text). In TG will serve as a command description.
 	Name		string
 	// TG only. Will be used as a command (in "/{command}" format). ASCII characters only.
 	Label		string
 	Action		func(BotHandle, *User)
 }
-
-// For telegram method setMyCommands
-func (c Command) MarshalJSON() ([]byte, error) {
-	return json.Marshal(map[string]string{
-		"command": c.Label,
-		"description": c.Name,
-	})
-}
\ No newline at end of file
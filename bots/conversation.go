@@ -0,0 +1,149 @@
+package bots
+
+// Multi-step conversations with the users
+
+import (
+	"fmt"
+	. "github.com/xopoww/korm/types"
+	"time"
+)
+
+// StateStorage persistently stores the states of the conversations by users' UIDs.
+type StateStorage interface {
+	// Get the state of the user's conversation. Must return nil if there is none or it has expired.
+	GetState(uid int) (*ConvState, error)
+	// Save the state of the user's conversation replacing the previous one.
+	SetState(uid int, state *ConvState) error
+	// Delete the state of the user's conversation (if any).
+	DeleteState(uid int) error
+}
+
+// 	StepHandler handles the reply of the user to the question asked by Conversations.Ask.
+// Data is the data of the conversation, handler may modify it and pass it to the next step.
+// Conversation ends after the handler returns unless the handler asks another question.
+type StepHandler func(bot BotHandle, m *Message, data map[string]string)
+
+// Callback action of the "skip" button
+const convSkipAction = "skip"
+
+// 	Conversations routes free-text replies of the users to the pending conversation steps.
+// User.UID must be resolved (e.g. by a middleware) before the user reaches Conversations.
+type Conversations struct {
+	storage		StateStorage
+	// time the user has to reply to a question
+	timeout		time.Duration
+	steps		map[string]StepHandler
+}
+
+func NewConversations(storage StateStorage, timeout time.Duration) *Conversations {
+	return &Conversations{
+		storage: storage,
+		timeout: timeout,
+		steps:   map[string]StepHandler{},
+	}
+}
+
+// Add a named step. Must be called before the bots are started.
+func (c *Conversations) AddStep(name string, handler StepHandler) {
+	c.steps[name] = handler
+}
+
+// Register the handler of the "skip" button within the bot.
+func (c *Conversations) Register(bot BotHandle) {
+	bot.AddCallbackHandler(convSkipAction, "", func(bot BotHandle, cq *CallbackQuery) {
+		state, err := c.storage.GetState(cq.From.UID)
+		if err != nil {
+			bot.Errorf("Get conversation state (uid %d): %s", cq.From.UID, err)
+			return
+		}
+		// ignore the buttons of the previous questions
+		if state == nil || state.Step != cq.Argument {
+			return
+		}
+		c.handle(bot, &Message{From: cq.From, Skipped: true}, state)
+	})
+}
+
+// 	Send the question to the user and set the step that will handle the reply.
+// If skip is not empty, a button with this label is added to the keyboard, and pressing it
+// passes a Message with Skipped set to the step handler.
+func (c *Conversations) Ask(bot BotHandle, user *User, step string, data map[string]string,
+	question string, keyboard *Keyboard, skip string) error {
+	if skip != "" {
+		if keyboard == nil {
+			keyboard = &Keyboard{}
+		}
+		keyboard.AddRow(KeyboardButton{
+			Label:    skip,
+			Color:    ColorSecondary,
+			Action:   convSkipAction,
+			Argument: step,
+		})
+	}
+
+	if err := c.Expect(user, step, data); err != nil {
+		return err
+	}
+	if _, err := bot.SendMessage(question, user, keyboard); err != nil {
+		if e := c.storage.DeleteState(user.UID); e != nil {
+			bot.Errorf("Delete conversation state (uid %d): %s", user.UID, e)
+		}
+		return fmt.Errorf("send question: %w", err)
+	}
+	return nil
+}
+
+// 	Set the step that will handle the next reply of the user without sending a question.
+// Useful if the question is sent in some other way (e.g. by BotHandle.RequestContact).
+func (c *Conversations) Expect(user *User, step string, data map[string]string) error {
+	if _, found := c.steps[step]; !found {
+		return fmt.Errorf("unknown conversation step: %s", step)
+	}
+	if data == nil {
+		data = map[string]string{}
+	}
+	err := c.storage.SetState(user.UID, &ConvState{
+		Step:    step,
+		Data:    data,
+		Expires: time.Now().Add(c.timeout),
+	})
+	if err != nil {
+		return fmt.Errorf("set state: %w", err)
+	}
+	return nil
+}
+
+// 	Pass the message to the pending step of the sender's conversation.
+// Returns false if the sender has no pending conversation (so the message should be handled elsewhere).
+func (c *Conversations) Handle(bot BotHandle, m *Message) bool {
+	state, err := c.storage.GetState(m.From.UID)
+	if err != nil {
+		bot.Errorf("Get conversation state (uid %d): %s", m.From.UID, err)
+		return false
+	}
+	if state == nil {
+		return false
+	}
+	c.handle(bot, m, state)
+	return true
+}
+
+// End the user's conversation (if any).
+func (c *Conversations) Cancel(user *User) error {
+	return c.storage.DeleteState(user.UID)
+}
+
+func (c *Conversations) handle(bot BotHandle, m *Message, state *ConvState) {
+	hand, found := c.steps[state.Step]
+	if !found {
+		bot.Errorf("Unknown conversation step %s (uid %d)", state.Step, m.From.UID)
+	}
+	// the state is deleted beforehand, so that the handler can set the next one
+	if err := c.storage.DeleteState(m.From.UID); err != nil {
+		bot.Errorf("Delete conversation state (uid %d): %s", m.From.UID, err)
+		return
+	}
+	if found {
+		hand(bot, m, state.Data)
+	}
+}
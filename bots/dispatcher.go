@@ -0,0 +1,76 @@
+package bots
+
+import (
+	"github.com/sirupsen/logrus"
+	"runtime/debug"
+	"sync"
+)
+
+const (
+	// default number of workers handling the updates
+	defaultWorkers = 8
+	// size of the queue of each worker
+	workerQueueSize = 100
+)
+
+// dispatcher handles the updates concurrently in a pool of workers.
+// Updates with the same key (e.g. chat id) are always handled by the same worker,
+// so they are processed in the order they were dispatched, while updates
+// from different chats are processed in parallel.
+type dispatcher struct {
+	queues		[]chan func()
+	wg			sync.WaitGroup
+	logger		*logrus.Logger
+}
+
+// Create a dispatcher and start its workers.
+// If workers is not positive, defaultWorkers is used.
+func newDispatcher(workers int, logger *logrus.Logger) *dispatcher {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	d := &dispatcher{
+		queues: make([]chan func(), workers),
+		logger: logger,
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan func(), workerQueueSize)
+		d.wg.Add(1)
+		go d.worker(d.queues[i])
+	}
+	return d
+}
+
+// 	Put the job to the queue of the worker responsible for the key.
+// Blocks if the queue is full: the updates are never dropped (and the updates of a chat
+// are never reordered), the network redelivers the updates that are not received in time.
+func (d *dispatcher) dispatch(key int64, job func()) {
+	n := uint64(key) % uint64(len(d.queues))
+	d.queues[n] <- job
+}
+
+// Stop accepting new jobs and wait for the queued ones to finish.
+func (d *dispatcher) stop() {
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.wg.Wait()
+}
+
+func (d *dispatcher) worker(queue chan func()) {
+	defer d.wg.Done()
+	for job := range queue {
+		d.run(job)
+	}
+}
+
+// Run the job recovering from a panic (if any), so that one faulty handler
+// does not bring the whole bot down.
+func (d *dispatcher) run(job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			d.logger.Errorf("Recovered from panic in update handler: %v\n%s", r, debug.Stack())
+		}
+	}()
+	job()
+}
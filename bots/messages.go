@@ -4,46 +4,79 @@ package bots
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 )
 
-type messageTemplates struct {
-	// common
-	Error			string		`json:"error"`
-	UnknownCommand	string		`json:"unknown_command"`
-	// start
-	Hello			string		`json:"hello"`
-	HelloAgain		string		`json:"hello_again"`
-	// sync
-	AlreadySynced	string		`json:"already_synced"`
-	EmitKeyTG		string		`json:"emit_key_tg"`
-	EmitKeyVK		string		`json:"emit_key_vk"`
-	SendToVK		string		`json:"send_to_vk"`
-	SendToTG		string		`json:"send_to_tg"`
-	UnknownKey		string		`json:"unknown_key"`
-}
+// Locale that is used if the user has not chosen one
+// or if a message is missing from the user's locale.
+const DefaultLocale = "RU"
 
 type locale struct {
-	Repr			string		`json:"repr"`
-	Messages		*messageTemplates	`json:"messages"`
+	Repr			string				`json:"repr"`
+	// message templates by their keys
+	Messages		map[string]string	`json:"messages"`
 }
 
-const messagesFile = "messages.json"
-func loadMessages()(map[string]*locale, error) {
-	file, err := os.Open(messagesFile)
+// Locales loaded by LoadMessages
+var locales = map[string]*locale{}
+
+// 	Load the messages for all locales from .json file.
+// Must be called before the bots are initialized.
+func LoadMessages(filename string) error {
+	file, err := os.Open(filename)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer func() {
+		_ = file.Close()
+	}()
 	data, err := ioutil.ReadAll(file)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var locales map[string]*locale
-	err = json.Unmarshal(data, &locales)
+	var loaded map[string]*locale
+	err = json.Unmarshal(data, &loaded)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if _, found := loaded[DefaultLocale]; !found {
+		return fmt.Errorf("default locale (%s) is missing", DefaultLocale)
+	}
+	locales = loaded
+	return nil
+}
+
+// 	Get the text of the message by its key in the specified locale.
+// If the message is missing (or empty) in the locale, DefaultLocale is used.
+// If it is missing there as well, the key itself is returned.
+// If any arguments are passed, the message is used as a format string for them.
+func Text(localeCode, key string, a ...interface{}) string {
+	text := key
+	if loc, found := locales[localeCode]; found && loc.Messages[key] != "" {
+		text = loc.Messages[key]
+	} else if loc, found := locales[DefaultLocale]; found && loc.Messages[key] != "" {
+		text = loc.Messages[key]
 	}
-	return locales, nil
+	if len(a) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, a...)
+}
+
+// Get the codes of all loaded locales with their representations (e.g. flags).
+func Locales() map[string]string {
+	result := make(map[string]string, len(locales))
+	for code, loc := range locales {
+		result[code] = loc.Repr
+	}
+	return result
+}
+
+// Check if the locale with the code is loaded.
+func HasLocale(code string) bool {
+	_, found := locales[code]
+	return found
 }
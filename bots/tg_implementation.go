@@ -1,13 +1,17 @@
 package bots
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	tg "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	. "github.com/xopoww/korm/types"
+	"net/http"
 	"net/url"
+	"strings"
 )
 
 // Telegram implementation of BotHandle interface
@@ -17,23 +21,75 @@ type tgBot struct {
 	commandHandlers		map[string]func(*tg.Message)
 	callbackHandlers	map[string]callbackHandler
 	defaultHandler		func(*tg.Message)
+	middleware			[]Middleware
+
+	cfg					*TgConfig
+	// updates received via webhook (nil if long polling is used)
+	webhookUpdates		chan tg.Update
 
 	logger				*logrus.Logger
 }
 
-// Create a new TgBot
-func NewTgBot(token string, logger *logrus.Logger) (BotHandle, error) {
-	bot, err := tg.NewBotAPI(token)
+const (
+	// default long polling timeout (in seconds)
+	tgPollTimeout = 60
+	// size of the buffer for updates received via webhook
+	tgUpdatesBuffer = 100
+)
+
+// Settings of the Telegram bot
+type TgConfig struct {
+	Token			string
+	// Long polling timeout in seconds. If zero, tgPollTimeout is used.
+	PollTimeout		int
+	// Number of workers handling the updates concurrently. If zero, defaultWorkers is used.
+	Workers			int
+	// If not nil, updates are received via webhook instead of long polling.
+	Webhook			*TgWebhook
+}
+
+// Settings of the Telegram webhook
+type TgWebhook struct {
+	// Public (https) URL Telegram sends the updates to
+	URL				string
+	// Secret token that Telegram puts into X-Telegram-Bot-Api-Secret-Token header
+	// (required: without it anyone could forge the updates)
+	Secret			string
+	// Webhook handler is mounted on Router at Path
+	Router			*mux.Router
+	Path			string
+}
+
+// Create a new TgBot. If cfg.Webhook is not nil, the webhook handler is mounted on cfg.Webhook.Router.
+func NewTgBot(cfg *TgConfig, logger *logrus.Logger) (BotHandle, error) {
+	if cfg.Webhook != nil && cfg.Webhook.Secret == "" {
+		return nil, errors.New("webhook secret is empty")
+	}
+	api, err := tg.NewBotAPI(cfg.Token)
 	if err != nil {
 		return nil, fmt.Errorf("bot api: %w", err)
 	}
 
-	return &tgBot{
-		BotAPI:          	bot,
+	bot := &tgBot{
+		BotAPI:          	api,
 		commandHandlers:	make(map[string]func(*tg.Message)),
 		callbackHandlers:	make(map[string]callbackHandler),
+		cfg:				cfg,
 		logger:				logger,
-	}, nil
+	}
+
+	if hook := cfg.Webhook; hook != nil {
+		if hook.Router == nil {
+			return nil, errors.New("webhook router is nil")
+		}
+		bot.webhookUpdates = make(chan tg.Update, tgUpdatesBuffer)
+		path := hook.Path
+		if path == "" {
+			path = "/tg"
+		}
+		hook.Router.Handle(path, http.HandlerFunc(bot.webhookHandler)).Methods(http.MethodPost)
+	}
+	return bot, nil
 }
 
 type callbackHandler struct {
@@ -42,102 +98,193 @@ type callbackHandler struct {
 	action		func(BotHandle, *CallbackQuery)
 }
 
-// Convert Keyboard to telegram reply markup.
-func (bot * tgBot) processKeyboard(keyboard * Keyboard) *tg.InlineKeyboardMarkup {
+// Maximum size of callback data in bytes (limited by Telegram)
+const tgMaxCallbackData = 64
+
+// 	Convert Keyboard to telegram reply markup.
+// Returns an error if callback data of some button cannot be encoded.
+func (bot * tgBot) processKeyboard(keyboard * Keyboard) (*tg.InlineKeyboardMarkup, error) {
 	if keyboard == nil {
-		return nil
+		return nil, nil
+	}
+	fits := func(data string) bool {
+		return len(data) <= tgMaxCallbackData
 	}
 	keys := make([][]tg.InlineKeyboardButton, len(keyboard.keys))
 	for i, row := range keyboard.keys {
 		keys[i] = make([]tg.InlineKeyboardButton, len(row))
 		for j, button := range row {
-			data := map[string]string{
-				"act": button.Action,
-				"arg": button.Argument,
+			data, err := encodeCallback(button.Action, button.Argument, fits)
+			if err != nil {
+				return nil, fmt.Errorf("button %q: %w", button.Label, err)
 			}
-			// Ignoring an error because there simply can't be any.
-			dataBytes, _ := json.Marshal(data)
-			keys[i][j] = tg.NewInlineKeyboardButtonData(button.Label, string(dataBytes))
+			keys[i][j] = tg.NewInlineKeyboardButtonData(button.Label, data)
 		}
 	}
 	markup := tg.NewInlineKeyboardMarkup(keys...)
-	return &markup
+	return &markup, nil
 }
 
 // ==== bot interface implementation ====
 
 func (bot * tgBot) Start() error {
-	uCfg := tg.UpdateConfig{
-		Offset:  0,
-		Limit:   0,
-		Timeout: 60,
-	}
-	updates, err := bot.GetUpdatesChan(uCfg)
-	if err != nil {
-		return fmt.Errorf("get updates chan: %w", err)
+	var updates tg.UpdatesChannel
+	if hook := bot.cfg.Webhook; hook != nil {
+		vals := url.Values{}
+		vals.Set("url", hook.URL)
+		vals.Set("secret_token", hook.Secret)
+		resp, err := bot.MakeRequest("setWebhook", vals)
+		if err != nil {
+			return fmt.Errorf("set webhook: %w", err)
+		}
+		if !resp.Ok {
+			return fmt.Errorf("set webhook: API error (%d): %s", resp.ErrorCode, resp.Description)
+		}
+		bot.logger.Infof("Receiving TG updates via webhook at %s", hook.URL)
+		updates = bot.webhookUpdates
+	} else {
+		// getUpdates does not work while a webhook is set
+		if _, err := bot.RemoveWebhook(); err != nil {
+			return fmt.Errorf("remove webhook: %w", err)
+		}
+		timeout := bot.cfg.PollTimeout
+		if timeout == 0 {
+			timeout = tgPollTimeout
+		}
+		uCfg := tg.UpdateConfig{
+			Offset:  0,
+			Limit:   0,
+			Timeout: timeout,
+		}
+		var err error
+		updates, err = bot.GetUpdatesChan(uCfg)
+		if err != nil {
+			return fmt.Errorf("get updates chan: %w", err)
+		}
+		bot.logger.Info("Receiving TG updates via long polling")
 	}
 
+	d := newDispatcher(bot.cfg.Workers, bot.logger)
+	defer d.stop()
 	for upd := range updates {
-		// text message
-		if m := upd.Message; m != nil {
-			// command
-			if m.IsCommand() {
-				com := m.Command()
-				bot.logger.Tracef("Got a command: %s", com)
-				if hand, found := bot.commandHandlers[com]; found {
-					hand(m)
-					continue
-				}
-				// ! unhandled command
-			}
+		upd := upd
+		d.dispatch(updateChatID(&upd), func() {
+			bot.handleUpdate(upd)
+		})
+	}
+
+	return errors.New("updates chan is closed")
+}
 
-			// simple text message
-			if hand := bot.defaultHandler; hand != nil {
+// Dispatch the update to the corresponding handler.
+// Same for the updates received via long polling and via webhook.
+func (bot *tgBot) handleUpdate(upd tg.Update) {
+	// text message
+	if m := upd.Message; m != nil {
+		// command
+		if m.IsCommand() {
+			com := m.Command()
+			bot.logger.Tracef("Got a command: %s", com)
+			if hand, found := bot.commandHandlers[com]; found {
 				hand(m)
-				continue
+				return
 			}
-			// ! unhandled message
+			// ! unhandled command
 		}
 
-		// callback query
-		if cq := upd.CallbackQuery; cq != nil {
-			dataBytes := []byte(cq.Data)
-			var data struct {
-				Action		string	`json:"act"`
-				Argument	string	`json:"arg"`
+		// simple text message
+		if hand := bot.defaultHandler; hand != nil {
+			hand(m)
+			return
+		}
+		// ! unhandled message
+	}
+
+	// callback query
+	if cq := upd.CallbackQuery; cq != nil {
+		action, argument, err := decodeCallback(cq.Data)
+		if err != nil {
+			bot.logger.Warnf("Invalid callback data: %s (error: %s)", cq.Data, err)
+			// answer anyway, so that the client stops waiting
+			_, _ = bot.AnswerCallbackQuery(tg.NewCallback(cq.ID, ""))
+			return
+		}
+		// the buttons of the messages sent in inline mode have no message to edit,
+		// and the bot does not send such messages
+		if cq.Message == nil {
+			bot.logger.Warnf("Callback query without a message (action %s).", action)
+			_, _ = bot.AnswerCallbackQuery(tg.NewCallback(cq.ID, ""))
+			return
+		}
+		if hand, found := bot.callbackHandlers[action]; found {
+			user := stripTgUser(cq.From)
+			if err := runMiddleware(bot, bot.middleware, user); err != nil {
+				bot.logger.Errorf("Middleware (callback %s): %s", action, err)
+				return
 			}
-			err := json.Unmarshal(dataBytes, &data)
+			answer := ""
+			if hand.answer != "" {
+				answer = Text(user.Locale, hand.answer)
+			}
+			_, err := bot.AnswerCallbackQuery(tg.NewCallback(cq.ID, answer))
 			if err != nil {
-				bot.logger.Warnf("Invalid callback data: %s (error: %s)", cq.Data, err)
-				continue
+				bot.logger.Errorf("Error answering callback query: %s", err)
+				return
 			}
-			if hand, found := bot.callbackHandlers[data.Action]; found {
-				_, err := bot.AnswerCallbackQuery(tg.NewCallback(cq.ID, hand.answer))
-				if err != nil {
-					bot.logger.Errorf("Error answering callback query: %s", err)
-					continue
-				}
-				if act := hand.action; act != nil {
-					act(bot, &CallbackQuery{
-						From:      stripTgUser(cq.From),
-						MessageID: cq.Message.MessageID,
-						Argument:  data.Argument,
-					})
-				}
-				continue
+			if act := hand.action; act != nil {
+				act(bot, &CallbackQuery{
+					From:      user,
+					MessageID: cq.Message.MessageID,
+					Argument:  argument,
+				})
 			}
-			// ! unhandled callback
+			return
 		}
+		// ! unhandled callback
 	}
+}
 
-	return errors.New("updates chan is closed")
+// Receive updates sent by Telegram to the webhook.
+func (bot *tgBot) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	secret := bot.cfg.Webhook.Secret
+	if subtle.ConstantTimeCompare(
+		[]byte(r.Header.Get("X-Telegram-Bot-Api-Secret-Token")), []byte(secret)) != 1 {
+		bot.logger.Warnf("TG webhook request with invalid secret token from %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var upd tg.Update
+	err := json.NewDecoder(r.Body).Decode(&upd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bot.webhookUpdates <- upd
+	w.WriteHeader(http.StatusOK)
 }
 
 func (bot *tgBot) SendMessage(text string, to *User, keyboard *Keyboard) (int, error) {
 	message := tg.NewMessage(int64(to.ID), text)
 	if keyboard != nil {
-		message.ReplyMarkup = bot.processKeyboard(keyboard)
+		markup, err := bot.processKeyboard(keyboard)
+		if err != nil {
+			return 0, err
+		}
+		message.ReplyMarkup = markup
+	}
+	resp, err := bot.Send(message)
+	if err != nil {
+		return 0, err
 	}
+	return resp.MessageID, nil
+}
+
+func (bot *tgBot) RequestContact(text string, to *User, label string) (int, error) {
+	message := tg.NewMessage(int64(to.ID), text)
+	markup := tg.NewReplyKeyboard(tg.NewKeyboardButtonRow(tg.NewKeyboardButtonContact(label)))
+	markup.OneTimeKeyboard = true
+	message.ReplyMarkup = markup
 	resp, err := bot.Send(message)
 	if err != nil {
 		return 0, err
@@ -150,11 +297,15 @@ func (bot * tgBot) EditMessage(to *User, id int, text string, keyboard *Keyboard
 	if text == "" {
 		cfg = tg.NewDeleteMessage(int64(to.ID), id)
 	} else {
+		markup, err := bot.processKeyboard(keyboard)
+		if err != nil {
+			return err
+		}
 		cfg = tg.EditMessageTextConfig{
 			BaseEdit:              tg.BaseEdit{
 				ChatID:          int64(to.ID),
 				MessageID:       id,
-				ReplyMarkup:     bot.processKeyboard(keyboard),
+				ReplyMarkup:     markup,
 			},
 			Text:                  text,
 		}
@@ -166,18 +317,53 @@ func (bot * tgBot) EditMessage(to *User, id int, text string, keyboard *Keyboard
 func (bot *tgBot) RegisterCommands(commands ...Command) error {
 	for _, com := range commands {
 		act := com.Action
+		label := com.Label
 		bot.commandHandlers[com.Label] = func(m *tg.Message){
-			act(bot, stripTgUser(m.From))
+			user := stripTgUser(m.From)
+			if err := runMiddleware(bot, bot.middleware, user); err != nil {
+				bot.logger.Errorf("Middleware (command %s): %s", label, err)
+				return
+			}
+			act(bot, user)
 		}
 		bot.logger.Tracef("Registered a command: %s", com.Label)
 	}
 
-	data, err := json.Marshal(commands)
+	// default list of commands and a list for every other locale
+	err := bot.setMyCommands(commands, DefaultLocale, "")
+	if err != nil {
+		return err
+	}
+	for code := range locales {
+		if code == DefaultLocale {
+			continue
+		}
+		err = bot.setMyCommands(commands, code, strings.ToLower(code))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Call telegram method setMyCommands with command descriptions in the specified locale.
+func (bot *tgBot) setMyCommands(commands []Command, localeCode, languageCode string) error {
+	list := make([]map[string]string, len(commands))
+	for i, com := range commands {
+		list[i] = map[string]string{
+			"command": com.Label,
+			"description": Text(localeCode, com.Name),
+		}
+	}
+	data, err := json.Marshal(list)
 	if err != nil {
 		return fmt.Errorf("marshal list of commands: %w", err)
 	}
 	vals := url.Values{}
 	vals.Set("commands", string(data))
+	if languageCode != "" {
+		vals.Set("language_code", languageCode)
+	}
 	resp, err := bot.MakeRequest("setMyCommands", vals)
 	if err != nil {
 		return fmt.Errorf("make request: %w", err)
@@ -195,6 +381,34 @@ func (bot *tgBot) AddCallbackHandler(action, answer string, handler func(BotHand
 	}
 }
 
+func (bot *tgBot) SetDefaultHandler(handler func(BotHandle, *Message)) {
+	bot.defaultHandler = func(m *tg.Message){
+		user := stripTgUser(m.From)
+		if err := runMiddleware(bot, bot.middleware, user); err != nil {
+			bot.logger.Errorf("Middleware (text message): %s", err)
+			return
+		}
+		message := &Message{
+			From: user,
+			ID:   m.MessageID,
+			Text: m.Text,
+		}
+		// accept only the user's own contact
+		if c := m.Contact; c != nil && c.UserID == m.From.ID {
+			message.Phone = c.PhoneNumber
+		}
+		handler(bot, message)
+	}
+}
+
+func (bot *tgBot) Use(middleware ...Middleware) {
+	bot.middleware = append(bot.middleware, middleware...)
+}
+
+func (bot *tgBot) IsVK() bool {
+	return false
+}
+
 func (bot *tgBot) Debugf(f string, a ...interface{}) {
 	bot.logger.Debugf(f, a...)
 }
@@ -205,11 +419,31 @@ func (bot *tgBot) Errorf(f string, a ...interface{}) {
 
 // ======== utils ========
 
+// Get the id of the chat the update came from (0 if there is none).
+func updateChatID(upd *tg.Update) int64 {
+	switch {
+	case upd.Message != nil:
+		return upd.Message.Chat.ID
+	case upd.CallbackQuery != nil && upd.CallbackQuery.Message != nil:
+		return upd.CallbackQuery.Message.Chat.ID
+	case upd.CallbackQuery != nil:
+		return int64(upd.CallbackQuery.From.ID)
+	default:
+		return 0
+	}
+}
+
 // Convert telegram user to *types.User
 func stripTgUser(user * tg.User) *User {
-	return &User{
+	u := &User{
 		FirstName: user.FirstName,
 		LastName:  user.LastName,
+		Username:  user.UserName,
 		ID:        user.ID,
 	}
+	// telegram client language is used until the user chooses a locale
+	if lang := strings.ToUpper(user.LanguageCode); len(lang) >= 2 && HasLocale(lang[:2]) {
+		u.Locale = lang[:2]
+	}
+	return u
 }
\ No newline at end of file
@@ -0,0 +1,562 @@
+package bots
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	. "github.com/xopoww/korm/types"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vkAPIEndpoint = "https://api.vk.com/method/"
+	vkAPIVersion = "5.131"
+	// size of the buffer for events received via Callback API
+	vkUpdatesBuffer = 100
+	// max length of a button label
+	vkMaxLabel = 40
+	// how long the names of a user are cached
+	vkUserCacheTTL = time.Hour
+	// maximum number of users in the cache
+	vkUserCacheSize = 10000
+)
+
+// Settings of the VK community bot
+type VkConfig struct {
+	// Community access token
+	Token			string
+	// Community id
+	GroupID			int
+	// Secret key from the Callback API settings (required: without it anyone could forge the events)
+	Secret			string
+	// String that must be returned to VK to confirm the server address
+	Confirmation	string
+	// Callback API handler is mounted on Router at Path
+	Router			*mux.Router
+	Path			string
+	// Number of workers handling the events concurrently. If zero, defaultWorkers is used.
+	Workers			int
+}
+
+// VK implementation of BotHandle interface
+type vkBot struct {
+	cfg					*VkConfig
+	client				*http.Client
+	updates				chan vkEvent
+
+	commandHandlers		map[string]func(*User)
+	callbackHandlers	map[string]callbackHandler
+	defaultHandler		func(BotHandle, *Message)
+	middleware			[]Middleware
+
+	// cache of user names (VK events contain only user ids)
+	users				map[int]cachedVkUser
+	usersMutex			sync.RWMutex
+
+	logger				*logrus.Logger
+}
+
+// Create a new VK bot and mount its Callback API handler on cfg.Router.
+func NewVkBot(cfg *VkConfig, logger *logrus.Logger) (BotHandle, error) {
+	if cfg.Router == nil {
+		return nil, errors.New("router is nil")
+	}
+	if cfg.Secret == "" {
+		return nil, errors.New("callback API secret is empty")
+	}
+	bot := &vkBot{
+		cfg:				cfg,
+		client:				&http.Client{Timeout: 30 * time.Second},
+		updates:			make(chan vkEvent, vkUpdatesBuffer),
+		commandHandlers:	make(map[string]func(*User)),
+		callbackHandlers:	make(map[string]callbackHandler),
+		users:				make(map[int]cachedVkUser),
+		logger:				logger,
+	}
+
+	// check the token
+	err := bot.call("groups.getById", url.Values{"group_id": {fmt.Sprint(cfg.GroupID)}}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("groups.getById: %w", err)
+	}
+
+	path := cfg.Path
+	if path == "" {
+		path = "/vk"
+	}
+	cfg.Router.Handle(path, bot).Methods(http.MethodPost)
+	return bot, nil
+}
+
+// ======== Callback API ========
+
+// An event sent by VK Callback API
+type vkEvent struct {
+	Type		string				`json:"type"`
+	Object		json.RawMessage		`json:"object"`
+	GroupID		int					`json:"group_id"`
+	Secret		string				`json:"secret"`
+}
+
+// Object of message_new event
+type vkMessageNew struct {
+	Message		struct{
+		FromID		int		`json:"from_id"`
+		PeerID		int		`json:"peer_id"`
+		Text		string	`json:"text"`
+		Payload		string	`json:"payload"`
+		ConversationMessageID	int	`json:"conversation_message_id"`
+	}	`json:"message"`
+}
+
+// Object of message_event event (callback button is pressed)
+type vkMessageEvent struct {
+	UserID					int				`json:"user_id"`
+	PeerID					int				`json:"peer_id"`
+	EventID					string			`json:"event_id"`
+	Payload					json.RawMessage	`json:"payload"`
+	ConversationMessageID	int				`json:"conversation_message_id"`
+}
+
+// 	Callback API handler. Verifies an event and puts it to the updates chan.
+// The handler never waits for the bot: if the chan is full, VK is asked to resend the event later
+// (waiting would make VK time out and resend the event that has been received).
+func (bot *vkBot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var event vkEvent
+	err := json.NewDecoder(r.Body).Decode(&event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(event.Secret), []byte(bot.cfg.Secret)) != 1 {
+		bot.logger.Warnf("VK event with invalid secret (type %s).", event.Type)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if event.GroupID != bot.cfg.GroupID {
+		bot.logger.Warnf("VK event for another group (%d).", event.GroupID)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if event.Type == "confirmation" {
+		_, _ = w.Write([]byte(bot.cfg.Confirmation))
+		return
+	}
+
+	select {
+	case bot.updates <- event:
+		_, _ = w.Write([]byte("ok"))
+	default:
+		bot.logger.Warnf("VK updates chan is full, event is to be resent (type %s).", event.Type)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+// ======== bot interface implementation ========
+
+func (bot *vkBot) Start() error {
+	d := newDispatcher(bot.cfg.Workers, bot.logger)
+	defer d.stop()
+	for event := range bot.updates {
+		switch event.Type {
+		case "message_new":
+			var obj vkMessageNew
+			if err := json.Unmarshal(event.Object, &obj); err != nil {
+				bot.logger.Warnf("Invalid message_new object: %s", err)
+				continue
+			}
+			d.dispatch(int64(obj.Message.PeerID), func() {
+				bot.handleMessage(&obj)
+			})
+		case "message_event":
+			var obj vkMessageEvent
+			if err := json.Unmarshal(event.Object, &obj); err != nil {
+				bot.logger.Warnf("Invalid message_event object: %s", err)
+				continue
+			}
+			d.dispatch(int64(obj.PeerID), func() {
+				bot.handleCallback(&obj)
+			})
+		default:
+			bot.logger.Tracef("Skipping VK event: %s", event.Type)
+		}
+	}
+	return errors.New("updates chan is closed")
+}
+
+func (bot *vkBot) handleMessage(obj *vkMessageNew) {
+	m := obj.Message
+	user, err := bot.getUser(m.FromID)
+	if err != nil {
+		bot.logger.Errorf("Get VK user (id %d): %s", m.FromID, err)
+		return
+	}
+
+	// "Start" button sends a payload with a command
+	var payload struct{
+		Command		string	`json:"command"`
+	}
+	if m.Payload != "" {
+		_ = json.Unmarshal([]byte(m.Payload), &payload)
+	}
+	com := payload.Command
+	if com == "" && strings.HasPrefix(m.Text, "/") {
+		com = strings.TrimPrefix(strings.Fields(m.Text)[0], "/")
+	}
+
+	if com != "" {
+		bot.logger.Tracef("Got a command: %s", com)
+		if hand, found := bot.commandHandlers[strings.ToLower(com)]; found {
+			hand(user)
+			return
+		}
+		// ! unhandled command
+	}
+
+	// simple text message
+	if hand := bot.defaultHandler; hand != nil {
+		if err := runMiddleware(bot, bot.middleware, user); err != nil {
+			bot.logger.Errorf("Middleware (text message): %s", err)
+			return
+		}
+		hand(bot, &Message{
+			From: user,
+			ID:   m.ConversationMessageID,
+			Text: m.Text,
+		})
+		return
+	}
+	// ! unhandled message
+}
+
+func (bot *vkBot) handleCallback(obj *vkMessageEvent) {
+	// payload is either a JSON string with encoded callback data or a legacy JSON object
+	data := string(obj.Payload)
+	var encoded string
+	if json.Unmarshal(obj.Payload, &encoded) == nil {
+		data = encoded
+	}
+	action, argument, err := decodeCallback(data)
+	if err != nil {
+		bot.logger.Warnf("Invalid callback payload: %s (error: %s)", obj.Payload, err)
+		return
+	}
+	hand, found := bot.callbackHandlers[action]
+	if !found {
+		// ! unhandled callback
+		return
+	}
+
+	user, err := bot.getUser(obj.UserID)
+	if err != nil {
+		bot.logger.Errorf("Get VK user (id %d): %s", obj.UserID, err)
+		return
+	}
+	if err := runMiddleware(bot, bot.middleware, user); err != nil {
+		bot.logger.Errorf("Middleware (callback %s): %s", action, err)
+		return
+	}
+
+	vals := url.Values{
+		"event_id": {obj.EventID},
+		"user_id": {fmt.Sprint(obj.UserID)},
+		"peer_id": {fmt.Sprint(obj.PeerID)},
+	}
+	if hand.answer != "" {
+		eventData, _ := json.Marshal(map[string]string{
+			"type": "show_snackbar",
+			"text": Text(user.Locale, hand.answer),
+		})
+		vals.Set("event_data", string(eventData))
+	}
+	err = bot.call("messages.sendMessageEventAnswer", vals, nil)
+	if err != nil {
+		bot.logger.Errorf("Error answering message event: %s", err)
+		return
+	}
+
+	if act := hand.action; act != nil {
+		act(bot, &CallbackQuery{
+			From:      user,
+			MessageID: obj.ConversationMessageID,
+			Argument:  argument,
+		})
+	}
+}
+
+// On success returns conversation message id of the sent message.
+func (bot *vkBot) SendMessage(text string, to *User, keyboard *Keyboard) (int, error) {
+	vals := url.Values{
+		"peer_ids": {fmt.Sprint(to.ID)},
+		"random_id": {fmt.Sprint(rand.Int31())},
+		"message": {text},
+	}
+	if keyboard != nil {
+		keys, err := bot.processKeyboard(keyboard)
+		if err != nil {
+			return 0, err
+		}
+		vals.Set("keyboard", keys)
+	}
+
+	var resp []struct{
+		ConversationMessageID	int		`json:"conversation_message_id"`
+		Error					*vkError	`json:"error"`
+	}
+	err := bot.call("messages.send", vals, &resp)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) == 0 {
+		return 0, errors.New("empty response")
+	}
+	if resp[0].Error != nil {
+		return 0, resp[0].Error
+	}
+	return resp[0].ConversationMessageID, nil
+}
+
+// VK bots cannot request the contact, so just the text is sent.
+func (bot *vkBot) RequestContact(text string, to *User, _ string) (int, error) {
+	return bot.SendMessage(text, to, nil)
+}
+
+// Edit the message by its conversation message id.
+func (bot *vkBot) EditMessage(to *User, id int, text string, keyboard *Keyboard) error {
+	if text == "" {
+		return bot.call("messages.delete", url.Values{
+			"peer_id": {fmt.Sprint(to.ID)},
+			"conversation_message_ids": {fmt.Sprint(id)},
+			"delete_for_all": {"1"},
+		}, nil)
+	}
+
+	if keyboard == nil {
+		// remove the keyboard from the message
+		keyboard = &Keyboard{}
+	}
+	keys, err := bot.processKeyboard(keyboard)
+	if err != nil {
+		return err
+	}
+	return bot.call("messages.edit", url.Values{
+		"peer_id": {fmt.Sprint(to.ID)},
+		"conversation_message_id": {fmt.Sprint(id)},
+		"message": {text},
+		"keyboard": {keys},
+	}, nil)
+}
+
+// VK does not have a list of commands, so the commands are only recognized
+// in "/{command}" format.
+func (bot *vkBot) RegisterCommands(commands ...Command) error {
+	for _, com := range commands {
+		act := com.Action
+		label := com.Label
+		bot.commandHandlers[strings.ToLower(com.Label)] = func(user *User){
+			if err := runMiddleware(bot, bot.middleware, user); err != nil {
+				bot.logger.Errorf("Middleware (command %s): %s", label, err)
+				return
+			}
+			act(bot, user)
+		}
+		bot.logger.Tracef("Registered a command: %s", com.Label)
+	}
+	return nil
+}
+
+func (bot *vkBot) AddCallbackHandler(action, answer string, handler func(BotHandle, *CallbackQuery)) {
+	bot.callbackHandlers[action] = callbackHandler{
+		answer: answer,
+		action: handler,
+	}
+}
+
+func (bot *vkBot) SetDefaultHandler(handler func(BotHandle, *Message)) {
+	bot.defaultHandler = handler
+}
+
+func (bot *vkBot) Use(middleware ...Middleware) {
+	bot.middleware = append(bot.middleware, middleware...)
+}
+
+func (bot *vkBot) IsVK() bool {
+	return true
+}
+
+func (bot *vkBot) Debugf(f string, a ...interface{}) {
+	bot.logger.Debugf(f, a...)
+}
+
+func (bot *vkBot) Errorf(f string, a ...interface{}) {
+	bot.logger.Errorf(f, a...)
+}
+
+// ======== utils ========
+
+// Error returned by VK API
+type vkError struct {
+	Code		int		`json:"error_code"`
+	Message		string	`json:"error_msg"`
+}
+
+func (e *vkError) Error() string {
+	return fmt.Sprintf("VK API error (%d): %s", e.Code, e.Message)
+}
+
+// Call a VK API method. If result is not nil, the response is unmarshalled into it.
+func (bot *vkBot) call(method string, vals url.Values, result interface{}) error {
+	vals.Set("access_token", bot.cfg.Token)
+	vals.Set("v", vkAPIVersion)
+	resp, err := bot.client.PostForm(vkAPIEndpoint + method, vals)
+	if err != nil {
+		return fmt.Errorf("post form: %w", err)
+	}
+	defer func() {
+		if e := resp.Body.Close(); e != nil {
+			bot.logger.Errorf("Cannot close a response body: %s", e)
+		}
+	}()
+
+	var body struct{
+		Response	json.RawMessage	`json:"response"`
+		Error		*vkError		`json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	if body.Error != nil {
+		return body.Error
+	}
+	if result != nil {
+		err = json.Unmarshal(body.Response, result)
+		if err != nil {
+			return fmt.Errorf("unmarshal response: %w", err)
+		}
+	}
+	return nil
+}
+
+// Get the user by VK id (from cache or via users.get).
+type cachedVkUser struct {
+	User
+	expires		time.Time
+}
+
+func (bot *vkBot) getUser(id int) (*User, error) {
+	bot.usersMutex.RLock()
+	cached, found := bot.users[id]
+	bot.usersMutex.RUnlock()
+	if found && time.Now().Before(cached.expires) {
+		user := cached.User
+		return &user, nil
+	}
+
+	var resp []struct{
+		FirstName	string	`json:"first_name"`
+		LastName	string	`json:"last_name"`
+	}
+	err := bot.call("users.get", url.Values{"user_ids": {strconv.Itoa(id)}}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("users.get: %w", err)
+	}
+	if len(resp) == 0 {
+		return nil, errors.New("users.get: empty response")
+	}
+	user := User{
+		FirstName: resp[0].FirstName,
+		LastName:  resp[0].LastName,
+		ID:        id,
+	}
+
+	bot.usersMutex.Lock()
+	defer bot.usersMutex.Unlock()
+	now := time.Now()
+	if len(bot.users) >= vkUserCacheSize {
+		for cachedID, cached := range bot.users {
+			if now.After(cached.expires) {
+				delete(bot.users, cachedID)
+			}
+		}
+		// all users are recent: start over rather than grow
+		if len(bot.users) >= vkUserCacheSize {
+			bot.users = make(map[int]cachedVkUser)
+		}
+	}
+	bot.users[id] = cachedVkUser{User: user, expires: now.Add(vkUserCacheTTL)}
+	return &user, nil
+}
+
+// VK keyboard objects
+type (
+	vkKeyboard struct {
+		Inline		bool			`json:"inline"`
+		Buttons		[][]vkButton	`json:"buttons"`
+	}
+	vkButton struct {
+		Action		vkButtonAction	`json:"action"`
+		Color		string			`json:"color,omitempty"`
+	}
+	vkButtonAction struct {
+		Type		string	`json:"type"`
+		Label		string	`json:"label"`
+		Payload		string	`json:"payload"`
+	}
+)
+
+// Maximum size of button payload in bytes (limited by VK)
+const vkMaxPayload = 255
+
+// 	Convert Keyboard to JSON-encoded VK inline keyboard with callback buttons.
+// Returns an error if payload of some button cannot be encoded.
+func (bot *vkBot) processKeyboard(keyboard *Keyboard) (string, error) {
+	// payload must be valid JSON, so the callback data is sent as a JSON string
+	fits := func(data string) bool {
+		payload, _ := json.Marshal(data)
+		return len(payload) <= vkMaxPayload
+	}
+	keys := vkKeyboard{
+		Inline:  true,
+		Buttons: make([][]vkButton, len(keyboard.keys)),
+	}
+	for i, row := range keyboard.keys {
+		keys.Buttons[i] = make([]vkButton, len(row))
+		for j, button := range row {
+			data, err := encodeCallback(button.Action, button.Argument, fits)
+			if err != nil {
+				return "", fmt.Errorf("button %q: %w", button.Label, err)
+			}
+			// Ignoring an error because there simply can't be any.
+			payload, _ := json.Marshal(data)
+			label := []rune(button.Label)
+			if len(label) > vkMaxLabel {
+				label = append(label[:vkMaxLabel-1], '…')
+			}
+			keys.Buttons[i][j] = vkButton{
+				Action: vkButtonAction{
+					Type:    "callback",
+					Label:   string(label),
+					Payload: string(payload),
+				},
+				Color:  button.Color,
+			}
+		}
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return "", fmt.Errorf("marshal keyboard: %w", err)
+	}
+	return string(data), nil
+}
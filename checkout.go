@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/xopoww/korm/bots"
+	db "github.com/xopoww/korm/database"
+	. "github.com/xopoww/korm/types"
+	"regexp"
+	"strings"
+)
+
+// Checkout conversation steps (see bots.Conversations)
+const (
+	stepPromo = "promo"
+	stepAddress = "address"
+	stepPhone = "phone"
+	stepTime = "time"
+	stepComment = "comment"
+)
+
+// Loose check of the phone numbers typed by the users
+var phoneRegexp = regexp.MustCompile(`^\+?[0-9][0-9 ()-]{4,18}[0-9]$`)
+
+// Add the steps collecting delivery details to conversations.
+func addCheckoutSteps() {
+	conversations.AddStep(stepPromo, func(bot bots.BotHandle, m *bots.Message, data map[string]string) {
+		if m.Skipped {
+			if err := db.SetCartPromo(m.From.UID, ""); err != nil {
+				bot.Errorf("Set cart promo (uid %d): %s", m.From.UID, err)
+			}
+			askAddress(bot, m.From, data)
+			return
+		}
+		code := db.NormalizePromoCode(m.Text)
+		bill, err := priceCart(m.From, code)
+		if text, ok := describePromoError(m.From, code, err); ok {
+			_, _ = bot.SendMessage(text, m.From, nil)
+			ask(bot, m.From, stepPromo, data, "ask_promo")
+			return
+		}
+		// other errors are about the cart items, they are reported at confirmation
+		if err = db.SetCartPromo(m.From.UID, code); err != nil {
+			bot.Errorf("Set cart promo (uid %d): %s", m.From.UID, err)
+			_, _ = bot.SendMessage(tr(m.From, "error"), m.From, nil)
+			return
+		}
+		if bill != nil {
+			_, _ = bot.SendMessage(tr(m.From, "promo_applied", bill.PromoCode, bill.PromoDiscount), m.From, nil)
+		}
+		askAddress(bot, m.From, data)
+	})
+
+	conversations.AddStep(stepAddress, func(bot bots.BotHandle, m *bots.Message, data map[string]string) {
+		address := strings.TrimSpace(m.Text)
+		if address == "" {
+			askAddress(bot, m.From, data)
+			return
+		}
+		data["address"] = address
+		askPhone(bot, m.From, data, "ask_phone")
+	})
+
+	conversations.AddStep(stepPhone, func(bot bots.BotHandle, m *bots.Message, data map[string]string) {
+		phone := m.Phone
+		if phone == "" {
+			phone = strings.TrimSpace(m.Text)
+			if !phoneRegexp.MatchString(phone) {
+				askPhone(bot, m.From, data, "bad_phone")
+				return
+			}
+		}
+		data["phone"] = phone
+		ask(bot, m.From, stepTime, data, "ask_time")
+	})
+
+	conversations.AddStep(stepTime, func(bot bots.BotHandle, m *bots.Message, data map[string]string) {
+		if !m.Skipped {
+			data["time"] = strings.TrimSpace(m.Text)
+		}
+		ask(bot, m.From, stepComment, data, "ask_comment")
+	})
+
+	conversations.AddStep(stepComment, func(bot bots.BotHandle, m *bots.Message, data map[string]string) {
+		if !m.Skipped {
+			data["comment"] = strings.TrimSpace(m.Text)
+		}
+		delivery := Delivery{
+			Address: data["address"],
+			Phone:   data["phone"],
+			Time:    data["time"],
+			Comment: data["comment"],
+		}
+		if err := db.SetCartDelivery(m.From.UID, delivery); err != nil {
+			bot.Errorf("Set cart delivery (uid %d): %s", m.From.UID, err)
+			_, _ = bot.SendMessage(tr(m.From, "error"), m.From, nil)
+			return
+		}
+		showConfirmation(bot, m.From, delivery)
+	})
+}
+
+// Start checkout: ask for a promo code and then collect the delivery details of the user's order.
+func startCheckout(bot bots.BotHandle, user *User) {
+	ask(bot, user, stepPromo, nil, "ask_promo")
+}
+
+// Price the user's cart with the promo code.
+func priceCart(user *User, code string) (*Bill, error) {
+	items, err := db.GetCart(user.UID)
+	if err != nil {
+		return nil, fmt.Errorf("get cart: %w", err)
+	}
+	offerID, err := db.GetCartOffer(user.UID)
+	if err != nil {
+		return nil, fmt.Errorf("get cart offer: %w", err)
+	}
+	return db.PriceOrder(&Order{UID: user.UID, Items: items, OfferID: offerID, PromoCode: code})
+}
+
+// 	Explain to the user why the promo code cannot be applied.
+// If err is not about the promo code, ok is false.
+func describePromoError(user *User, code string, err error) (text string, ok bool) {
+	switch {
+	case err == nil:
+		return "", false
+	case errors.Is(err, db.ErrPromoUnknown):
+		return tr(user, "promo_unknown", code), true
+	case errors.Is(err, db.ErrPromoExpired):
+		return tr(user, "promo_expired", code), true
+	case errors.Is(err, db.ErrPromoUsedUp):
+		return tr(user, "promo_used_up", code), true
+	case errors.Is(err, db.ErrPromoNotApplicable):
+		return tr(user, "promo_not_applicable", code), true
+	case errors.Is(err, db.ErrPromoMinTotal):
+		promo, e := db.GetPromo(code)
+		if e != nil {
+			return tr(user, "promo_not_applicable", code), true
+		}
+		return tr(user, "promo_min_total", code, promo.MinTotal), true
+	default:
+		return "", false
+	}
+}
+
+func askAddress(bot bots.BotHandle, user *User, data map[string]string) {
+	err := conversations.Ask(bot, user, stepAddress, data, tr(user, "ask_address"), nil, "")
+	if err != nil {
+		bot.Errorf("Ask address (uid %d): %s", user.UID, err)
+	}
+}
+
+func askPhone(bot bots.BotHandle, user *User, data map[string]string, question string) {
+	if err := conversations.Expect(user, stepPhone, data); err != nil {
+		bot.Errorf("Expect phone (uid %d): %s", user.UID, err)
+		return
+	}
+	_, err := bot.RequestContact(tr(user, question), user, tr(user, "btn_share_phone"))
+	if err != nil {
+		bot.Errorf("Request contact (uid %d): %s", user.UID, err)
+	}
+}
+
+// Ask an optional question.
+func ask(bot bots.BotHandle, user *User, step string, data map[string]string, question string) {
+	err := conversations.Ask(bot, user, step, data, tr(user, question), nil, tr(user, "btn_skip"))
+	if err != nil {
+		bot.Errorf("Ask %s (uid %d): %s", step, user.UID, err)
+	}
+}
+
+// Show the cart with the delivery details and ask the user to confirm the order.
+func showConfirmation(bot bots.BotHandle, user *User, delivery Delivery) {
+	text, keys, err := confirmationMessage(user, delivery)
+	if err != nil {
+		bot.Errorf("Confirmation message (uid %d): %s", user.UID, err)
+		return
+	}
+	if _, err = bot.SendMessage(text, user, keys); err != nil {
+		bot.Errorf("Send confirmation (uid %d): %s", user.UID, err)
+	}
+}
+
+// Make the text and the keyboard of the order confirmation message.
+func confirmationMessage(user *User, delivery Delivery) (string, *bots.Keyboard, error) {
+	cart, err := listCart(user)
+	if err != nil {
+		return "", nil, fmt.Errorf("list cart: %w", err)
+	}
+	orDefault := func(s string) string {
+		if s == "" {
+			return tr(user, "not_set")
+		}
+		return s
+	}
+	text := tr(user, "confirm_order", cart, delivery.Address, delivery.Phone,
+		orDefault(delivery.Time), orDefault(delivery.Comment))
+
+	keys := &bots.Keyboard{}
+	keys.AddRow(bots.KeyboardButton{
+		Label:  tr(user, "btn_confirm"),
+		Color:  bots.ColorPositive,
+		Action: "confirm",
+	})
+
+	balance, err := db.GetPointsBalance(user.UID)
+	if err != nil {
+		return "", nil, fmt.Errorf("get points balance: %w", err)
+	}
+	usePoints, err := db.GetCartUsePoints(user.UID)
+	if err != nil {
+		return "", nil, fmt.Errorf("get cart use points: %w", err)
+	}
+	switch {
+	case usePoints:
+		keys.AddRow(bots.KeyboardButton{Label: tr(user, "btn_keep_points"), Action: "points", Argument: "0"})
+	case balance > 0:
+		keys.AddRow(bots.KeyboardButton{Label: tr(user, "btn_use_points", balance), Action: "points", Argument: "1"})
+	}
+	keys.AddRow(bots.KeyboardButton{Label: tr(user, "btn_change"), Action: "back"})
+	return text, keys, nil
+}
+
+// Register the order from the user's cart with the delivery details collected at checkout.
+func confirmOrder(bot bots.BotHandle, cq *bots.CallbackQuery) {
+	uid := cq.From.UID
+	items, err := db.GetCart(uid)
+	if err != nil {
+		bot.Errorf("Get cart (uid %d): %s", uid, err)
+		return
+	}
+	if len(items) == 0 {
+		return
+	}
+	delivery, err := db.GetCartDelivery(uid)
+	if err != nil {
+		bot.Errorf("Get cart delivery (uid %d): %s", uid, err)
+		return
+	}
+	if delivery.Address == "" || delivery.Phone == "" {
+		startCheckout(bot, cq.From)
+		return
+	}
+
+	offer, err := cartOffer(cq.From)
+	if err != nil {
+		bot.Errorf("Cart offer (uid %d): %s", uid, err)
+		return
+	}
+	promo, err := db.GetCartPromo(uid)
+	if err != nil {
+		bot.Errorf("Get cart promo (uid %d): %s", uid, err)
+		return
+	}
+	points, err := cartPoints(cq.From)
+	if err != nil {
+		bot.Errorf("Cart points (uid %d): %s", uid, err)
+		return
+	}
+	order := &Order{UID: uid, VK: bot.IsVK(), Items: items, Delivery: delivery, PromoCode: promo, Points: points}
+	if offer != nil {
+		order.OfferID = offer.ID
+	}
+
+	bill, err := db.RegisterOrder(order)
+	var orderErr *db.OrderError
+	if text, ok := describePromoError(cq.From, promo, err); ok {
+		// drop the code and let the user confirm the order without it
+		if err = db.SetCartPromo(uid, ""); err != nil {
+			bot.Errorf("Set cart promo (uid %d): %s", uid, err)
+			return
+		}
+		_ = bot.EditMessage(cq.From, cq.MessageID, text + "\n" + tr(cq.From, "promo_removed"), nil)
+		showConfirmation(bot, cq.From, delivery)
+		return
+	}
+	switch {
+	case err == nil:
+		break
+	// the balance has changed since the confirmation was shown
+	case errors.Is(err, db.ErrNotEnoughPoints):
+		_ = bot.EditMessage(cq.From, cq.MessageID, "", nil)
+		showConfirmation(bot, cq.From, delivery)
+		return
+	case errors.As(err, &orderErr) &&
+		(errors.Is(err, db.ErrOutOfStock) || errors.Is(err, db.ErrBadID)):
+		text, keys := describeOrderError(cq.From, orderErr)
+		if err := bot.EditMessage(cq.From, cq.MessageID, text, keys); err != nil {
+			bot.Errorf("Edit message (order error): %s", err)
+		}
+		return
+	// the order does not fit the offer, or the offer is no longer available
+	case errors.Is(err, db.ErrOfferMismatch), errors.Is(err, db.ErrOfferExpired), errors.Is(err, db.ErrBadID):
+		keys := &bots.Keyboard{}
+		keys.AddRow(bots.KeyboardButton{Label: tr(cq.From, "btn_change"), Action: "back"})
+		if err := bot.EditMessage(cq.From, cq.MessageID, tr(cq.From, "offer_mismatch"), keys); err != nil {
+			bot.Errorf("Edit message (offer error): %s", err)
+		}
+		return
+	default:
+		bot.Errorf("Register order (uid %d): %s", uid, err)
+		_, _ = bot.SendMessage(tr(cq.From, "error"), cq.From, nil)
+		return
+	}
+
+	err = db.ClearCart(uid)
+	if err != nil {
+		bot.Errorf("Clear cart (uid %d): %s", uid, err)
+	}
+	_ = bot.EditMessage(cq.From, cq.MessageID, "", nil)
+	text := tr(cq.From, "order_done", order.ID, bill.Total)
+	if bill.PointsEarned > 0 {
+		text += "\n" + tr(cq.From, "points_for_order", bill.PointsEarned)
+	}
+	_, _ = bot.SendMessage(text, cq.From, nil)
+}
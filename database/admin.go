@@ -1,57 +1,220 @@
 package database
 
 import (
-	"bytes"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"golang.org/x/crypto/argon2"
+	"strings"
+
+	. "github.com/xopoww/korm/types"
 )
 
 
 // 	Add an admin to the database
-func AddAdmin(username, password, name string)error {
-	_, err := db.Exec(`INSERT INTO "Admins" (username, passhash, name) VALUES ($1, $2, $3)`,
-		username, makeHash(password), name)
-	return err
+// If there already is an admin with this username, ErrAdminExists is returned.
+func AddAdmin(username, password, name string, role AdminRole)error {
+	if !validRole(role) {
+		return ErrBadRole
+	}
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM Admins WHERE username = $1)`, username).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("select from admins: %w", err)
+	}
+	if exists {
+		return ErrAdminExists
+	}
+
+	hash, err := makeHash(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO "Admins" (username, passhash, name, role) VALUES ($1, $2, $3, $4)`,
+		username, hash, name, role)
+	if err != nil {
+		return fmt.Errorf("insert into admins: %w", err)
+	}
+	db.Infof("Added admin %s (%s).", username, role)
+	return nil
 }
 
-func makeHash(pass string)[]byte {
-	hasher := sha1.New()
-	hasher.Write([]byte(pass))
-	return hasher.Sum(nil)
+// Parameters of the password hashes made by makeHash (recommended by OWASP). They are stored
+// in each hash, so they can be changed without invalidating the existing hashes.
+const (
+	passTime = 2
+	// memory in KiB
+	passMemory = 19 * 1024
+	passThreads = 1
+	// maximum number of hashes computed at the same time (each takes the memory of its hash):
+	// /api/auth is public, so the concurrent logins must not be able to exhaust the memory
+	maxHashing = 4
+	passSaltLen = 16
+	passKeyLen = 32
+	// minimal length of a new password
+	minPasswordLen = 8
+)
+
+// 	Hash the password with Argon2id and a random salt. The result is in the PHC string format:
+//		$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<base64 salt>$<base64 key>
+func makeHash(pass string)([]byte, error) {
+	salt := make([]byte, passSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generate salt: %w", err)
+	}
+	key := argon2Key([]byte(pass), salt, passTime, passMemory, passThreads, passKeyLen)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		passMemory, passTime, passThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
 }
 
-func checkHash(pass string, hash []byte)bool {
-	return bytes.Equal(makeHash(pass), hash)
+// 	Check the password against the hash.
+// Besides the hashes made by makeHash, unsalted SHA-1 hashes of the old versions are accepted:
+// upgrade is true if the hash must be replaced with a new one.
+func checkHash(pass string, hash []byte)(ok, upgrade bool, err error) {
+	if len(hash) == sha1.Size {
+		legacy := sha1.Sum([]byte(pass))
+		return subtle.ConstantTimeCompare(legacy[:], hash) == 1, true, nil
+	}
+
+	var (
+		version, threads int
+		memory, time uint32
+	)
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, false, errors.New("unknown password hash format")
+	}
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, fmt.Errorf("unsupported argon2 version: %s", parts[2])
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, false, fmt.Errorf("parse parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, fmt.Errorf("decode salt: %w", err)
+	}
+	trueKey, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, fmt.Errorf("decode key: %w", err)
+	}
+
+	key := argon2Key([]byte(pass), salt, time, memory, uint8(threads), uint32(len(trueKey)))
+	ok = subtle.ConstantTimeCompare(key, trueKey) == 1
+	// the hashes with other parameters are remade (also when they cost more than needed)
+	upgrade = memory != passMemory || time != passTime || threads != passThreads
+	return ok, ok && upgrade, nil
 }
 
+var hashingSlots = make(chan struct{}, maxHashing)
+
+// argon2Key computes the Argon2id key waiting if maxHashing keys are being computed already.
+func argon2Key(pass, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	hashingSlots <- struct{}{}
+	defer func() { <-hashingSlots }()
+	return argon2.IDKey(pass, salt, time, memory, threads, keyLen)
+}
+
+// 	Generate a random password (for the new admins, who are to change it).
+func GeneratePassword()(string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate password: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Hash checked when there is no such admin, so that the response time doesn't tell that.
+var dummyHash, _ = makeHash("")
+
 //	Check whether the credentials are valid
-// If the check is successful, but credentials are not valid, returns wrapped ErrBadAdmin.
+// If the check is successful, but credentials are not valid (or the admin is disabled),
+// returns wrapped ErrBadAdmin. A hash of an old format is replaced with a new one after a successful check.
 func CheckAdmin(username, password string)error {
-	var trueHash []byte
-	err := db.QueryRow(`SELECT passhash FROM Admins WHERE username = $1`,
-		username).Scan(&trueHash)
+	var (
+		trueHash []byte
+		disabled bool
+	)
+	err := db.QueryRow(`SELECT passhash, disabled FROM Admins WHERE username = $1`,
+		username).Scan(&trueHash, &disabled)
 	switch {
 	case err == nil:
 		break
 	case errors.Is(err, sql.ErrNoRows):
+		_, _, _ = checkHash(password, dummyHash)
 		return errBadUsername
 	default:
 		return err
 	}
 
-	if !checkHash(password, trueHash) {
+	ok, upgrade, err := checkHash(password, trueHash)
+	if err != nil {
+		return fmt.Errorf("check hash of admin %s: %w", username, err)
+	}
+	if !ok {
 		return errBadPassword
 	}
+	// checked after the password so that it doesn't tell anything to those who don't know it
+	if disabled {
+		return errDisabled
+	}
+	if upgrade {
+		if err = upgradeHash(username, password, trueHash); err != nil {
+			// the credentials are valid anyway
+			db.Errorf("Cannot upgrade password hash of admin %s: %s", username, err)
+		}
+	}
 	return nil
 }
 var (
 	ErrBadAdmin = errors.New("invalid credentials")
 	errBadUsername = fmt.Errorf("%w: bad username", ErrBadAdmin)
 	errBadPassword = fmt.Errorf("%w: wrong password", ErrBadAdmin)
+	errDisabled = fmt.Errorf("%w: account is disabled", ErrBadAdmin)
+	ErrWeakPassword = fmt.Errorf("password must be at least %d characters long", minPasswordLen)
 )
 
+// Replace the old hash of the admin's password (unless it has been changed concurrently).
+func upgradeHash(username, password string, oldHash []byte) error {
+	hash, err := makeHash(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE Admins SET passhash = $1 WHERE username = $2 AND passhash = $3`,
+		hash, username, oldHash)
+	if err != nil {
+		return fmt.Errorf("update admins: %w", err)
+	}
+	db.Infof("Upgraded password hash of admin %s.", username)
+	return nil
+}
+
+// 	Change the admin's password. The old password is checked as by CheckAdmin.
+// If the new password is too short, ErrWeakPassword is returned.
+func ChangeAdminPassword(username, oldPassword, newPassword string)error {
+	if len([]rune(newPassword)) < minPasswordLen {
+		return ErrWeakPassword
+	}
+	if err := CheckAdmin(username, oldPassword); err != nil {
+		return err
+	}
+	hash, err := makeHash(newPassword)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE Admins SET passhash = $1 WHERE username = $2`, hash, username)
+	if err != nil {
+		return fmt.Errorf("update admins: %w", err)
+	}
+	db.Infof("Changed password of admin %s.", username)
+	return nil
+}
+
 //  Get admin name by his username
 func GetAdminName(username string)(string, error) {
 	var name string
@@ -61,4 +224,91 @@ func GetAdminName(username string)(string, error) {
 		err = errBadUsername
 	}
 	return name, err
-}
\ No newline at end of file
+}
+
+// 	Get all admins (ordered by username).
+func GetAdmins()([]Admin, error) {
+	admins := make([]Admin, 0)
+	err := db.Select(&admins, `SELECT username, name, role, disabled FROM Admins ORDER BY username`)
+	if err != nil {
+		return nil, fmt.Errorf("select from admins: %w", err)
+	}
+	return admins, nil
+}
+
+// 	Count the admins (including the disabled ones).
+func CountAdmins()(int, error) {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM Admins`).Scan(&n); err != nil {
+		return 0, fmt.Errorf("select from admins: %w", err)
+	}
+	return n, nil
+}
+
+// 	Change the role of the admin.
+// If there is no such admin, ErrUnknownAdmin is returned. The last active owner cannot be demoted (ErrLastOwner).
+func SetAdminRole(username string, role AdminRole)error {
+	if !validRole(role) {
+		return ErrBadRole
+	}
+	return updateAdmin(username, `UPDATE Admins SET role = $1 WHERE username = $2`, role, username)
+}
+
+// 	Disable or enable the admin. The sessions of a disabled admin are ended.
+// If there is no such admin, ErrUnknownAdmin is returned. The last active owner cannot be disabled (ErrLastOwner).
+func SetAdminDisabled(username string, disabled bool)error {
+	return updateAdmin(username, `UPDATE Admins SET disabled = $1 WHERE username = $2`, disabled, username)
+}
+
+// 	Update the admin record making sure that at least one active owner remains.
+func updateAdmin(username, query string, args ...interface{})error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	rollback := func() {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+	}
+
+	r, err := tx.Exec(query, args...)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("update admins: %w", err)
+	}
+	if nRows, _ := r.RowsAffected(); nRows == 0 {
+		rollback()
+		return ErrUnknownAdmin
+	}
+	var owners int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM Admins WHERE role = $1 AND disabled = 0`, RoleOwner).Scan(&owners)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("select from admins: %w", err)
+	}
+	if owners == 0 {
+		rollback()
+		return ErrLastOwner
+	}
+	// a disabled admin mustn't keep the sessions, and the role is looked up with the session anyway
+	if _, err = tx.Exec(`DELETE FROM AdminSessions WHERE username = $1 AND
+	(SELECT disabled FROM Admins WHERE username = $1)`, username); err != nil {
+		rollback()
+		return fmt.Errorf("delete from admin sessions: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	db.Infof("Updated admin %s.", username)
+	return nil
+}
+
+func validRole(role AdminRole) bool {
+	switch role {
+	case RoleOwner, RoleManager, RoleCook, RoleCourier:
+		return true
+	default:
+		return false
+	}
+}
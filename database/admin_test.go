@@ -0,0 +1,104 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	. "github.com/xopoww/korm/types"
+)
+
+// Hash the password as makeHash does, but with other parameters.
+func argon2Hash(pass string, time, memory uint32) []byte {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(pass), salt, time, memory, passThreads, passKeyLen)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, time, passThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)))
+}
+
+func TestCheckHash(t *testing.T) {
+	hash, err := makeHash("secret")
+	if err != nil {
+		t.Fatalf("make hash: %s", err)
+	}
+	legacy := sha1.Sum([]byte("secret"))
+	tests := []struct {
+		name        string
+		pass        string
+		hash        []byte
+		wantOK      bool
+		wantUpgrade bool
+		wantErr     bool
+	}{
+		{"argon2id", "secret", hash, true, false, false},
+		{"argon2id, wrong password", "Secret", hash, false, false, false},
+		{"sha1", "secret", legacy[:], true, true, false},
+		{"sha1, wrong password", "Secret", legacy[:], false, true, false},
+		{"other parameters", "secret", argon2Hash("secret", 1, 8*1024), true, true, false},
+		{"other parameters, wrong password", "Secret", argon2Hash("secret", 1, 8*1024), false, false, false},
+		{"unknown format", "secret", []byte("$2a$10$abcdef"), false, false, true},
+		{"other version", "secret", bytes.Replace(hash, []byte("v=19"), []byte("v=16"), 1), false, false, true},
+		{"bad parameters", "secret", bytes.Replace(hash, []byte("m="), []byte("x="), 1), false, false, true},
+		{"bad salt", "secret", []byte("$argon2id$v=19$m=8192,t=1,p=1$!!!$AAAA"), false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, upgrade, err := checkHash(tt.pass, tt.hash)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkHash() error = %v, want error: %t", err, tt.wantErr)
+			}
+			if ok != tt.wantOK || upgrade != tt.wantUpgrade {
+				t.Errorf("checkHash() = (%t, %t), want (%t, %t)", ok, upgrade, tt.wantOK, tt.wantUpgrade)
+			}
+		})
+	}
+}
+
+func TestCheckAdminUpgrade(t *testing.T) {
+	addTestAdmin(t, "legacy_admin", RoleManager)
+	legacy := sha1.Sum([]byte("old password"))
+	if _, err := db.Exec(`UPDATE Admins SET passhash = $1 WHERE username = $2`, legacy[:], "legacy_admin"); err != nil {
+		t.Fatalf("update admins: %s", err)
+	}
+	passhash := func() []byte {
+		t.Helper()
+		var hash []byte
+		if err := db.QueryRow(`SELECT passhash FROM Admins WHERE username = $1`, "legacy_admin").Scan(&hash); err != nil {
+			t.Fatalf("select from admins: %s", err)
+		}
+		return hash
+	}
+
+	// a wrong password doesn't upgrade anything
+	if err := CheckAdmin("legacy_admin", "wrong password"); !errors.Is(err, ErrBadAdmin) {
+		t.Errorf("check a wrong password: got %v, want ErrBadAdmin", err)
+	}
+	if !bytes.Equal(passhash(), legacy[:]) {
+		t.Fatalf("hash changed after a failed check")
+	}
+
+	if err := CheckAdmin("legacy_admin", "old password"); err != nil {
+		t.Fatalf("check the password against a SHA-1 hash: %s", err)
+	}
+	hash := passhash()
+	if !bytes.HasPrefix(hash, []byte("$argon2id$")) {
+		t.Fatalf("hash was not upgraded: %q", hash)
+	}
+	if ok, upgrade, err := checkHash("old password", hash); err != nil || !ok || upgrade {
+		t.Errorf("checkHash() of the upgraded hash = (%t, %t, %v), want (true, false, nil)", ok, upgrade, err)
+	}
+
+	if err := CheckAdmin("legacy_admin", "old password"); err != nil {
+		t.Errorf("check the password against the upgraded hash: %s", err)
+	}
+	if err := CheckAdmin("legacy_admin", "wrong password"); !errors.Is(err, ErrBadAdmin) {
+		t.Errorf("check a wrong password: got %v, want ErrBadAdmin", err)
+	}
+	if err := CheckAdmin("no_such_admin", "old password"); !errors.Is(err, ErrBadAdmin) {
+		t.Errorf("check an unknown admin: got %v, want ErrBadAdmin", err)
+	}
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	. "github.com/xopoww/korm/types"
+	"time"
+)
+
+// CallbackStorage stores the callback data of the bot buttons in the database
+// (implements bots.CallbackStorage).
+type CallbackStorage struct{}
+
+// Save the callback data under the token replacing the previous one.
+func (CallbackStorage) SaveCallback(token string, data *CallbackData) error {
+	_, err := db.Exec(`
+INSERT INTO Callbacks (token, action, argument, expires) VALUES ($1, $2, $3, $4)
+ON CONFLICT (token) DO UPDATE SET action = excluded.action, argument = excluded.argument, expires = excluded.expires`,
+		token, data.Action, data.Argument, data.Expires.Unix())
+	if err != nil {
+		return fmt.Errorf("upsert into callbacks: %w", err)
+	}
+	return nil
+}
+
+// 	Get the callback data saved under the token.
+// If there is none (or it has expired), nil is returned.
+func (CallbackStorage) GetCallback(token string) (*CallbackData, error) {
+	var (
+		data CallbackData
+		expires int64
+	)
+	err := db.QueryRow(`SELECT action, argument, expires FROM Callbacks WHERE token = $1 AND expires > $2`,
+		token, time.Now().Unix()).Scan(&data.Action, &data.Argument, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("select from callbacks: %w", err)
+	}
+	data.Expires = time.Unix(expires, 0)
+	return &data, nil
+}
+
+// callbacksEraser periodically deletes the expired callback data.
+func callbacksEraser() {
+	for range time.Tick(time.Hour) {
+		r, err := db.Exec(`DELETE FROM Callbacks WHERE expires <= $1`, time.Now().Unix())
+		if err != nil {
+			db.Errorf("Error deleting expired callbacks: %s", err)
+			continue
+		}
+		if nRows, _ := r.RowsAffected(); nRows != 0 {
+			db.Debugf("Deleted %d expired callbacks", nRows)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	. "github.com/xopoww/korm/types"
+	"time"
+)
+
+// 	Get the contents of the user's cart.
+// If the user has no cart yet, an empty slice is returned.
+func GetCart(uid int) ([]OrderItem, error) {
+	r, err := db.Queryx(`SELECT dish_id, quantity FROM CartItems WHERE uid = $1`, uid)
+	if err != nil {
+		return nil, fmt.Errorf("select from cart items: %w", err)
+	}
+	defer func() {
+		if e := r.Close(); e != nil {
+			db.Errorf("Cannot close a result: %s", e)
+		}
+	}()
+
+	items := make([]OrderItem, 0)
+	for r.Next() {
+		var item OrderItem
+		err = r.Scan(&item.DishID, &item.Quantity)
+		if err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		items = append(items, item)
+	}
+
+	db.Tracef("Got %d items from the cart of user %d.", len(items), uid)
+	return items, nil
+}
+
+// 	Add delta portions of the dish to the user's cart.
+// Delta may be negative. If the resulting quantity is not positive, the dish is removed from the cart.
+func AddToCart(uid, dishID, delta int) error {
+	if err := CheckID(dishID, "Dishes"); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+
+	err = touchCart(uid, tx)
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+		return err
+	}
+
+	_, err = tx.Exec(`
+INSERT INTO CartItems (uid, dish_id, quantity) VALUES ($1, $2, $3)
+ON CONFLICT (uid, dish_id) DO UPDATE SET quantity = quantity + excluded.quantity`,
+		uid, dishID, delta)
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+		return fmt.Errorf("upsert into cart items: %w", err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM CartItems WHERE uid = $1 AND quantity <= 0`, uid)
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+		return fmt.Errorf("delete from cart items: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	db.Debugf("Added %d portions of dish %d to the cart of user %d.", delta, dishID, uid)
+	return nil
+}
+
+// 	Remove the dish from the user's cart completely.
+func RemoveFromCart(uid, dishID int) error {
+	_, err := db.Exec(`DELETE FROM CartItems WHERE uid = $1 AND dish_id = $2`, uid, dishID)
+	if err != nil {
+		return fmt.Errorf("delete from cart items: %w", err)
+	}
+	db.Debugf("Removed dish %d from the cart of user %d.", dishID, uid)
+	return nil
+}
+
+// 	Remove all the items from the user's cart together with the choices made for them
+// (the offer, the promo code, the points and the delivery details), so that the next cart
+// goes through the checkout again.
+func ClearCart(uid int) error {
+	_, err := db.Exec(`DELETE FROM CartItems WHERE uid = $1`, uid)
+	if err != nil {
+		return fmt.Errorf("delete from cart items: %w", err)
+	}
+	_, err = db.Exec(`
+UPDATE Carts SET offer_id = NULL, promo_code = NULL, use_points = 0,
+	address = NULL, phone = NULL, delivery_time = NULL, comment = NULL
+WHERE uid = $1`, uid)
+	if err != nil {
+		return fmt.Errorf("update carts: %w", err)
+	}
+	db.Debugf("Cleared the cart of user %d.", uid)
+	return nil
+}
+
+// touchCart creates a cart record for the user (if there is none) and updates its modification time.
+func touchCart(uid int, tx *sql.Tx) error {
+	_, err := tx.Exec(`
+INSERT INTO Carts (uid, updated) VALUES ($1, $2)
+ON CONFLICT (uid) DO UPDATE SET updated = excluded.updated`,
+		uid, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("upsert into carts: %w", err)
+	}
+	return nil
+}
+
+// 	Choose the offer for the user's cart (0 means a regular order).
+// If there is no such offer, an ErrBadID is returned.
+func SetCartOffer(uid, offerID int) error {
+	var offer interface{}
+	if offerID != 0 {
+		if err := CheckID(offerID, "Offers"); err != nil {
+			return err
+		}
+		offer = offerID
+	}
+	_, err := db.Exec(`
+INSERT INTO Carts (uid, updated, offer_id) VALUES ($1, $2, $3)
+ON CONFLICT (uid) DO UPDATE SET updated = excluded.updated, offer_id = excluded.offer_id`,
+		uid, time.Now().Unix(), offer)
+	if err != nil {
+		return fmt.Errorf("upsert into carts: %w", err)
+	}
+	db.Debugf("Set offer of the cart of user %d to %d.", uid, offerID)
+	return nil
+}
+
+// 	Get the id of the offer chosen for the user's cart (0 if there is none).
+func GetCartOffer(uid int) (int, error) {
+	var offerID sql.NullInt64
+	err := db.QueryRow(`SELECT offer_id FROM Carts WHERE uid = $1`, uid).Scan(&offerID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("select from carts: %w", err)
+	}
+	return int(offerID.Int64), nil
+}
+
+// 	Set the promo code entered by the user for the cart (empty string clears it).
+// The code itself is checked when the cart is priced.
+func SetCartPromo(uid int, code string) error {
+	code = NormalizePromoCode(code)
+	_, err := db.Exec(`
+INSERT INTO Carts (uid, updated, promo_code) VALUES ($1, $2, $3)
+ON CONFLICT (uid) DO UPDATE SET updated = excluded.updated, promo_code = excluded.promo_code`,
+		uid, time.Now().Unix(), promoColumn(code))
+	if err != nil {
+		return fmt.Errorf("upsert into carts: %w", err)
+	}
+	db.Debugf("Set promo code of the cart of user %d to %q.", uid, code)
+	return nil
+}
+
+// 	Get the promo code entered for the user's cart (empty if there is none).
+func GetCartPromo(uid int) (string, error) {
+	var code sql.NullString
+	err := db.QueryRow(`SELECT promo_code FROM Carts WHERE uid = $1`, uid).Scan(&code)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("select from carts: %w", err)
+	}
+	return code.String, nil
+}
+
+// 	Choose whether the loyalty points should be spent on the user's order.
+func SetCartUsePoints(uid int, use bool) error {
+	_, err := db.Exec(`
+INSERT INTO Carts (uid, updated, use_points) VALUES ($1, $2, $3)
+ON CONFLICT (uid) DO UPDATE SET updated = excluded.updated, use_points = excluded.use_points`,
+		uid, time.Now().Unix(), use)
+	if err != nil {
+		return fmt.Errorf("upsert into carts: %w", err)
+	}
+	db.Debugf("Set use of points for the cart of user %d to %t.", uid, use)
+	return nil
+}
+
+// 	Check whether the user has chosen to spend the loyalty points on the order.
+func GetCartUsePoints(uid int) (bool, error) {
+	var use bool
+	err := db.QueryRow(`SELECT use_points FROM Carts WHERE uid = $1`, uid).Scan(&use)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, fmt.Errorf("select from carts: %w", err)
+	}
+	return use, nil
+}
+
+// 	Save the delivery details entered by the user at checkout to the user's cart.
+func SetCartDelivery(uid int, delivery Delivery) error {
+	_, err := db.Exec(`
+INSERT INTO Carts (uid, updated, address, phone, delivery_time, comment) VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (uid) DO UPDATE SET updated = excluded.updated, address = excluded.address,
+	phone = excluded.phone, delivery_time = excluded.delivery_time, comment = excluded.comment`,
+		uid, time.Now().Unix(), delivery.Address, delivery.Phone, delivery.Time, delivery.Comment)
+	if err != nil {
+		return fmt.Errorf("upsert into carts: %w", err)
+	}
+	db.Debugf("Set delivery details of the cart of user %d.", uid)
+	return nil
+}
+
+// 	Get the delivery details saved to the user's cart.
+// If there are none, zero Delivery is returned.
+func GetCartDelivery(uid int) (Delivery, error) {
+	var (
+		delivery Delivery
+		address, phone, deliveryTime, comment sql.NullString
+	)
+	err := db.QueryRow(`SELECT address, phone, delivery_time, comment FROM Carts WHERE uid = $1`, uid).
+		Scan(&address, &phone, &deliveryTime, &comment)
+	if errors.Is(err, sql.ErrNoRows) {
+		return delivery, nil
+	}
+	if err != nil {
+		return delivery, fmt.Errorf("select from carts: %w", err)
+	}
+	delivery.Address = address.String
+	delivery.Phone = phone.String
+	delivery.Time = deliveryTime.String
+	delivery.Comment = comment.String
+	return delivery, nil
+}
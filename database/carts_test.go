@@ -0,0 +1,47 @@
+package database
+
+import (
+	"testing"
+
+	. "github.com/xopoww/korm/types"
+)
+
+func TestClearCart(t *testing.T) {
+	uid := addTestUser(t, 401, false)
+	dishID := addTestDish(t, "cart test", 100, 10)
+	if err := AddToCart(uid, dishID, 2); err != nil {
+		t.Fatalf("add to cart: %s", err)
+	}
+	delivery := Delivery{Address: "Street 1", Phone: "+70000000000", Time: "18:00", Comment: "ring twice"}
+	if err := SetCartDelivery(uid, delivery); err != nil {
+		t.Fatalf("set cart delivery: %s", err)
+	}
+	if err := SetCartUsePoints(uid, true); err != nil {
+		t.Fatalf("set cart use points: %s", err)
+	}
+
+	if err := ClearCart(uid); err != nil {
+		t.Fatalf("clear cart: %s", err)
+	}
+	items, err := GetCart(uid)
+	if err != nil {
+		t.Fatalf("get cart: %s", err)
+	}
+	if len(items) != 0 {
+		t.Errorf("items = %v, want none", items)
+	}
+	got, err := GetCartDelivery(uid)
+	if err != nil {
+		t.Fatalf("get cart delivery: %s", err)
+	}
+	if got != (Delivery{}) {
+		t.Errorf("delivery = %+v, want none", got)
+	}
+	use, err := GetCartUsePoints(uid)
+	if err != nil {
+		t.Fatalf("get cart use points: %s", err)
+	}
+	if use {
+		t.Error("use points = true, want false")
+	}
+}
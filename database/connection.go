@@ -1,16 +1,21 @@
 package database
 
 import (
+	"fmt"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
 const (
 	dbName = "korm.db"
 	initScript = "database_creation.sql"
+	// Time (in ms) a connection waits for a lock held by another connection.
+	// Bots handle the updates concurrently, so concurrent writes are expected.
+	busyTimeout = 5000
 )
 
 // DB is a combination of embedded database and logger
@@ -36,7 +41,11 @@ var db *DB
 // Start will panic. A Close function must be called when working with database is finished.
 func Start(cfg *Config) {
 	// open and ping a database
-	handle := sqlx.MustConnect("sqlite3", cfg.Filename)
+	sep := "?"
+	if strings.Contains(cfg.Filename, "?") {
+		sep = "&"
+	}
+	handle := sqlx.MustConnect("sqlite3", fmt.Sprintf("%s%s_busy_timeout=%d", cfg.Filename, sep, busyTimeout))
 	logger := cfg.Logger
 	if logger == nil {
 		logger = &logrus.Logger{}
@@ -63,10 +72,18 @@ func Start(cfg *Config) {
 			db.Panicf("Could not execute init script: %s", err)
 		}
 	}
+	// the script (if any) doesn't change the tables of an existing database
+	if err := migrate(); err != nil {
+		db.Panicf("Could not migrate the database: %s", err)
+	}
 	db.Info("Initialized a database.")
 }
 
 func StartWorkers() {
+	go syncKeysEraser()
+	go convStatesEraser()
+	go callbacksEraser()
+	go sessionsEraser()
 	orderWorker()
 }
 
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/xopoww/korm/types"
+	"time"
+)
+
+// ConvStorage stores the states of the bot conversations in the database
+// (implements bots.StateStorage).
+type ConvStorage struct{}
+
+// 	Get the state of the user's conversation.
+// If there is none (or it has expired), nil is returned.
+func (ConvStorage) GetState(uid int) (*ConvState, error) {
+	var (
+		step, data string
+		expires int64
+	)
+	err := db.QueryRow(`SELECT step, data, expires FROM ConvStates WHERE uid = $1 AND expires > $2`,
+		uid, time.Now().Unix()).Scan(&step, &data, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("select from conv states: %w", err)
+	}
+
+	state := &ConvState{
+		Step:    step,
+		Expires: time.Unix(expires, 0),
+	}
+	if err = json.Unmarshal([]byte(data), &state.Data); err != nil {
+		return nil, fmt.Errorf("unmarshal data: %w", err)
+	}
+	return state, nil
+}
+
+// Save the state of the user's conversation replacing the previous one.
+func (ConvStorage) SetState(uid int, state *ConvState) error {
+	data, err := json.Marshal(state.Data)
+	if err != nil {
+		return fmt.Errorf("marshal data: %w", err)
+	}
+	_, err = db.Exec(`
+INSERT INTO ConvStates (uid, step, data, expires) VALUES ($1, $2, $3, $4)
+ON CONFLICT (uid) DO UPDATE SET step = excluded.step, data = excluded.data, expires = excluded.expires`,
+		uid, state.Step, string(data), state.Expires.Unix())
+	if err != nil {
+		return fmt.Errorf("upsert into conv states: %w", err)
+	}
+	db.Tracef("Set conversation step of user %d to %s.", uid, state.Step)
+	return nil
+}
+
+// Delete the state of the user's conversation (if any).
+func (ConvStorage) DeleteState(uid int) error {
+	_, err := db.Exec(`DELETE FROM ConvStates WHERE uid = $1`, uid)
+	if err != nil {
+		return fmt.Errorf("delete from conv states: %w", err)
+	}
+	return nil
+}
+
+// convStatesEraser periodically deletes the expired conversation states.
+func convStatesEraser() {
+	for range time.Tick(time.Minute) {
+		r, err := db.Exec(`DELETE FROM ConvStates WHERE expires <= $1`, time.Now().Unix())
+		if err != nil {
+			db.Errorf("Error deleting expired conversation states: %s", err)
+			continue
+		}
+		if nRows, _ := r.RowsAffected(); nRows != 0 {
+			db.Debugf("Deleted %d expired conversation states", nRows)
+		}
+	}
+}
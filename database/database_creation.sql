@@ -16,16 +16,26 @@ CREATE TABLE IF NOT EXISTS "Users" (
         id			INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
         vkID		INTEGER UNIQUE,
         tgID		INTEGER UNIQUE,
+        locale		TEXT,
 
         FOREIGN KEY("vkID") REFERENCES VkUsers("id"),
         FOREIGN KEY("tgID") REFERENCES "TgUsers"("id")
 );
 
+CREATE TABLE IF NOT EXISTS "Synchro" (
+        SyncKey     TEXT NOT NULL PRIMARY KEY UNIQUE,
+        id          INTEGER NOT NULL,
+        fromVK      INTEGER NOT NULL,
+        expires     INTEGER NOT NULL
+);
+
 CREATE TABLE IF NOT EXISTS "Admins" (
         id          INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
         username    TEXT NOT NULL UNIQUE,
         passhash    BLOB NOT NULL,
-        name        TEXT NOT NULL
+        name        TEXT NOT NULL,
+        role        TEXT NOT NULL,
+        disabled    INTEGER NOT NULL DEFAULT 0
 );
 
 CREATE TABLE IF NOT EXISTS "DishKinds" (
@@ -45,6 +55,7 @@ CREATE TABLE IF NOT EXISTS "Dishes" (
         description TEXT,
         quantity    INTEGER,
         kind        INTEGER NOT NULL,
+        price       INTEGER,
 
         FOREIGN KEY ("kind") REFERENCES DishKinds("id") ON UPDATE CASCADE
 );
@@ -54,14 +65,35 @@ CREATE TABLE IF NOT EXISTS "Orders" (
         UID			INTEGER NOT NULL,
         time		INTEGER NOT NULL,
         offer_id    INTEGER DEFAULT 0,
+        status      TEXT NOT NULL DEFAULT 'new',
+        vk          INTEGER NOT NULL DEFAULT 0,
+        total       INTEGER,
+        promo_code  TEXT,
+        promo_discount INTEGER,
+        points      INTEGER NOT NULL DEFAULT 0,
+        address     TEXT,
+        phone       TEXT,
+        delivery_time TEXT,
+        comment     TEXT,
 
         FOREIGN KEY("offer_id") REFERENCES Offers("id") ON DELETE SET NULL
 );
 
+CREATE TABLE IF NOT EXISTS "OrderStatuses" (
+        order_id       INTEGER NOT NULL,
+        status         TEXT NOT NULL,
+        time           INTEGER NOT NULL,
+        actor          TEXT,
+        comment        TEXT,
+
+        FOREIGN KEY("order_id") REFERENCES Orders("id") ON DELETE CASCADE
+);
+
 CREATE TABLE IF NOT EXISTS "OrderItems" (
         order_id       INTEGER NOT NULL,
         dish_id        INTEGER NOT NULL,
         quantity       INTEGER NOT NULL,
+        price          INTEGER,
 
         PRIMARY KEY("order_id", "dish_id"),
         FOREIGN KEY("order_id") REFERENCES Orders("id") ON DELETE CASCADE,
@@ -80,7 +112,94 @@ CREATE TABLE IF NOT EXISTS "OfferItems" (
         kind_id         INTEGER NOT NULL,
         quantity        INTEGER NOT NULL,
 
-        FOREIGN KEY("offer_id") REFERENCES Orders("id") ON DELETE CASCADE,
+        FOREIGN KEY("offer_id") REFERENCES Offers("id") ON DELETE CASCADE,
         FOREIGN KEY("kind_id") REFERENCES DishKinds("id"),
         PRIMARY KEY ("offer_id", "kind_id")
-);
\ No newline at end of file
+);
+CREATE TABLE IF NOT EXISTS "Carts" (
+        uid             INTEGER NOT NULL PRIMARY KEY UNIQUE,
+        updated         INTEGER NOT NULL,
+        offer_id        INTEGER,
+        promo_code      TEXT,
+        use_points      INTEGER NOT NULL DEFAULT 0,
+        address         TEXT,
+        phone           TEXT,
+        delivery_time   TEXT,
+        comment         TEXT,
+
+        FOREIGN KEY("uid") REFERENCES Users("id") ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS "CartItems" (
+        uid             INTEGER NOT NULL,
+        dish_id         INTEGER NOT NULL,
+        quantity        INTEGER NOT NULL,
+
+        PRIMARY KEY("uid", "dish_id"),
+        FOREIGN KEY("uid") REFERENCES Carts("uid") ON DELETE CASCADE,
+        FOREIGN KEY("dish_id") REFERENCES Dishes("id") ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS "ConvStates" (
+        uid             INTEGER NOT NULL PRIMARY KEY UNIQUE,
+        step            TEXT NOT NULL,
+        data            TEXT NOT NULL,
+        expires         INTEGER NOT NULL,
+
+        FOREIGN KEY("uid") REFERENCES Users("id") ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS "Callbacks" (
+        token           TEXT NOT NULL PRIMARY KEY UNIQUE,
+        action          TEXT NOT NULL,
+        argument        TEXT NOT NULL,
+        expires         INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS "PromoCodes" (
+        code            TEXT NOT NULL PRIMARY KEY UNIQUE,
+        type            TEXT NOT NULL,
+        value           INTEGER NOT NULL,
+        min_total       INTEGER NOT NULL DEFAULT 0,
+        expires         INTEGER,
+        max_uses        INTEGER NOT NULL DEFAULT 0,
+        max_uses_per_user INTEGER NOT NULL DEFAULT 0,
+        disabled        INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS "PromoKinds" (
+        code            TEXT NOT NULL,
+        kind_id         INTEGER NOT NULL,
+
+        PRIMARY KEY("code", "kind_id"),
+        FOREIGN KEY("code") REFERENCES PromoCodes("code") ON DELETE CASCADE,
+        FOREIGN KEY("kind_id") REFERENCES DishKinds("id") ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS "PromoUses" (
+        code            TEXT NOT NULL,
+        uid             INTEGER NOT NULL,
+        order_id        INTEGER NOT NULL UNIQUE,
+        time            INTEGER NOT NULL,
+
+        FOREIGN KEY("code") REFERENCES PromoCodes("code"),
+        FOREIGN KEY("order_id") REFERENCES Orders("id") ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS "PointsLedger" (
+        id              INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
+        uid             INTEGER NOT NULL,
+        delta           INTEGER NOT NULL,
+        time            INTEGER NOT NULL,
+        order_id        INTEGER,
+        actor           TEXT,
+        reason          TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS "AdminSessions" (
+        id_hash         BLOB NOT NULL PRIMARY KEY,
+        username        TEXT NOT NULL,
+        csrf_token      TEXT NOT NULL,
+        created         INTEGER NOT NULL,
+        last_seen       INTEGER NOT NULL
+);
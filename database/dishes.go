@@ -8,10 +8,11 @@ import (
 )
 
 // 	Add a new dish to the database.
+// If price is nil, the price of the kind is used for the dish.
 // On success, returns an id of the dish inserted.
-func NewDish(name, description string, quantity, kind int) (int, error) {
-	res, err := db.Exec(`INSERT INTO "Dishes" (name, description, quantity, kind) VALUES ($1, $2, $3, $4)`,
-		name, description, quantity, kind)
+func NewDish(name, description string, quantity, kind int, price *int) (int, error) {
+	res, err := db.Exec(`INSERT INTO "Dishes" (name, description, quantity, kind, price) VALUES ($1, $2, $3, $4, $5)`,
+		name, description, quantity, kind, price)
 	if err != nil {
 		return 0, fmt.Errorf("insert into dishes: %w", err)
 	}
@@ -46,7 +47,7 @@ func GetDishes()([]Dish, error) {
 func GetDishesByKind(kind DishKind)([]Dish, error) {
 	r, err := db.Queryx(
 		`
-SELECT id, name, description, quantity FROM Dishes WHERE kind = $1`,
+SELECT id, name, description, quantity, price FROM Dishes WHERE kind = $1`,
 	kind.ID)
 	if err != nil {
 		return nil, err
@@ -60,10 +61,12 @@ SELECT id, name, description, quantity FROM Dishes WHERE kind = $1`,
 	result := make([]Dish, 0)
 	for r.Next() {
 		dish := Dish{Kind: &kind}
-		err = r.Scan(&dish.ID, &dish.Name, &dish.Description, &dish.Quantity)
+		var price sql.NullInt64
+		err = r.Scan(&dish.ID, &dish.Name, &dish.Description, &dish.Quantity, &price)
 		if err != nil {
 			return nil, fmt.Errorf("scan: %w", err)
 		}
+		dish.Price = nullPrice(price)
 		result = append(result, dish)
 	}
 
@@ -74,16 +77,18 @@ SELECT id, name, description, quantity FROM Dishes WHERE kind = $1`,
 
 // 	Get a dish by its ID.
 func GetDishByID(id int)(*Dish, error){
-	d := Dish{ID: id}
+	d := Dish{ID: id, Kind: &DishKind{}}
+	var price sql.NullInt64
 	err := db.QueryRowx(
 		`
-SELECT name, description, quantity, repr, price
+SELECT name, description, quantity, Dishes.price, DishKinds.id, repr, DishKinds.price
 FROM Dishes JOIN DishKinds ON Dishes.Kind = DishKinds.id
 WHERE Dishes.id = $1`,
-		id).StructScan(&d)
+		id).Scan(&d.Name, &d.Description, &d.Quantity, &price, &d.Kind.ID, &d.Kind.Repr, &d.Kind.Price)
 
 	switch {
 	case err == nil:
+		d.Price = nullPrice(price)
 		return &d, nil
 	case errors.Is(err, sql.ErrNoRows):
 		return nil, ErrBadID
@@ -144,9 +149,99 @@ func DelDish(id int) error {
 	return nil
 }
 
+// 	Replace the fields of the dish record (found by dish.ID). Only Kind.ID of the dish kind is used.
+// If there is no such dish, an ErrBadID is returned.
+func UpdateDish(dish *Dish) error {
+	res, err := db.Exec(`
+UPDATE Dishes SET name = $1, description = $2, quantity = $3, kind = $4, price = $5 WHERE id = $6`,
+		dish.Name, dish.Description, dish.Quantity, dish.Kind.ID, dish.Price, dish.ID)
+	if err != nil {
+		return fmt.Errorf("update dishes: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBadID
+	}
+	db.Debugf("Updated dish %d.", dish.ID)
+	return nil
+}
+
 
 // ======== Dish kinds ========
 
+// 	Add a new dish kind. Returns the id of the kind inserted.
+// If there is a kind with the same name, an ErrKindExists is returned.
+func NewDishKind(repr string, price int) (int, error) {
+	if err := checkKindName(repr, 0); err != nil {
+		return 0, err
+	}
+	res, err := db.Exec(`INSERT INTO DishKinds (repr, price) VALUES ($1, $2)`, repr, price)
+	if err != nil {
+		return 0, fmt.Errorf("insert into dish kinds: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("last insert id: %w", err)
+	}
+	db.Debugf("Added dish kind %d (%s).", id, repr)
+	return int(id), nil
+}
+
+// 	Replace the name and the price of the dish kind (found by kind.ID).
+// If there is no such kind, an ErrBadID is returned.
+// If there is another kind with the same name, an ErrKindExists is returned.
+func UpdateDishKind(kind *DishKind) error {
+	if err := checkKindName(kind.Repr, kind.ID); err != nil {
+		return err
+	}
+	res, err := db.Exec(`UPDATE DishKinds SET repr = $1, price = $2 WHERE id = $3`, kind.Repr, kind.Price, kind.ID)
+	if err != nil {
+		return fmt.Errorf("update dish kinds: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBadID
+	}
+	db.Debugf("Updated dish kind %d.", kind.ID)
+	return nil
+}
+
+// checkKindName checks that no kind except the one with id uses the name (DishKinds.repr is unique).
+func checkKindName(repr string, id int) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM DishKinds WHERE repr = $1 AND id != $2`, repr, id).Scan(&n)
+	if err != nil {
+		return fmt.Errorf("count dish kinds: %w", err)
+	}
+	if n != 0 {
+		return ErrKindExists
+	}
+	return nil
+}
+
+// 	Delete the dish kind.
+// If there are dishes or offer slots of this kind, an ErrKindInUse is returned.
+// If there is no such kind, an ErrBadID is returned.
+func DelDishKind(id int) error {
+	var uses int
+	err := db.QueryRow(`
+SELECT (SELECT COUNT(*) FROM Dishes WHERE kind = $1) + (SELECT COUNT(*) FROM OfferItems WHERE kind_id = $1)`,
+		id).Scan(&uses)
+	if err != nil {
+		return fmt.Errorf("count kind uses: %w", err)
+	}
+	if uses != 0 {
+		return ErrKindInUse
+	}
+	res, err := db.Exec(`DELETE FROM DishKinds WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("delete from dish kinds: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBadID
+	}
+	db.Debugf("Deleted dish kind %d.", id)
+	return nil
+}
+
 // 	Load a list of all available dish kinds from database.
 func GetDishKinds() ([]DishKind, error) {
 	r, err := db.Queryx(`SELECT * FROM DishKinds`)
@@ -172,4 +267,25 @@ func GetDishKinds() ([]DishKind, error) {
 	return kinds, nil
 }
 
+// 	Get a dish kind by its ID.
+func GetDishKindByID(id int) (*DishKind, error) {
+	var kind DishKind
+	err := db.QueryRowx(`SELECT * FROM DishKinds WHERE id = $1`, id).StructScan(&kind)
+	switch {
+	case err == nil:
+		return &kind, nil
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrBadID
+	default:
+		return nil, err
+	}
+}
 
+// Convert a nullable price column to Dish.Price.
+func nullPrice(price sql.NullInt64) *int {
+	if !price.Valid {
+		return nil
+	}
+	p := int(price.Int64)
+	return &p
+}
@@ -0,0 +1,30 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "korm")
+	if err != nil {
+		panic(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	Start(&Config{
+		Filename:   filepath.Join(dir, "test.db"),
+		InitScript: "database_creation.sql",
+		Logger:     logger,
+	})
+	go orderWorker()
+
+	code := m.Run()
+	Close()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
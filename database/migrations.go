@@ -0,0 +1,136 @@
+package database
+
+import (
+	"fmt"
+)
+
+// Columns added to the tables after they had been deployed. CREATE TABLE IF NOT EXISTS in the
+// init script doesn't touch the existing tables, so the missing columns are added by migrate.
+// The definitions of NOT NULL columns must have a default (it is what the existing rows get).
+var columnMigrations = []struct{
+	table		string
+	column		string
+	definition	string
+}{
+	{"Users", "locale", "TEXT"},
+	{"Orders", "address", "TEXT"},
+	{"Orders", "phone", "TEXT"},
+	{"Orders", "delivery_time", "TEXT"},
+	{"Orders", "comment", "TEXT"},
+	{"Carts", "address", "TEXT"},
+	{"Carts", "phone", "TEXT"},
+	{"Carts", "delivery_time", "TEXT"},
+	{"Carts", "comment", "TEXT"},
+	{"Orders", "status", "TEXT NOT NULL DEFAULT 'new'"},
+	{"Orders", "vk", "INTEGER NOT NULL DEFAULT 0"},
+	{"Carts", "offer_id", "INTEGER"},
+	{"Orders", "total", "INTEGER"},
+	{"OrderItems", "price", "INTEGER"},
+	{"Dishes", "price", "INTEGER"},
+	{"Orders", "promo_code", "TEXT"},
+	{"Orders", "promo_discount", "INTEGER"},
+	{"Carts", "promo_code", "TEXT"},
+	{"Orders", "points", "INTEGER NOT NULL DEFAULT 0"},
+	{"Carts", "use_points", "INTEGER NOT NULL DEFAULT 0"},
+	// the admins of the versions without roles could do everything
+	{"Admins", "role", "TEXT NOT NULL DEFAULT 'owner'"},
+	{"Admins", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// 	Bring the tables created by the older versions up to date.
+// Must be called after the init script (if any). The tables that don't exist are skipped.
+// Every step checks whether it is needed, so migrate may be run on any database any number of times.
+func migrate() error {
+	for _, m := range columnMigrations {
+		exists, err := tableExists(m.table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		exists, err = columnExists(m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		_, err = db.Exec(fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN %s %s`, m.table, m.column, m.definition))
+		if err != nil {
+			return fmt.Errorf("add column %s.%s: %w", m.table, m.column, err)
+		}
+		db.Infof("Migration: added column %s.%s.", m.table, m.column)
+	}
+	return fixOfferItemsKey()
+}
+
+func tableExists(table string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = $1)`,
+		table).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("select from sqlite master: %w", err)
+	}
+	return exists, nil
+}
+
+func columnExists(table, column string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM pragma_table_info($1) WHERE name = $2)`,
+		table, column).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("table info of %s: %w", table, err)
+	}
+	return exists, nil
+}
+
+// 	OfferItems.offer_id of the old versions references Orders instead of Offers.
+// SQLite cannot alter a foreign key, so the table is rebuilt.
+func fixOfferItemsKey() error {
+	var wrong bool
+	err := db.QueryRow(`
+SELECT EXISTS(SELECT 1 FROM pragma_foreign_key_list('OfferItems') WHERE "from" = 'offer_id' AND "table" = 'Orders')`).
+		Scan(&wrong)
+	if err != nil {
+		return fmt.Errorf("foreign keys of OfferItems: %w", err)
+	}
+	if !wrong {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	rollback := func() {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+	}
+	steps := []string{
+		`CREATE TABLE "OfferItems_new" (
+        offer_id        INTEGER NOT NULL,
+        kind_id         INTEGER NOT NULL,
+        quantity        INTEGER NOT NULL,
+
+        FOREIGN KEY("offer_id") REFERENCES Offers("id") ON DELETE CASCADE,
+        FOREIGN KEY("kind_id") REFERENCES DishKinds("id"),
+        PRIMARY KEY ("offer_id", "kind_id")
+)`,
+		`INSERT INTO OfferItems_new (offer_id, kind_id, quantity) SELECT offer_id, kind_id, quantity FROM OfferItems`,
+		`DROP TABLE OfferItems`,
+		`ALTER TABLE OfferItems_new RENAME TO OfferItems`,
+	}
+	for _, step := range steps {
+		if _, err = tx.Exec(step); err != nil {
+			rollback()
+			return fmt.Errorf("rebuild OfferItems: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	db.Info("Migration: fixed the foreign key of OfferItems.offer_id.")
+	return nil
+}
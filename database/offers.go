@@ -1,29 +1,34 @@
 package database
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	. "github.com/xopoww/korm/types"
 	"time"
 )
 
 // 	Get the list of items for the offer by its ID
-func getOfferItems(id int) ([]OfferItem, error) {
-	r, err := db.Queryx("SELECT * FROM OfferItems WHERE offer_id = $1", id)
+func getOfferItems(id int, q queryer) ([]OfferItem, error) {
+	r, err := q.Query(`
+SELECT quantity, DishKinds.id, repr, price FROM OfferItems
+JOIN DishKinds ON OfferItems.kind_id = DishKinds.id
+WHERE offer_id = $1`, id)
 	if err != nil {
 		return nil, fmt.Errorf("select from offer items: %w", err)
 	}
 	defer func(){
 		if e := r.Close(); e != nil {
-			db.Errorf("Cannot close a result: %s", err)
+			db.Errorf("Cannot close a result: %s", e)
 		}
 	}()
 
 	items := make([]OfferItem, 0)
 	for r.Next() {
-		var item OfferItem
-		err = r.StructScan(&item)
+		item := OfferItem{Kind: &DishKind{}}
+		err = r.Scan(&item.Quantity, &item.Kind.ID, &item.Kind.Repr, &item.Kind.Price)
 		if err != nil {
-			return nil, fmt.Errorf("struct scan: %s", err)
+			return nil, fmt.Errorf("scan: %s", err)
 		}
 		items = append(items, item)
 	}
@@ -31,36 +36,243 @@ func getOfferItems(id int) ([]OfferItem, error) {
 	return items, nil
 }
 
-//  Get the list of all active offers
-func GetOffers() ([]Offer, error) {
-	r, err := db.Queryx(`SELECT * FROM Offers WHERE expires > $1`, time.Now().Unix())
+// queryer is implemented by both *sqlx.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// 	Get the list of offers.
+// If all is false, only active (not expired) offers are returned.
+func GetOffers(all bool) ([]Offer, error) {
+	query := `SELECT id, name, price, expires FROM Offers`
+	var args []interface{}
+	if !all {
+		query += ` WHERE expires IS NULL OR expires > $1`
+		args = append(args, time.Now().Unix())
+	}
+	r, err := db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("select from offers: %w", err)
 	}
-	defer func(){
-		if e := r.Close(); e != nil {
-			db.Errorf("Cannot close a result: %s", err)
-		}
-	}()
 
 	offers := make([]Offer, 0)
 	for r.Next() {
-		var (
-			offer Offer
-			unixTime int64
-		)
-		err = r.Scan(offer.ID, offer.Description, offer.Price, &unixTime)
+		offer, err := scanOffer(r)
 		if err != nil {
-			return nil, fmt.Errorf("scan: %w", err)
+			_ = r.Close()
+			return nil, err
 		}
-		offer.Expires = time.Unix(unixTime, 0)
-		items, err := getOfferItems(offer.ID)
+		offers = append(offers, *offer)
+	}
+	// close the result before querying the items
+	if err = r.Close(); err != nil {
+		return nil, fmt.Errorf("close result: %w", err)
+	}
+
+	for i := range offers {
+		offers[i].Items, err = getOfferItems(offers[i].ID, db)
 		if err != nil {
 			return nil, fmt.Errorf("get offer items: %w", err)
 		}
-		offer.Items = items
-		offers = append(offers, offer)
 	}
-
 	return offers, nil
-}
\ No newline at end of file
+}
+
+// 	Get the offer by its ID.
+// If there is no such offer, an ErrBadID is returned.
+func GetOffer(id int) (*Offer, error) {
+	return getOffer(id, db)
+}
+
+func getOffer(id int, q queryer) (*Offer, error) {
+	offer, err := scanOffer(q.QueryRow(`SELECT id, name, price, expires FROM Offers WHERE id = $1`, id))
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrBadID
+	default:
+		return nil, err
+	}
+	offer.Items, err = getOfferItems(id, q)
+	if err != nil {
+		return nil, fmt.Errorf("get offer items: %w", err)
+	}
+	return offer, nil
+}
+
+func scanOffer(row interface{ Scan(...interface{}) error }) (*Offer, error) {
+	var (
+		offer Offer
+		name sql.NullString
+		expires sql.NullInt64
+	)
+	err := row.Scan(&offer.ID, &name, &offer.Price, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+	offer.Name = name.String
+	if expires.Valid {
+		offer.Expires = time.Unix(expires.Int64, 0)
+	}
+	return &offer, nil
+}
+
+// 	Create a new offer with its items. Only Kind.ID of the items' kinds is used.
+// Returns the id of the created offer.
+func NewOffer(offer *Offer) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin tx: %w", err)
+	}
+	res, err := tx.Exec(`INSERT INTO Offers (name, price, expires) VALUES ($1, $2, $3)`,
+		offer.Name, offer.Price, offerExpires(offer))
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+		return 0, fmt.Errorf("insert into offers: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+		return 0, fmt.Errorf("last insert id: %w", err)
+	}
+	if err = setOfferItems(int(id), offer.Items, tx); err != nil {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit tx: %w", err)
+	}
+	db.Infof("Created offer %d (%s).", id, offer.Name)
+	return int(id), nil
+}
+
+// 	Replace the offer (found by offer.ID) and its items.
+// If there is no such offer, an ErrBadID is returned.
+func UpdateOffer(offer *Offer) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	rollback := func() {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+	}
+	res, err := tx.Exec(`UPDATE Offers SET name = $1, price = $2, expires = $3 WHERE id = $4`,
+		offer.Name, offer.Price, offerExpires(offer), offer.ID)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("update offers: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		rollback()
+		return ErrBadID
+	}
+	if _, err = tx.Exec(`DELETE FROM OfferItems WHERE offer_id = $1`, offer.ID); err != nil {
+		rollback()
+		return fmt.Errorf("delete from offer items: %w", err)
+	}
+	if err = setOfferItems(offer.ID, offer.Items, tx); err != nil {
+		rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	db.Infof("Updated offer %d (%s).", offer.ID, offer.Name)
+	return nil
+}
+
+// 	Delete the offer with its items.
+// If there is no such offer, an ErrBadID is returned.
+func DelOffer(id int) error {
+	if err := CheckID(id, "Offers"); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	for _, query := range []string{
+		`DELETE FROM OfferItems WHERE offer_id = $1`,
+		`UPDATE Carts SET offer_id = NULL WHERE offer_id = $1`,
+		`DELETE FROM Offers WHERE id = $1`,
+	} {
+		if _, err = tx.Exec(query, id); err != nil {
+			if e := tx.Rollback(); e != nil {
+				db.Errorf("Cannot rollback a transaction: %s", e)
+			}
+			return fmt.Errorf("delete offer: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	db.Infof("Deleted offer %d.", id)
+	return nil
+}
+
+func setOfferItems(offerID int, items []OfferItem, tx *sql.Tx) error {
+	for _, item := range items {
+		if item.Kind == nil || item.Quantity <= 0 {
+			return fmt.Errorf("invalid offer item: %+v", item)
+		}
+		_, err := tx.Exec(`INSERT INTO OfferItems (offer_id, kind_id, quantity) VALUES ($1, $2, $3)`,
+			offerID, item.Kind.ID, item.Quantity)
+		if err != nil {
+			return fmt.Errorf("insert into offer items: %w", err)
+		}
+	}
+	return nil
+}
+
+// Get the value of Offers.expires column for the offer
+func offerExpires(offer *Offer) interface{} {
+	if offer.Expires.IsZero() {
+		return nil
+	}
+	return offer.Expires.Unix()
+}
+
+// 	Check that the items exactly fill the slots of the offer:
+// for each slot the number of portions of the slot kind must be equal to the slot quantity,
+// and there must be no dishes of other kinds.
+func checkOfferItems(offer *Offer, items []OrderItem, q queryer) error {
+	portions := make(map[int]int)
+	for _, item := range items {
+		var kindID int
+		err := q.QueryRow(`SELECT kind FROM Dishes WHERE id = $1`, item.DishID).Scan(&kindID)
+		switch {
+		case err == nil:
+			break
+		case errors.Is(err, sql.ErrNoRows):
+			return &OrderError{DishID: item.DishID, Err: ErrBadID}
+		default:
+			return fmt.Errorf("select from dishes: %w", err)
+		}
+		portions[kindID] += item.Quantity
+	}
+
+	for _, slot := range offer.Items {
+		if portions[slot.Kind.ID] != slot.Quantity {
+			return fmt.Errorf("%w: %d portions of %s instead of %d",
+				ErrOfferMismatch, portions[slot.Kind.ID], slot.Kind.Repr, slot.Quantity)
+		}
+		delete(portions, slot.Kind.ID)
+	}
+	if len(portions) != 0 {
+		return fmt.Errorf("%w: dishes of other kinds", ErrOfferMismatch)
+	}
+	return nil
+}
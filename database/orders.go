@@ -1,6 +1,8 @@
 package database
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	. "github.com/xopoww/korm/types"
 	"time"
@@ -8,18 +10,24 @@ import (
 
 // 	Channels for registering an order.
 // If a goroutine wants to register an order, it uses RegisterOrder function
-// to put an Order object to orderIn chan and waits for the result (error or nil)
+// to put an Order object to orderIn chan and waits for the result (bill or error)
 // to appear in orderOut.
 var (
 	orderIn = make(chan *Order)
-	orderOut = make(chan error)
+	orderOut = make(chan orderResult)
 )
 
+type orderResult struct {
+	bill	*Bill
+	err		error
+}
+
 // orderWorker is a internal function that picks orders from orderIn, executes them synchronously
 // and puts the result to orderOut
 func orderWorker() {
 	for order := range orderIn {
-		orderOut <- makeOrder(order.UID, order.Items)
+		bill, err := makeOrder(order)
+		orderOut <- orderResult{bill, err}
 	}
 }
 
@@ -27,58 +35,253 @@ func orderWorker() {
 // Only this function can be used to make an order from outside the package.
 // If another order is being processed at the moment, RegisterOrder will block
 // until worker processes the registered order.
-func RegisterOrder(order *Order) error {
+// On success returns the bill with the amount charged for the order.
+func RegisterOrder(order *Order) (*Bill, error) {
 	orderIn <- order
-	return <- orderOut
+	res := <- orderOut
+	return res.bill, res.err
+}
+
+// OrderError is returned by RegisterOrder if one of the order items could not be processed.
+// Use errors.Is on it to find out the reason (e.g. ErrOutOfStock or ErrBadID).
+type OrderError struct {
+	DishID	int
+	Err		error
+}
+
+func (e *OrderError) Error() string {
+	return fmt.Sprintf("sub dish (id %d): %s", e.DishID, e.Err)
+}
+
+func (e *OrderError) Unwrap() error {
+	return e.Err
 }
 
 // 	Make an order.
-// Subtracts the ordered items from the DB and records an order.
+// Subtracts the ordered items from the DB and records an order with the prices of its items and the total.
 // If (at any point) an error is encountered, it's returned and no changes will be made to the DB.
-func makeOrder(uid int, items []OrderItem) error {
+func makeOrder(order *Order) (*Bill, error) {
 	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("begin tx: %w", err)
+		return nil, fmt.Errorf("begin tx: %w", err)
 	}
-
-	res, err := tx.Exec(`INSERT INTO Orders (UID, time) VALUES ($1, $2)`, uid, time.Now().Unix())
-	if err != nil {
+	rollback := func() {
 		if e := tx.Rollback(); e != nil {
-			db.Errorf("Cannot rollback a transaction: %s", err)
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+	}
+
+	var offer *Offer
+	if order.OfferID != 0 {
+		offer, err = checkOrderOffer(order, tx)
+		if err != nil {
+			rollback()
+			return nil, err
 		}
-		return fmt.Errorf("insert into orders: %w", err)
+	}
+	bill, err := priceOrder(order, offer, tx)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	res, err := tx.Exec(`
+INSERT INTO Orders (UID, time, offer_id, status, vk, total, promo_code, promo_discount, points,
+	address, phone, delivery_time, comment)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		order.UID, now, order.OfferID, StatusNew, order.VK, bill.Total, promoColumn(bill.PromoCode), bill.PromoDiscount,
+		bill.Points, order.Address, order.Phone, order.Delivery.Time, order.Comment)
+	if err != nil {
+		rollback()
+		return nil, fmt.Errorf("insert into orders: %w", err)
 	}
 	orderID, err := res.LastInsertId()
 	if err != nil {
-		if e := tx.Rollback(); e != nil {
-			db.Errorf("Cannot rollback a transaction: %s", err)
+		rollback()
+		return nil, fmt.Errorf("last insert id: %s", err)
+	}
+	_, err = tx.Exec(`INSERT INTO OrderStatuses (order_id, status, time) VALUES ($1, $2, $3)`,
+		orderID, StatusNew, now)
+	if err != nil {
+		rollback()
+		return nil, fmt.Errorf("insert into order statuses: %w", err)
+	}
+	if bill.PromoCode != "" {
+		_, err = tx.Exec(`INSERT INTO PromoUses (code, uid, order_id, time) VALUES ($1, $2, $3, $4)`,
+			bill.PromoCode, order.UID, orderID, now)
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("insert into promo uses: %w", err)
 		}
-		return fmt.Errorf("last insert id: %s", err)
+	}
+	if err = chargeOrderPoints(order.UID, int(orderID), bill, tx); err != nil {
+		rollback()
+		return nil, err
+	}
+
+	for _, line := range bill.Lines {
+		err = SubDish(line.DishID, line.Quantity, tx)
+		if err != nil {
+			rollback()
+			return nil, &OrderError{DishID: line.DishID, Err: err}
+		}
+
+		_, err = tx.Exec(`INSERT INTO OrderItems (order_id, dish_id, quantity, price) VALUES ($1, $2, $3, $4)`,
+			orderID, line.DishID, line.Quantity, line.UnitPrice)
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("insert into order items: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit tx: %w", err)
+	}
+	order.ID = int(orderID)
+	order.Status = StatusNew
+	order.Total = bill.Total
+	order.PromoCode = bill.PromoCode
+	order.Points = bill.Points
+	db.Infof("An order (id %d, total %d) successfully made.", orderID, bill.Total)
+	return bill, nil
+}
+
+// Check that the offer chosen for the order is active and the order items fill its slots.
+func checkOrderOffer(order *Order, tx *sql.Tx) (*Offer, error) {
+	offer, err := getOffer(order.OfferID, tx)
+	if err != nil {
+		return nil, fmt.Errorf("get offer (id %d): %w", order.OfferID, err)
+	}
+	if !offer.Expires.IsZero() && offer.Expires.Before(time.Now()) {
+		return nil, ErrOfferExpired
+	}
+	if err = checkOfferItems(offer, order.Items, tx); err != nil {
+		return nil, err
+	}
+	return offer, nil
+}
+
+// 	Get the order by its id (with items and delivery details).
+// If there is no such order, an ErrBadID is returned.
+func GetOrder(id int) (*Order, error) {
+	var (
+		order = Order{ID: id}
+		orderTime int64
+		offerID, total sql.NullInt64
+		promoCode, address, phone, deliveryTime, comment sql.NullString
+	)
+	err := db.QueryRow(`
+SELECT UID, vk, status, time, offer_id, total, promo_code, points, address, phone, delivery_time, comment
+FROM Orders WHERE id = $1`, id).
+		Scan(&order.UID, &order.VK, &order.Status, &orderTime, &offerID, &total,
+			&promoCode, &order.Points, &address, &phone, &deliveryTime, &comment)
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrBadID
+	default:
+		return nil, fmt.Errorf("select from orders: %w", err)
+	}
+	order.Created = time.Unix(orderTime, 0)
+	order.OfferID = int(offerID.Int64)
+	order.Total = int(total.Int64)
+	order.PromoCode = promoCode.String
+	order.Address = address.String
+	order.Phone = phone.String
+	order.Delivery.Time = deliveryTime.String
+	order.Comment = comment.String
+
+	order.Items, err = getOrderItems(id)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// 	Get a page of the user's orders (newest first) and the total number of the user's orders.
+func GetUserOrders(uid, offset, limit int) ([]Order, int, error) {
+	var total int
+	err := db.QueryRow(`SELECT COUNT(*) FROM Orders WHERE UID = $1`, uid).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("count orders: %w", err)
+	}
+
+	var ids []int
+	err = db.Select(&ids, `SELECT id FROM Orders WHERE UID = $1 ORDER BY time DESC, id DESC LIMIT $2 OFFSET $3`,
+		uid, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("select from orders: %w", err)
 	}
 
-	for _, item := range items {
-		err = SubDish(item.DishID, item.Quantity, tx)
+	orders := make([]Order, 0, len(ids))
+	for _, id := range ids {
+		order, err := GetOrder(id)
 		if err != nil {
-			if e := tx.Rollback(); e != nil {
-				db.Errorf("Cannot rollback a transaction: %s", err)
-			}
-			return fmt.Errorf("sub dish (id %d): %w", item.DishID, err)
+			return nil, 0, fmt.Errorf("get order (id %d): %w", id, err)
 		}
+		orders = append(orders, *order)
+	}
+	return orders, total, nil
+}
 
-		_, err = tx.Exec(`INSERT INTO OrderItems (order_id, dish_id, quantity) VALUES ($1, $2, $3)`,
-			orderID, item.DishID, item.Quantity)
+// 	Get a page of all orders (newest first) and the total number of them.
+// If status is not empty, only the orders with this status are returned.
+func GetOrders(status OrderStatus, offset, limit int) ([]Order, int, error) {
+	where := ""
+	args := []interface{}{}
+	if status != "" {
+		where = ` WHERE status = $1`
+		args = append(args, status)
+	}
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM Orders` + where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count orders: %w", err)
+	}
+
+	var ids []int
+	err := db.Select(&ids,
+		fmt.Sprintf(`SELECT id FROM Orders%s ORDER BY time DESC, id DESC LIMIT $%d OFFSET $%d`,
+			where, len(args) + 1, len(args) + 2),
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("select from orders: %w", err)
+	}
+
+	orders := make([]Order, 0, len(ids))
+	for _, id := range ids {
+		order, err := GetOrder(id)
 		if err != nil {
-			if e := tx.Rollback(); e != nil {
-				db.Errorf("Cannot rollback a transaction: %s", err)
-			}
-			return fmt.Errorf("insert into order items: %w", err)
+			return nil, 0, fmt.Errorf("get order (id %d): %w", id, err)
 		}
+		orders = append(orders, *order)
+	}
+	return orders, total, nil
+}
+
+func getOrderItems(orderID int) ([]OrderItem, error) {
+	r, err := db.Query(`SELECT dish_id, quantity, price FROM OrderItems WHERE order_id = $1`, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("select from order items: %w", err)
 	}
+	defer func() {
+		if e := r.Close(); e != nil {
+			db.Errorf("Cannot close a result: %s", e)
+		}
+	}()
 
-	if e := tx.Commit(); e != nil {
-		db.Errorf("Cannot commit a transaction: %s", err)
-		return e
+	items := make([]OrderItem, 0)
+	for r.Next() {
+		var (
+			item OrderItem
+			price sql.NullInt64
+		)
+		if err = r.Scan(&item.DishID, &item.Quantity, &price); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		item.Price = int(price.Int64)
+		items = append(items, item)
 	}
-	db.Infof("An order (id %d) successfully made.", orderID)
-	return nil
-}
\ No newline at end of file
+	return items, nil
+}
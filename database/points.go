@@ -0,0 +1,212 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	. "github.com/xopoww/korm/types"
+	"time"
+)
+
+// Percentage of the order total (after all discounts) credited to the customer as loyalty points.
+// One point is worth one rouble.
+const pointsPercent = 5
+
+// Reasons of the ledger entries made by the system (the entries made by the admins have an actor)
+const (
+	// points spent on or earned by the order (PointsEntry.OrderID)
+	PointsReasonOrder = "order"
+	// the order (PointsEntry.OrderID) has been cancelled
+	PointsReasonCancelled = "order cancelled"
+	// the balance has been moved when the user's accounts were merged
+	PointsReasonMerge = "accounts merged"
+)
+
+// 	Get the loyalty points balance of the user.
+func GetPointsBalance(uid int) (int, error) {
+	return pointsBalance(uid, db)
+}
+
+func pointsBalance(uid int, q queryer) (int, error) {
+	var balance int
+	err := q.QueryRow(`SELECT COALESCE(SUM(delta), 0) FROM PointsLedger WHERE uid = $1`, uid).Scan(&balance)
+	if err != nil {
+		return 0, fmt.Errorf("select from points ledger: %w", err)
+	}
+	return balance, nil
+}
+
+// 	Get the last entries of the user's loyalty points ledger (newest first).
+func GetPointsHistory(uid, limit int) ([]PointsEntry, error) {
+	r, err := db.Query(`
+SELECT id, delta, time, order_id, actor, reason FROM PointsLedger WHERE uid = $1
+ORDER BY id DESC LIMIT $2`, uid, limit)
+	if err != nil {
+		return nil, fmt.Errorf("select from points ledger: %w", err)
+	}
+	defer func() {
+		if e := r.Close(); e != nil {
+			db.Errorf("Cannot close a result: %s", e)
+		}
+	}()
+
+	entries := make([]PointsEntry, 0)
+	for r.Next() {
+		var (
+			entry = PointsEntry{UID: uid}
+			entryTime int64
+			orderID sql.NullInt64
+			actor sql.NullString
+		)
+		if err = r.Scan(&entry.ID, &entry.Delta, &entryTime, &orderID, &actor, &entry.Reason); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		entry.Time = time.Unix(entryTime, 0)
+		entry.OrderID = int(orderID.Int64)
+		entry.Actor = actor.String
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// 	Credit (or debit, if delta is negative) the user's loyalty points on behalf of actor.
+// The balance cannot become negative (ErrNotEnoughPoints is returned).
+// If there is no such user, an ErrBadID is returned. Returns the new balance.
+func AdjustPoints(uid, delta int, actor, reason string) (int, error) {
+	if err := CheckID(uid, "Users"); err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin tx: %w", err)
+	}
+	rollback := func() {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+	}
+
+	balance, err := pointsBalance(uid, tx)
+	if err != nil {
+		rollback()
+		return 0, err
+	}
+	if balance + delta < 0 {
+		rollback()
+		return 0, ErrNotEnoughPoints
+	}
+	if err = addPoints(uid, delta, 0, actor, reason, tx); err != nil {
+		rollback()
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit tx: %w", err)
+	}
+	db.Infof("Adjusted points of user %d by %d (by %s): %s.", uid, delta, actor, reason)
+	return balance + delta, nil
+}
+
+// addPoints appends an entry to the ledger. orderID and actor may be zero values.
+func addPoints(uid, delta, orderID int, actor, reason string, tx *sql.Tx) error {
+	var order, actorCol interface{}
+	if orderID != 0 {
+		order = orderID
+	}
+	if actor != "" {
+		actorCol = actor
+	}
+	_, err := tx.Exec(`
+INSERT INTO PointsLedger (uid, delta, time, order_id, actor, reason) VALUES ($1, $2, $3, $4, $5, $6)`,
+		uid, delta, time.Now().Unix(), order, actorCol, reason)
+	if err != nil {
+		return fmt.Errorf("insert into points ledger: %w", err)
+	}
+	return nil
+}
+
+// 	Apply the points the customer wants to spend on the bill.
+// Bill.Total must already include the other discounts.
+func spendPoints(order *Order, bill *Bill, q queryer) error {
+	if order.Points <= 0 {
+		return nil
+	}
+	balance, err := pointsBalance(order.UID, q)
+	if err != nil {
+		return err
+	}
+	if order.Points > balance {
+		return ErrNotEnoughPoints
+	}
+	spent := order.Points
+	if spent > bill.Total {
+		spent = bill.Total
+	}
+	bill.Points = spent
+	bill.Total -= spent
+	bill.Discount += spent
+	return nil
+}
+
+// 	Record the points spent on the order.
+// Sets bill.PointsEarned: the points are credited when the order is delivered (see creditOrderPoints),
+// so that they cannot be spent before the order can no longer be cancelled.
+// Orders made by the admins (with no user) are skipped.
+func chargeOrderPoints(uid, orderID int, bill *Bill, tx *sql.Tx) error {
+	if uid == 0 {
+		return nil
+	}
+	if bill.Points != 0 {
+		if err := addPoints(uid, -bill.Points, orderID, "", PointsReasonOrder, tx); err != nil {
+			return err
+		}
+	}
+	bill.PointsEarned = bill.Total * pointsPercent / 100
+	return nil
+}
+
+// 	creditOrderPoints credits the points earned by the delivered order. Returns the number of points.
+// The entry is made for the current owner of the order (the order may have been moved by mergeUsers).
+func creditOrderPoints(orderID int, tx *sql.Tx) (int, error) {
+	var uid, total int
+	err := tx.QueryRow(`SELECT UID, COALESCE(total, 0) FROM Orders WHERE id = $1`, orderID).Scan(&uid, &total)
+	if err != nil {
+		return 0, fmt.Errorf("select from orders: %w", err)
+	}
+	earned := total * pointsPercent / 100
+	if uid == 0 || earned == 0 {
+		return 0, nil
+	}
+	if err = addPoints(uid, earned, orderID, "", PointsReasonOrder, tx); err != nil {
+		return 0, err
+	}
+	return earned, nil
+}
+
+// 	reverseOrderPoints returns the points spent on the cancelled order.
+// The entry is made for the current owner of the order (the order may have been moved by mergeUsers).
+func reverseOrderPoints(orderID int, tx *sql.Tx) error {
+	_, err := tx.Exec(`
+INSERT INTO PointsLedger (uid, delta, time, order_id, reason)
+SELECT (SELECT UID FROM Orders WHERE id = $1), -SUM(delta), $2, $1, $3 FROM PointsLedger WHERE order_id = $1
+GROUP BY order_id HAVING SUM(delta) != 0`,
+		orderID, time.Now().Unix(), PointsReasonCancelled)
+	if err != nil {
+		return fmt.Errorf("insert into points ledger: %w", err)
+	}
+	return nil
+}
+
+// transferPoints moves the whole balance of one user to another (when the accounts are merged).
+func transferPoints(fromUID, toUID int, tx *sql.Tx) error {
+	balance, err := pointsBalance(fromUID, tx)
+	if err != nil {
+		return err
+	}
+	if balance == 0 {
+		return nil
+	}
+	if err = addPoints(fromUID, -balance, 0, "", PointsReasonMerge, tx); err != nil {
+		return err
+	}
+	db.Debugf("Transferred %d points from user %d to user %d.", balance, fromUID, toUID)
+	return addPoints(toUID, balance, 0, "", PointsReasonMerge, tx)
+}
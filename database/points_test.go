@@ -0,0 +1,98 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/xopoww/korm/types"
+)
+
+// addTestDish adds a dish of a new kind with the price.
+func addTestDish(t *testing.T, name string, price, quantity int) int {
+	t.Helper()
+	kindID, err := NewDishKind(name, price)
+	if err != nil {
+		t.Fatalf("new dish kind %s: %s", name, err)
+	}
+	id, err := NewDish(name, "", quantity, kindID, nil)
+	if err != nil {
+		t.Fatalf("new dish %s: %s", name, err)
+	}
+	return id
+}
+
+func deliverOrder(id int) error {
+	for _, status := range []OrderStatus{StatusAccepted, StatusCooking, StatusDelivering, StatusDelivered} {
+		if err := SetOrderStatus(id, status, "test", ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestOrderPointsCancel(t *testing.T) {
+	uid := addTestUser(t, 301, false)
+	dishID := addTestDish(t, "points test", 1000, 100)
+	// ids of the orders placed by the steps
+	orders := make(map[string]int)
+	place := func(name string, quantity, points int) func() error {
+		return func() error {
+			order := &Order{UID: uid, Items: []OrderItem{{DishID: dishID, Quantity: quantity}}, Points: points}
+			if _, err := RegisterOrder(order); err != nil {
+				return err
+			}
+			orders[name] = order.ID
+			return nil
+		}
+	}
+	cancel := func(name string) func() error {
+		return func() error { return CancelOrder(orders[name], "test", "") }
+	}
+	deliver := func(name string) func() error {
+		return func() error { return deliverOrder(orders[name]) }
+	}
+
+	steps := []struct {
+		name		string
+		do			func() error
+		wantErr		error
+		balance		int
+	}{
+		// 5% of 2000 are earned, but not credited yet
+		{"place A", place("A", 2, 0), nil, 0},
+		{"spend the points of A", place("B", 1, 100), ErrNotEnoughPoints, 0},
+		{"deliver A", deliver("A"), nil, 100},
+		{"cancel delivered A", cancel("A"), ErrCannotCancel, 100},
+		{"place B with the points of A", place("B", 1, 100), nil, 0},
+		{"cancel B", cancel("B"), nil, 100},
+		{"cancel B again", cancel("B"), ErrCannotCancel, 100},
+		{"place C with the points of A", place("C", 1, 100), nil, 0},
+		// C costs 900 after the points
+		{"deliver C", deliver("C"), nil, 45},
+	}
+	for _, step := range steps {
+		err := step.do()
+		switch {
+		case step.wantErr == nil && err != nil:
+			t.Fatalf("%s: %s", step.name, err)
+		case !errors.Is(err, step.wantErr):
+			t.Fatalf("%s: got %v, want %v", step.name, err, step.wantErr)
+		}
+		balance, err := GetPointsBalance(uid)
+		if err != nil {
+			t.Fatalf("%s: get points balance: %s", step.name, err)
+		}
+		if balance != step.balance {
+			t.Fatalf("%s: balance = %d, want %d", step.name, balance, step.balance)
+		}
+	}
+
+	dish, err := GetDishByID(dishID)
+	if err != nil {
+		t.Fatalf("get dish: %s", err)
+	}
+	// A and C are delivered, B is cancelled
+	if dish.Quantity != 97 {
+		t.Errorf("stock = %d, want 97", dish.Quantity)
+	}
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	. "github.com/xopoww/korm/types"
+)
+
+// 	Compute the bill for the order items with the current prices.
+// If order.OfferID is not 0, the offer price is charged instead of the sum of the line prices.
+// If order.PromoCode is not empty, the code is checked for order.UID and its discount is applied
+// (ErrPromo* errors are returned if the code cannot be applied).
+// If order.Points is not 0, the points are spent on the rest of the total
+// (ErrNotEnoughPoints is returned if the user does not have them).
+// If the items are invalid (there are none, a quantity is not positive or a dish is repeated),
+// ErrBadItems is returned. If one of the dishes does not exist, an *OrderError wrapping ErrBadID is returned.
+func PriceOrder(order *Order) (*Bill, error) {
+	var offer *Offer
+	if order.OfferID != 0 {
+		var err error
+		offer, err = GetOffer(order.OfferID)
+		if err != nil {
+			return nil, fmt.Errorf("get offer (id %d): %w", order.OfferID, err)
+		}
+	}
+	return priceOrder(order, offer, db)
+}
+
+// priceOrder computes the bill within q (so that makeOrder can use prices consistent with its transaction).
+func priceOrder(order *Order, offer *Offer, q queryer) (*Bill, error) {
+	bill, err := priceItems(order.Items, offer, q)
+	if err != nil {
+		return nil, err
+	}
+	if order.PromoCode != "" {
+		code := NormalizePromoCode(order.PromoCode)
+		_, discount, err := checkPromo(code, order.UID, bill, q)
+		if err != nil {
+			return nil, err
+		}
+		bill.PromoCode = code
+		bill.PromoDiscount = discount
+		bill.Total -= discount
+		bill.Discount += discount
+	}
+	if err = spendPoints(order, bill, q); err != nil {
+		return nil, err
+	}
+	return bill, nil
+}
+
+// priceItems computes the bill without a promo code.
+func priceItems(items []OrderItem, offer *Offer, q queryer) (*Bill, error) {
+	if err := checkItems(items); err != nil {
+		return nil, err
+	}
+	bill := &Bill{Lines: make([]BillLine, 0, len(items))}
+	for _, item := range items {
+		unitPrice, err := dishPrice(item.DishID, q)
+		if err != nil {
+			return nil, err
+		}
+		line := BillLine{
+			DishID:    item.DishID,
+			Quantity:  item.Quantity,
+			UnitPrice: unitPrice,
+			Price:     unitPrice * item.Quantity,
+		}
+		bill.Lines = append(bill.Lines, line)
+		bill.Subtotal += line.Price
+	}
+
+	bill.Total = bill.Subtotal
+	if offer != nil {
+		bill.Total = offer.Price
+	}
+	bill.Discount = bill.Subtotal - bill.Total
+	return bill, nil
+}
+
+// checkItems checks that the order has items and every dish is ordered once in a positive quantity.
+func checkItems(items []OrderItem) error {
+	if len(items) == 0 {
+		return fmt.Errorf("%w: no items", ErrBadItems)
+	}
+	seen := make(map[int]bool, len(items))
+	for _, item := range items {
+		if item.Quantity <= 0 {
+			return fmt.Errorf("%w: quantity of dish %d is %d", ErrBadItems, item.DishID, item.Quantity)
+		}
+		if seen[item.DishID] {
+			return fmt.Errorf("%w: dish %d is repeated", ErrBadItems, item.DishID)
+		}
+		seen[item.DishID] = true
+	}
+	return nil
+}
+
+// dishPrice gets the current price of a portion of the dish.
+func dishPrice(dishID int, q queryer) (int, error) {
+	var price int
+	err := q.QueryRow(`
+SELECT COALESCE(Dishes.price, DishKinds.price) FROM Dishes JOIN DishKinds ON Dishes.kind = DishKinds.id
+WHERE Dishes.id = $1`,
+		dishID).Scan(&price)
+	switch {
+	case err == nil:
+		return price, nil
+	case errors.Is(err, sql.ErrNoRows):
+		return 0, &OrderError{DishID: dishID, Err: ErrBadID}
+	default:
+		return 0, fmt.Errorf("select dish price: %w", err)
+	}
+}
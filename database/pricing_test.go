@@ -0,0 +1,101 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/xopoww/korm/types"
+)
+
+func TestPriceOrder(t *testing.T) {
+	uid := addTestUser(t, 501, false)
+	if _, err := AdjustPoints(uid, 150, "test", "test"); err != nil {
+		t.Fatalf("adjust points: %s", err)
+	}
+	// A costs 100 (the kind price), B costs 200 (overrides the kind price of 250)
+	dishA := addTestDish(t, "pricing A", 100, 10)
+	kindB, err := NewDishKind("pricing B", 250)
+	if err != nil {
+		t.Fatalf("new dish kind: %s", err)
+	}
+	priceB := 200
+	dishB, err := NewDish("pricing B", "", 10, kindB, &priceB)
+	if err != nil {
+		t.Fatalf("new dish: %s", err)
+	}
+	dish, err := GetDishByID(dishA)
+	if err != nil {
+		t.Fatalf("get dish: %s", err)
+	}
+	offerID, err := NewOffer(&Offer{Name: "pricing", Price: 300, Items: []OfferItem{
+		{Kind: dish.Kind, Quantity: 2},
+		{Kind: &DishKind{ID: kindB}, Quantity: 1},
+	}})
+	if err != nil {
+		t.Fatalf("new offer: %s", err)
+	}
+
+	items := []OrderItem{{DishID: dishA, Quantity: 2}, {DishID: dishB, Quantity: 1}}
+	tests := []struct {
+		name		string
+		order		Order
+		wantErr		error
+		subtotal	int
+		discount	int
+		points		int
+		total		int
+	}{
+		{"dishes", Order{Items: items}, nil, 400, 0, 0, 400},
+		{"offer", Order{Items: items, OfferID: offerID}, nil, 400, 100, 0, 300},
+		{"points", Order{UID: uid, Items: items, Points: 150}, nil, 400, 150, 150, 250},
+		{"points with offer", Order{UID: uid, Items: items, OfferID: offerID, Points: 150}, nil, 400, 250, 150, 150},
+		// only the total is spent
+		{"points over the total", Order{UID: uid, Items: []OrderItem{{DishID: dishA, Quantity: 1}}, Points: 150},
+			nil, 100, 100, 100, 0},
+		{"more points than the balance", Order{UID: uid, Items: items, Points: 151}, ErrNotEnoughPoints, 0, 0, 0, 0},
+		{"no items", Order{}, ErrBadItems, 0, 0, 0, 0},
+		{"zero quantity", Order{Items: []OrderItem{{DishID: dishA}}}, ErrBadItems, 0, 0, 0, 0},
+		{"negative quantity", Order{Items: []OrderItem{{DishID: dishA, Quantity: -1}}}, ErrBadItems, 0, 0, 0, 0},
+		{"repeated dish", Order{Items: []OrderItem{{DishID: dishA, Quantity: 1}, {DishID: dishA, Quantity: 1}}},
+			ErrBadItems, 0, 0, 0, 0},
+		{"unknown dish", Order{Items: []OrderItem{{DishID: -1, Quantity: 1}}}, ErrBadID, 0, 0, 0, 0},
+		{"unknown offer", Order{Items: items, OfferID: -1}, ErrBadID, 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bill, err := PriceOrder(&tt.order)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("price order: %s", err)
+			}
+			if bill.Subtotal != tt.subtotal || bill.Discount != tt.discount || bill.Points != tt.points ||
+				bill.Total != tt.total {
+				t.Errorf("subtotal %d, discount %d, points %d, total %d; want %d, %d, %d, %d",
+					bill.Subtotal, bill.Discount, bill.Points, bill.Total,
+					tt.subtotal, tt.discount, tt.points, tt.total)
+			}
+			for _, line := range bill.Lines {
+				if line.Price != line.UnitPrice * line.Quantity {
+					t.Errorf("line %+v: price is not unit price * quantity", line)
+				}
+			}
+		})
+	}
+}
+
+func TestPriceOrderUnitPrices(t *testing.T) {
+	dishID := addTestDish(t, "unit price", 120, 10)
+	bill, err := PriceOrder(&Order{Items: []OrderItem{{DishID: dishID, Quantity: 3}}})
+	if err != nil {
+		t.Fatalf("price order: %s", err)
+	}
+	want := []BillLine{{DishID: dishID, Quantity: 3, UnitPrice: 120, Price: 360}}
+	if len(bill.Lines) != 1 || bill.Lines[0] != want[0] {
+		t.Errorf("lines = %+v, want %+v", bill.Lines, want)
+	}
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	. "github.com/xopoww/korm/types"
+	"strings"
+	"time"
+)
+
+// NormalizePromoCode brings the code to the form it is stored in (codes are case-insensitive).
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Get the value of a promo_code column for the code (NULL if there is none)
+func promoColumn(code string) interface{} {
+	if code == "" {
+		return nil
+	}
+	return code
+}
+
+// 	Create a new promo code.
+// If a code with the same name already exists, an ErrPromoExists is returned.
+func NewPromo(promo *Promo) error {
+	promo.Code = NormalizePromoCode(promo.Code)
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	rollback := func() {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+	}
+
+	var exists int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM PromoCodes WHERE code = $1`, promo.Code).Scan(&exists)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("count promo codes: %w", err)
+	}
+	if exists != 0 {
+		rollback()
+		return ErrPromoExists
+	}
+
+	var expires interface{}
+	if !promo.Expires.IsZero() {
+		expires = promo.Expires.Unix()
+	}
+	_, err = tx.Exec(`
+INSERT INTO PromoCodes (code, type, value, min_total, expires, max_uses, max_uses_per_user, disabled)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		promo.Code, promo.Type, promo.Value, promo.MinTotal, expires,
+		promo.MaxUses, promo.MaxUsesPerUser, promo.Disabled)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("insert into promo codes: %w", err)
+	}
+	for _, kindID := range promo.KindIDs {
+		_, err = tx.Exec(`INSERT INTO PromoKinds (code, kind_id) VALUES ($1, $2)`, promo.Code, kindID)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("insert into promo kinds: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	db.Infof("Created promo code %s.", promo.Code)
+	return nil
+}
+
+// 	Get the list of all promo codes (including disabled and expired ones).
+func GetPromos() ([]Promo, error) {
+	var codes []string
+	if err := db.Select(&codes, `SELECT code FROM PromoCodes ORDER BY code`); err != nil {
+		return nil, fmt.Errorf("select from promo codes: %w", err)
+	}
+	promos := make([]Promo, 0, len(codes))
+	for _, code := range codes {
+		promo, err := getPromo(code, db)
+		if err != nil {
+			return nil, fmt.Errorf("get promo (%s): %w", code, err)
+		}
+		promos = append(promos, *promo)
+	}
+	return promos, nil
+}
+
+// 	Get the promo code.
+// If there is no such code, an ErrPromoUnknown is returned.
+func GetPromo(code string) (*Promo, error) {
+	return getPromo(NormalizePromoCode(code), db)
+}
+
+func getPromo(code string, q queryer) (*Promo, error) {
+	var (
+		promo = Promo{Code: code}
+		expires sql.NullInt64
+	)
+	err := q.QueryRow(`
+SELECT type, value, min_total, expires, max_uses, max_uses_per_user, disabled,
+	(SELECT COUNT(*) FROM PromoUses WHERE code = $1)
+FROM PromoCodes WHERE code = $1`, code).
+		Scan(&promo.Type, &promo.Value, &promo.MinTotal, &expires,
+			&promo.MaxUses, &promo.MaxUsesPerUser, &promo.Disabled, &promo.Uses)
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrPromoUnknown
+	default:
+		return nil, fmt.Errorf("select from promo codes: %w", err)
+	}
+	if expires.Valid {
+		promo.Expires = time.Unix(expires.Int64, 0)
+	}
+
+	r, err := q.Query(`SELECT kind_id FROM PromoKinds WHERE code = $1`, code)
+	if err != nil {
+		return nil, fmt.Errorf("select from promo kinds: %w", err)
+	}
+	defer func() {
+		if e := r.Close(); e != nil {
+			db.Errorf("Cannot close a result: %s", e)
+		}
+	}()
+	for r.Next() {
+		var kindID int
+		if err = r.Scan(&kindID); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		promo.KindIDs = append(promo.KindIDs, kindID)
+	}
+	return &promo, nil
+}
+
+// 	Disable the promo code so that it can no longer be applied.
+// Orders already made with the code are not affected.
+// If there is no such code, an ErrPromoUnknown is returned.
+func DisablePromo(code string) error {
+	code = NormalizePromoCode(code)
+	res, err := db.Exec(`UPDATE PromoCodes SET disabled = 1 WHERE code = $1`, code)
+	if err != nil {
+		return fmt.Errorf("update promo codes: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPromoUnknown
+	}
+	db.Infof("Disabled promo code %s.", code)
+	return nil
+}
+
+// 	Check that the promo code can be applied by the user to the bill and compute the discount.
+// Bill.Total must not include the promo discount yet. The discount never exceeds the total.
+func checkPromo(code string, uid int, bill *Bill, q queryer) (*Promo, int, error) {
+	promo, err := getPromo(code, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	if promo.Disabled || (!promo.Expires.IsZero() && promo.Expires.Before(time.Now())) {
+		return nil, 0, ErrPromoExpired
+	}
+	if promo.MaxUses != 0 && promo.Uses >= promo.MaxUses {
+		return nil, 0, ErrPromoUsedUp
+	}
+	if promo.MaxUsesPerUser != 0 {
+		var uses int
+		err = q.QueryRow(`SELECT COUNT(*) FROM PromoUses WHERE code = $1 AND uid = $2`, code, uid).Scan(&uses)
+		if err != nil {
+			return nil, 0, fmt.Errorf("count promo uses: %w", err)
+		}
+		if uses >= promo.MaxUsesPerUser {
+			return nil, 0, ErrPromoUsedUp
+		}
+	}
+	if bill.Total < promo.MinTotal {
+		return nil, 0, fmt.Errorf("%w (%d)", ErrPromoMinTotal, promo.MinTotal)
+	}
+
+	// the amount the discount is computed from
+	eligible := bill.Total
+	if len(promo.KindIDs) != 0 {
+		eligible, err = promoEligible(promo, bill, q)
+		if err != nil {
+			return nil, 0, err
+		}
+		if eligible == 0 {
+			return nil, 0, ErrPromoNotApplicable
+		}
+	}
+
+	var discount int
+	switch promo.Type {
+	case PromoPercent:
+		discount = eligible * promo.Value / 100
+	case PromoFixed:
+		discount = promo.Value
+		if discount > eligible {
+			discount = eligible
+		}
+	default:
+		return nil, 0, fmt.Errorf("unknown promo type: %s", promo.Type)
+	}
+	if discount > bill.Total {
+		discount = bill.Total
+	}
+	return promo, discount, nil
+}
+
+// promoEligible sums the prices of the bill lines with the dishes of the kinds the promo is restricted to.
+func promoEligible(promo *Promo, bill *Bill, q queryer) (int, error) {
+	kinds := make(map[int]bool, len(promo.KindIDs))
+	for _, id := range promo.KindIDs {
+		kinds[id] = true
+	}
+	sum := 0
+	for _, line := range bill.Lines {
+		var kindID int
+		err := q.QueryRow(`SELECT kind FROM Dishes WHERE id = $1`, line.DishID).Scan(&kindID)
+		switch {
+		case err == nil:
+			break
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, &OrderError{DishID: line.DishID, Err: ErrBadID}
+		default:
+			return 0, fmt.Errorf("select from dishes: %w", err)
+		}
+		if kinds[kindID] {
+			sum += line.Price
+		}
+	}
+	return sum, nil
+}
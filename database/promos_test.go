@@ -0,0 +1,131 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/xopoww/korm/types"
+)
+
+func TestPromoDiscount(t *testing.T) {
+	uid := addTestUser(t, 601, false)
+	// the order: 2 portions of A (100 each) and 1 portion of B (300)
+	dishA := addTestDish(t, "promo A", 100, 100)
+	dishB := addTestDish(t, "promo B", 300, 100)
+	dish, err := GetDishByID(dishB)
+	if err != nil {
+		t.Fatalf("get dish: %s", err)
+	}
+	items := []OrderItem{{DishID: dishA, Quantity: 2}, {DishID: dishB, Quantity: 1}}
+	otherKind, err := NewDishKind("promo other", 50)
+	if err != nil {
+		t.Fatalf("new dish kind: %s", err)
+	}
+
+	tests := []struct {
+		promo		Promo
+		wantErr		error
+		discount	int
+	}{
+		{Promo{Code: "pct10", Type: PromoPercent, Value: 10}, nil, 50},
+		{Promo{Code: "fixed70", Type: PromoFixed, Value: 70}, nil, 70},
+		{Promo{Code: "fixed1000", Type: PromoFixed, Value: 1000}, nil, 500},
+		{Promo{Code: "pct200", Type: PromoPercent, Value: 200}, nil, 500},
+		{Promo{Code: "min500", Type: PromoFixed, Value: 10, MinTotal: 500}, nil, 10},
+		{Promo{Code: "min501", Type: PromoFixed, Value: 10, MinTotal: 501}, ErrPromoMinTotal, 0},
+		{Promo{Code: "expired", Type: PromoFixed, Value: 10, Expires: time.Now().Add(-time.Hour)}, ErrPromoExpired, 0},
+		{Promo{Code: "future", Type: PromoFixed, Value: 10, Expires: time.Now().Add(time.Hour)}, nil, 10},
+		{Promo{Code: "disabled", Type: PromoFixed, Value: 10, Disabled: true}, ErrPromoExpired, 0},
+		// the discount is computed from the dishes of the kinds only
+		{Promo{Code: "kindpct", Type: PromoPercent, Value: 50, KindIDs: []int{dish.Kind.ID}}, nil, 150},
+		{Promo{Code: "kindfixed", Type: PromoFixed, Value: 1000, KindIDs: []int{dish.Kind.ID}}, nil, 300},
+		{Promo{Code: "otherkind", Type: PromoFixed, Value: 10, KindIDs: []int{otherKind}}, ErrPromoNotApplicable, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.promo.Code, func(t *testing.T) {
+			if err := NewPromo(&tt.promo); err != nil {
+				t.Fatalf("new promo: %s", err)
+			}
+			bill, err := PriceOrder(&Order{UID: uid, Items: items, PromoCode: tt.promo.Code})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("price order: %s", err)
+			}
+			if bill.PromoDiscount != tt.discount || bill.Total != 500 - tt.discount {
+				t.Errorf("promo discount %d, total %d; want %d, %d",
+					bill.PromoDiscount, bill.Total, tt.discount, 500 - tt.discount)
+			}
+		})
+	}
+
+	if _, err = PriceOrder(&Order{UID: uid, Items: items, PromoCode: "nosuchcode"}); !errors.Is(err, ErrPromoUnknown) {
+		t.Errorf("unknown code: got %v, want ErrPromoUnknown", err)
+	}
+	// codes are case-insensitive
+	if _, err = PriceOrder(&Order{UID: uid, Items: items, PromoCode: " PCT10 "}); err != nil {
+		t.Errorf("code in upper case: %s", err)
+	}
+}
+
+func TestPromoLimits(t *testing.T) {
+	uid := addTestUser(t, 602, false)
+	otherUID := addTestUser(t, 603, false)
+	dishID := addTestDish(t, "promo limits", 100, 100)
+	order := func(uid int, code string) error {
+		_, err := RegisterOrder(&Order{UID: uid, Items: []OrderItem{{DishID: dishID, Quantity: 1}}, PromoCode: code})
+		return err
+	}
+	for _, promo := range []Promo{
+		{Code: "twice", Type: PromoFixed, Value: 10, MaxUses: 2},
+		{Code: "onceeach", Type: PromoFixed, Value: 10, MaxUsesPerUser: 1},
+	} {
+		promo := promo
+		if err := NewPromo(&promo); err != nil {
+			t.Fatalf("new promo %s: %s", promo.Code, err)
+		}
+	}
+
+	steps := []struct {
+		name		string
+		uid			int
+		code		string
+		wantErr		error
+	}{
+		{"first use", uid, "twice", nil},
+		{"second use by another user", otherUID, "twice", nil},
+		{"third use", uid, "twice", ErrPromoUsedUp},
+		{"first use by a user", uid, "onceeach", nil},
+		{"second use by the user", uid, "onceeach", ErrPromoUsedUp},
+		{"first use by another user", otherUID, "onceeach", nil},
+	}
+	for _, step := range steps {
+		err := order(step.uid, step.code)
+		switch {
+		case step.wantErr == nil && err != nil:
+			t.Fatalf("%s: %s", step.name, err)
+		case !errors.Is(err, step.wantErr):
+			t.Fatalf("%s: got %v, want %v", step.name, err, step.wantErr)
+		}
+	}
+
+	// a cancelled order doesn't count towards the limits
+	orders, _, err := GetUserOrders(otherUID, 0, 1)
+	if err != nil || len(orders) == 0 {
+		t.Fatalf("get user orders: %v", err)
+	}
+	if err = CancelOrder(orders[0].ID, "test", ""); err != nil {
+		t.Fatalf("cancel order: %s", err)
+	}
+	if err = order(otherUID, "onceeach"); err != nil {
+		t.Errorf("use after the order is cancelled: %s", err)
+	}
+	if err = NewPromo(&Promo{Code: "TWICE", Type: PromoFixed, Value: 1}); !errors.Is(err, ErrPromoExists) {
+		t.Errorf("create an existing code: got %v, want ErrPromoExists", err)
+	}
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/xopoww/korm/types"
+)
+
+const (
+	// A session expires if it hasn't been used for this long...
+	SessionIdleTimeout = 2 * time.Hour
+	// ...and in any case after this long since the login.
+	SessionLifetime = 24 * time.Hour
+)
+
+// 	Start a new session of the admin.
+// Returns the session token that identifies the session (it is given to the client and
+// is never stored: the DB keeps only its hash).
+func NewSession(username string) (string, *AdminSession, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var role AdminRole
+	err = db.QueryRow(`SELECT role FROM Admins WHERE username = $1`, username).Scan(&role)
+	if err != nil {
+		return "", nil, fmt.Errorf("select from admins: %w", err)
+	}
+
+	now := time.Now()
+	_, err = db.Exec(`
+INSERT INTO AdminSessions (id_hash, username, csrf_token, created, last_seen) VALUES ($1, $2, $3, $4, $4)`,
+		hashToken(token), username, csrfToken, now.Unix())
+	if err != nil {
+		return "", nil, fmt.Errorf("insert into admin sessions: %w", err)
+	}
+	db.Debugf("Started a session of admin %s.", username)
+	return token, &AdminSession{
+		Username:  username,
+		Role:      role,
+		CSRFToken: csrfToken,
+		Created:   now,
+		LastSeen:  now,
+	}, nil
+}
+
+// 	Get the session by its token and mark it as used. The role of the admin is looked up too.
+// If there is no such session, it has expired or the admin is disabled, ErrNoSession is returned.
+func GetSession(token string) (*AdminSession, error) {
+	var (
+		session AdminSession
+		created, lastSeen int64
+	)
+	// sessions of the disabled admins are ended by SetAdminDisabled, but the check is cheap
+	err := db.QueryRow(`
+SELECT s.username, a.role, s.csrf_token, s.created, s.last_seen FROM AdminSessions s
+JOIN Admins a ON a.username = s.username
+WHERE s.id_hash = $1 AND a.disabled = 0`,
+		hashToken(token)).Scan(&session.Username, &session.Role, &session.CSRFToken, &created, &lastSeen)
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNoSession
+	default:
+		return nil, fmt.Errorf("select from admin sessions: %w", err)
+	}
+	session.Created = time.Unix(created, 0)
+
+	now := time.Now()
+	if sessionExpired(session.Created, time.Unix(lastSeen, 0), now) {
+		if err = DeleteSession(token); err != nil {
+			return nil, err
+		}
+		return nil, ErrNoSession
+	}
+
+	session.LastSeen = now
+	_, err = db.Exec(`UPDATE AdminSessions SET last_seen = $1 WHERE id_hash = $2`, now.Unix(), hashToken(token))
+	if err != nil {
+		return nil, fmt.Errorf("update admin sessions: %w", err)
+	}
+	return &session, nil
+}
+
+// 	End the session (log out). Ending a non-existent session is not an error.
+func DeleteSession(token string) error {
+	_, err := db.Exec(`DELETE FROM AdminSessions WHERE id_hash = $1`, hashToken(token))
+	if err != nil {
+		return fmt.Errorf("delete from admin sessions: %w", err)
+	}
+	return nil
+}
+
+// 	End all sessions of the admin (log out everywhere). Returns the number of the sessions ended.
+func DeleteAdminSessions(username string) (int, error) {
+	r, err := db.Exec(`DELETE FROM AdminSessions WHERE username = $1`, username)
+	if err != nil {
+		return 0, fmt.Errorf("delete from admin sessions: %w", err)
+	}
+	nRows, _ := r.RowsAffected()
+	db.Infof("Ended %d sessions of admin %s.", nRows, username)
+	return int(nRows), nil
+}
+
+func sessionExpired(created, lastSeen, now time.Time) bool {
+	return now.Sub(lastSeen) >= SessionIdleTimeout || now.Sub(created) >= SessionLifetime
+}
+
+// Generate a random hex token (256 bits).
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+func sessionsEraser() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		r, err := db.Exec(`DELETE FROM AdminSessions WHERE last_seen <= $1 OR created <= $2`,
+			now.Add(-SessionIdleTimeout).Unix(), now.Add(-SessionLifetime).Unix())
+		if err != nil {
+			db.Errorf("Error deleting expired admin sessions: %s", err)
+			continue
+		}
+		if nRows, _ := r.RowsAffected(); nRows != 0 {
+			db.Debugf("Deleted %d expired admin sessions", nRows)
+		}
+	}
+}
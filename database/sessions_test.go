@@ -0,0 +1,112 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/xopoww/korm/types"
+)
+
+func addTestAdmin(t *testing.T, username string, role AdminRole) {
+	t.Helper()
+	if err := AddAdmin(username, "password", "Test Admin", role); err != nil {
+		t.Fatalf("add admin %s: %s", username, err)
+	}
+}
+
+func TestSessionExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		created  time.Duration
+		lastSeen time.Duration
+		want     bool
+	}{
+		{"fresh", 0, 0, false},
+		{"recently used", 3 * time.Hour, time.Minute, false},
+		{"idle", 3 * time.Hour, SessionIdleTimeout, true},
+		{"almost idle", 3 * time.Hour, SessionIdleTimeout - time.Second, false},
+		{"too old", SessionLifetime, time.Minute, true},
+		{"almost too old", SessionLifetime - time.Second, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sessionExpired(now.Add(-tt.created), now.Add(-tt.lastSeen), now)
+			if got != tt.want {
+				t.Errorf("sessionExpired(-%s, -%s) = %t, want %t", tt.created, tt.lastSeen, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	addTestAdmin(t, "sessions_owner", RoleOwner)
+	addTestAdmin(t, "sessions_cook", RoleCook)
+
+	token, session, err := NewSession("sessions_cook")
+	if err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	got, err := GetSession(token)
+	if err != nil {
+		t.Fatalf("get session: %s", err)
+	}
+	if got.Username != "sessions_cook" || got.Role != RoleCook || got.CSRFToken != session.CSRFToken {
+		t.Errorf("got session %+v, want %+v", got, session)
+	}
+	if _, err = GetSession(token + "0"); !errors.Is(err, ErrNoSession) {
+		t.Errorf("get session by a wrong token: got %v, want ErrNoSession", err)
+	}
+
+	// the sessions are looked up by the hash of the token only
+	expire := func(t *testing.T, query string) {
+		t.Helper()
+		token, _, err := NewSession("sessions_cook")
+		if err != nil {
+			t.Fatalf("new session: %s", err)
+		}
+		if _, err = db.Exec(query, hashToken(token)); err != nil {
+			t.Fatalf("update admin sessions: %s", err)
+		}
+		if _, err = GetSession(token); !errors.Is(err, ErrNoSession) {
+			t.Errorf("get expired session: got %v, want ErrNoSession", err)
+		}
+		var exists bool
+		err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM AdminSessions WHERE id_hash = $1)`, hashToken(token)).Scan(&exists)
+		if err != nil {
+			t.Fatalf("select from admin sessions: %s", err)
+		}
+		if exists {
+			t.Errorf("expired session was not deleted")
+		}
+	}
+	t.Run("idle", func(t *testing.T) {
+		expire(t, `UPDATE AdminSessions SET last_seen = last_seen - 3 * 3600 WHERE id_hash = $1`)
+	})
+	t.Run("too old", func(t *testing.T) {
+		expire(t, `UPDATE AdminSessions SET created = created - 25 * 3600 WHERE id_hash = $1`)
+	})
+
+	t.Run("logout", func(t *testing.T) {
+		if err := DeleteSession(token); err != nil {
+			t.Fatalf("delete session: %s", err)
+		}
+		if _, err := GetSession(token); !errors.Is(err, ErrNoSession) {
+			t.Errorf("get deleted session: got %v, want ErrNoSession", err)
+		}
+	})
+
+	t.Run("disabled admin", func(t *testing.T) {
+		token, _, err := NewSession("sessions_cook")
+		if err != nil {
+			t.Fatalf("new session: %s", err)
+		}
+		if err = SetAdminDisabled("sessions_cook", true); err != nil {
+			t.Fatalf("disable admin: %s", err)
+		}
+		if _, err = GetSession(token); !errors.Is(err, ErrNoSession) {
+			t.Errorf("get session of a disabled admin: got %v, want ErrNoSession", err)
+		}
+	})
+}
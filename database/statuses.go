@@ -0,0 +1,190 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	. "github.com/xopoww/korm/types"
+	"time"
+)
+
+// Allowed transitions between the order statuses.
+// Only a new order may be cancelled: after it is accepted, the food is being cooked
+// and cannot be returned to stock.
+var transitions = map[OrderStatus][]OrderStatus{
+	StatusNew:        {StatusAccepted, StatusCancelled},
+	StatusAccepted:   {StatusCooking},
+	StatusCooking:    {StatusDelivering},
+	StatusDelivering: {StatusDelivered},
+}
+
+// Check if the order can be moved from one status to another.
+func CanTransition(from, to OrderStatus) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusChange describes a transition of an order to a new status.
+type StatusChange struct {
+	OrderID		int
+	// uid of the customer
+	UID			int
+	// VK is true if the order was placed via VK bot
+	VK			bool
+	From		OrderStatus
+	To			OrderStatus
+	// who changed the status (e.g. admin username)
+	Actor		string
+	Comment		string
+	// loyalty points credited to the customer by the change (on delivery)
+	Points		int
+}
+
+// Function that is called after the status of an order has been changed
+var statusListener func(StatusChange)
+
+// 	Set the function that will be called (in a separate goroutine) after each status change.
+// Must be called before StartWorkers.
+func SetStatusListener(listener func(StatusChange)) {
+	statusListener = listener
+}
+
+// 	Move the order to a new status and record the change to the status history.
+// Returns ErrBadID if there is no such order and ErrBadTransition if the transition is not allowed.
+func SetOrderStatus(orderID int, status OrderStatus, actor, comment string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	change, err := setOrderStatus(orderID, status, actor, comment, tx)
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	notifyStatus(change)
+	return nil
+}
+
+// setOrderStatus changes the status within tx. The listener must be notified after tx is committed.
+func setOrderStatus(orderID int, status OrderStatus, actor, comment string, tx *sql.Tx) (StatusChange, error) {
+	change := StatusChange{
+		OrderID: orderID,
+		To:      status,
+		Actor:   actor,
+		Comment: comment,
+	}
+	err := tx.QueryRow(`SELECT UID, vk, status FROM Orders WHERE id = $1`, orderID).
+		Scan(&change.UID, &change.VK, &change.From)
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, sql.ErrNoRows):
+		return change, ErrBadID
+	default:
+		return change, fmt.Errorf("select from orders: %w", err)
+	}
+	if !CanTransition(change.From, status) {
+		return change, fmt.Errorf("%w: %s -> %s", ErrBadTransition, change.From, status)
+	}
+
+	if status == StatusCancelled {
+		if err = restoreStock(orderID, tx); err != nil {
+			return change, err
+		}
+		// the use of the promo code no longer counts towards its limits
+		if _, err = tx.Exec(`DELETE FROM PromoUses WHERE order_id = $1`, orderID); err != nil {
+			return change, fmt.Errorf("delete from promo uses: %w", err)
+		}
+		if err = reverseOrderPoints(orderID, tx); err != nil {
+			return change, err
+		}
+	}
+	if status == StatusDelivered {
+		if change.Points, err = creditOrderPoints(orderID, tx); err != nil {
+			return change, err
+		}
+	}
+	_, err = tx.Exec(`UPDATE Orders SET status = $1 WHERE id = $2`, status, orderID)
+	if err != nil {
+		return change, fmt.Errorf("update orders: %w", err)
+	}
+	_, err = tx.Exec(`INSERT INTO OrderStatuses (order_id, status, time, actor, comment) VALUES ($1, $2, $3, $4, $5)`,
+		orderID, status, time.Now().Unix(), actor, comment)
+	if err != nil {
+		return change, fmt.Errorf("insert into order statuses: %w", err)
+	}
+	return change, nil
+}
+
+// 	Cancel the order and return its items to stock.
+// The order can only be cancelled before it is accepted, otherwise ErrCannotCancel is returned.
+// Actor and reason are recorded to the status history.
+func CancelOrder(orderID int, actor, reason string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	rollback := func() {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+	}
+
+	var status OrderStatus
+	err = tx.QueryRow(`SELECT status FROM Orders WHERE id = $1`, orderID).Scan(&status)
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, sql.ErrNoRows):
+		rollback()
+		return ErrBadID
+	default:
+		rollback()
+		return fmt.Errorf("select from orders: %w", err)
+	}
+	if status != StatusNew {
+		rollback()
+		return ErrCannotCancel
+	}
+
+	change, err := setOrderStatus(orderID, StatusCancelled, actor, reason, tx)
+	if err != nil {
+		rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	notifyStatus(change)
+	return nil
+}
+
+// restoreStock returns the items of the order to Dishes.quantity.
+// Items of the dishes that have been deleted since are skipped.
+func restoreStock(orderID int, tx *sql.Tx) error {
+	_, err := tx.Exec(`
+UPDATE Dishes SET quantity = quantity +
+	(SELECT SUM(quantity) FROM OrderItems WHERE order_id = $1 AND dish_id = Dishes.id)
+WHERE id IN (SELECT dish_id FROM OrderItems WHERE order_id = $1)`, orderID)
+	if err != nil {
+		return fmt.Errorf("update dishes: %w", err)
+	}
+	db.Debugf("Returned the items of order %d to stock.", orderID)
+	return nil
+}
+
+func notifyStatus(change StatusChange) {
+	db.Infof("Order %d: %s -> %s (by %s).", change.OrderID, change.From, change.To, change.Actor)
+	if statusListener != nil {
+		go statusListener(change)
+	}
+}
@@ -1,9 +1,12 @@
 package database
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/base32"
 	"errors"
 	"fmt"
+	"time"
 
 	. "github.com/xopoww/korm/types"
 )
@@ -52,8 +55,13 @@ func AddUser(user * User, vk bool)(int, error) {
 		return 0, fmt.Errorf("begin transaction: %v", err)
 	}
 
-	query := fmt.Sprintf(`INSERT INTO "%s" (FirstName, LastName, id) VALUES ($1, $2, $3)`, table)
-	_, err = tx.Exec(query, user.FirstName, user.LastName, user.ID)
+	if vk {
+		query := fmt.Sprintf(`INSERT INTO "%s" (FirstName, LastName, id) VALUES ($1, $2, $3)`, table)
+		_, err = tx.Exec(query, user.FirstName, user.LastName, user.ID)
+	} else {
+		query := fmt.Sprintf(`INSERT INTO "%s" (FirstName, LastName, Username, id) VALUES ($1, $2, $3, $4)`, table)
+		_, err = tx.Exec(query, user.FirstName, user.LastName, user.Username, user.ID)
+	}
 	if err != nil {
 		if e := tx.Rollback(); e != nil {
 			db.Fatalf("Could not rollback transaction: %s", e)
@@ -103,167 +111,311 @@ func GetVkUser(uid int)(*User, error) {
 
 // GetTgUser is not implemented because telegram updates contain full info about a user.
 
+// 	Get the account of the user (by uid) in the social network.
+// Only ID, UID and Locale fields are set.
+// If the user has no account in the network, an ErrBadID is returned.
+func GetNetworkUser(uid int, vk bool) (*User, error) {
+	xID := "tgID"
+	if vk {
+		xID = "vkID"
+	}
+
+	var (
+		id sql.NullInt64
+		locale sql.NullString
+	)
+	err := db.QueryRow(fmt.Sprintf(`SELECT %s, locale FROM Users WHERE id = $1`, xID), uid).Scan(&id, &locale)
+	switch {
+	case err == nil && id.Valid:
+		return &User{ID: int(id.Int64), UID: uid, Locale: locale.String}, nil
+	case err == nil, errors.Is(err, sql.ErrNoRows):
+		return nil, ErrBadID
+	default:
+		return nil, err
+	}
+}
+
 // Get the preferred locale code (e.g. "RU") for user.
-func GetUserLocale(id int, vk bool) string {
-	// TODO: locale selection and DB query here
-	return "RU"
+// If the user has not chosen a locale yet, an empty string is returned.
+func GetUserLocale(id int, vk bool) (string, error) {
+	xID := "tgID"
+	if vk {
+		xID = "vkID"
+	}
+
+	var locale sql.NullString
+	err := db.QueryRow(fmt.Sprintf(`SELECT locale FROM Users WHERE %s = $1`, xID), id).Scan(&locale)
+	switch {
+	case err == nil:
+		return locale.String, nil
+	case errors.Is(err, sql.ErrNoRows):
+		return "", ErrBadID
+	default:
+		return "", err
+	}
+}
+
+// Set the preferred locale code for user.
+func SetUserLocale(id int, vk bool, locale string) error {
+	xID := "tgID"
+	if vk {
+		xID = "vkID"
+	}
+
+	r, err := db.Exec(fmt.Sprintf(`UPDATE Users SET locale = $1 WHERE %s = $2`, xID), locale, id)
+	if err != nil {
+		return fmt.Errorf("update users: %w", err)
+	}
+	if n, err := r.RowsAffected(); err == nil && n == 0 {
+		return ErrBadID
+	}
+	db.Debugf("Set locale %s for %s user %d", locale, netName(vk), id)
+	return nil
+}
+
+// ======== Synchronization ========
+
+// Errors
+var (
+	ErrAlreadySynced = errors.New("user is already synced")
+	ErrUnknownKey = errors.New("unknown sync key")
+	ErrSameNetwork = errors.New("sync key was emitted in the same social network")
+)
+
+// Time during which a sync key is valid
+const SyncKeyDuration = time.Minute * 5
+
+// 	Check if the user has accounts in both social networks.
+func IsSynced(id int, vk bool)(bool, error) {
+	fromID, toID := "tgID", "vkID"
+	if vk {
+		fromID, toID = toID, fromID
+	}
+
+	var otherID sql.NullInt64
+	err := db.QueryRow(fmt.Sprintf(`SELECT %s FROM Users WHERE %s = $1`, toID, fromID), id).Scan(&otherID)
+	switch {
+	case err == nil:
+		db.Debugf("Checked user sync for %s %d", fromID, id)
+		return otherID.Valid, nil
+	case errors.Is(err, sql.ErrNoRows):
+		return false, ErrBadID
+	default:
+		return false, err
+	}
+}
+
+// 	Emit a new sync key for the user.
+// The key must be sent to the bot in the other social network within SyncKeyDuration.
+// Previously emitted keys of the user are invalidated.
+func EmitSyncKey(id int, vk bool)(string, error) {
+	synced, err := IsSynced(id, vk)
+	if err != nil {
+		return "", fmt.Errorf("is synced: %w", err)
+	}
+	if synced {
+		return "", ErrAlreadySynced
+	}
+
+	keyBytes := make([]byte, 5)
+	if _, err = rand.Read(keyBytes); err != nil {
+		return "", fmt.Errorf("rand read: %w", err)
+	}
+	key := base32.StdEncoding.EncodeToString(keyBytes)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("begin tx: %w", err)
+	}
+	_, err = tx.Exec(`DELETE FROM Synchro WHERE id = $1 AND fromVK = $2`, id, vk)
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+		return "", fmt.Errorf("delete from synchro: %w", err)
+	}
+	_, err = tx.Exec(`INSERT INTO Synchro (SyncKey, id, fromVK, expires) VALUES ($1, $2, $3, $4)`,
+		key, id, vk, time.Now().Add(SyncKeyDuration).Unix())
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+		return "", fmt.Errorf("insert into synchro: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return "", fmt.Errorf("commit tx: %w", err)
+	}
+
+	db.Debugf("Emitted a sync key for %s user %d", netName(vk), id)
+	return key, nil
+}
+
+// 	Use the sync key to merge the user with the one who emitted the key.
+// Returns ErrUnknownKey if the key does not exist or is expired, ErrSameNetwork
+// if the key was emitted by the user of the same social network and ErrAlreadySynced
+// if either of the users already has an account in the other network linked.
+func UseSyncKey(key string, id int, vk bool) error {
+	var (
+		otherID	int
+		fromVK	bool
+	)
+	err := db.QueryRow(`SELECT id, fromVK FROM Synchro WHERE SyncKey = $1 AND expires > $2`,
+		key, time.Now().Unix()).Scan(&otherID, &fromVK)
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrUnknownKey
+	default:
+		return fmt.Errorf("select from synchro: %w", err)
+	}
+	if fromVK == vk {
+		return ErrSameNetwork
+	}
+
+	tgID, vkID := otherID, id
+	if !vk {
+		tgID, vkID = vkID, tgID
+	}
+	err = mergeUsers(tgID, vkID)
+	if err != nil {
+		return fmt.Errorf("merge users: %w", err)
+	}
+
+	_, err = db.Exec(`DELETE FROM Synchro WHERE SyncKey = $1`, key)
+	if err != nil {
+		db.Errorf("Cannot delete a used sync key: %s", err)
+	}
+	return nil
+}
+
+// 	Merge two records of VK and TG user into one.
+// The UID associated with the TG user is left, all the records referencing the VK UID
+// are moved to it. If either user is already linked to an account in the other network,
+// ErrAlreadySynced is returned.
+func mergeUsers(tgID, vkID int) error {
+	// get UIDs
+	tgUID, err := CheckUser(tgID, false)
+	if err != nil {
+		return fmt.Errorf("check tg user: %w", err)
+	}
+	vkUID, err := CheckUser(vkID, true)
+	if err != nil {
+		return fmt.Errorf("check vk user: %w", err)
+	}
+	if tgUID == 0 || vkUID == 0 {
+		return ErrBadID
+	}
+	if tgUID == vkUID {
+		return ErrAlreadySynced
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	rollback := func() {
+		if e := tx.Rollback(); e != nil {
+			db.Errorf("Cannot rollback a transaction: %s", e)
+		}
+	}
+
+	// neither of the users may have the other network linked already:
+	// the account linked to it would lose its UID
+	var linked bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM Users WHERE (id = $1 AND vkID IS NOT NULL) OR (id = $2 AND tgID IS NOT NULL))`,
+		tgUID, vkUID).Scan(&linked)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("select from users: %w", err)
+	}
+	if linked {
+		rollback()
+		return ErrAlreadySynced
+	}
+
+	// replace vk UID with tg UID
+	_, err = tx.Exec(`UPDATE Orders SET UID = $1 WHERE UID = $2`, tgUID, vkUID)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("update orders: %w", err)
+	}
+	_, err = tx.Exec(`UPDATE PromoUses SET uid = $1 WHERE uid = $2`, tgUID, vkUID)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("update promo uses: %w", err)
+	}
+	if err = transferPoints(vkUID, tgUID, tx); err != nil {
+		rollback()
+		return err
+	}
+
+	// move the cart contents
+	if err = touchCart(tgUID, tx); err != nil {
+		rollback()
+		return err
+	}
+	_, err = tx.Exec(`
+INSERT INTO CartItems (uid, dish_id, quantity) SELECT $1, dish_id, quantity FROM CartItems WHERE uid = $2
+ON CONFLICT (uid, dish_id) DO UPDATE SET quantity = quantity + excluded.quantity`,
+		tgUID, vkUID)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("insert into cart items: %w", err)
+	}
+	_, err = tx.Exec(`DELETE FROM CartItems WHERE uid = $1`, vkUID)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("delete from cart items: %w", err)
+	}
+	_, err = tx.Exec(`DELETE FROM Carts WHERE uid = $1`, vkUID)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("delete from carts: %w", err)
+	}
+	// pending conversation of the VK user is dropped
+	_, err = tx.Exec(`DELETE FROM ConvStates WHERE uid = $1`, vkUID)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("delete from conv states: %w", err)
+	}
+
+	// move vkID to tgUID row and drop vkUID row
+	_, err = tx.Exec(`DELETE FROM Users WHERE id = $1`, vkUID)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("delete from users: %w", err)
+	}
+	_, err = tx.Exec(`UPDATE Users SET vkID = $1 WHERE id = $2`, vkID, tgUID)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("update users: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	db.Infof("Merged users: old UID %d, new UID %d", vkUID, tgUID)
+	return nil
 }
 
-// TODO: integrate user synchronization between social networks
-
-//// ======== Synchronization ========
-//
-///* Check if the user is already synced
-// */
-//func isSynced(id int, vk bool)(bool, error) {
-//	toID, fromID := "vkID", "tgID"
-//	if vk {
-//		toID, fromID = fromID, toID
-//	}
-//
-//	r, err := db.Query(fmt.Sprintf(`SELECT %s FROM Users WHERE %s = $1`, toID, fromID), id)
-//	if err != nil {
-//		return false, err
-//	}
-//	if !r.Next() {
-//		return false, errors.New(fmt.Sprintf("No user with %s %d", fromID, id))
-//	}
-//	var otherID int
-//	err = r.Scan(&otherID)
-//	if err != nil {
-//		return false, err
-//	}
-//	dbLogger.Debugf("Checked user sync for %s %d", fromID, id)
-//	return otherID == 0, nil
-//}
-//
-//// returns the sync key if it was emitted
-//// and empty string otherwise
-//func getSyncKey(id int, vk bool)(string, error) {
-//	toID, fromID := "vkID", "tgID"
-//	if vk {
-//		toID, fromID = fromID, toID
-//	}
-//	vkInt := 0
-//	if vk {
-//		vkInt = 1
-//	}
-//	r, err := db.Query(`SELECT SyncKey FROM Synchro WHERE id = $1 AND fromVK = $2`, id, vkInt)
-//	if err != nil {
-//		return "", err
-//	}
-//	if !r.Next() {
-//		dbLogger.Debugf("No key for %s %d yet", fromID, id)
-//		return "", nil
-//	}
-//	var key string
-//	err = r.Scan(&key)
-//	if err != nil {
-//		return "", err
-//	}
-//	dbLogger.Debugf("Got a sync key for %s %d", fromID, id)
-//	return key, nil
-//}
-//
-//func setSyncKey(id int, vk bool, key string)error {
-//	toID, fromID := "vkID", "tgID"
-//	if vk {
-//		toID, fromID = fromID, toID
-//	}
-//	vkInt := 0
-//	if vk {
-//		vkInt = 1
-//	}
-//
-//	_, err := db.Exec(`INSERT INTO "Synchro" (id, fromVK, SyncKey) VALUES ($1, $2, $3)`,
-//		id, vkInt, key)
-//	if err == nil {
-//		dbLogger.Debugf("Set a sync key for %s %d", fromID, id)
-//	}
-//	return err
-//}
-//
-//// merges two records of vkUser and tgUser into one
-//// leaves the UID associated with the tgUser
-//func mergeUsers(tgID, vkID int) error {
-//	// get UIDs
-//	tgUID, err := checkUser(tgID, false)
-//	if err != nil {
-//		return err
-//	}
-//	if tgUID == 0 {
-//		return errors.New(fmt.Sprintf("TG User with id %d does not exist", tgID))
-//	}
-//	vkUID, err := checkUser(vkID, true)
-//	if err != nil {
-//		return err
-//	}
-//	if vkUID == 0 {
-//		return errors.New(fmt.Sprintf("VK User with id %d does not exist", vkID))
-//	}
-//
-//	// replace vk UID with tg UID
-//	_, err = db.Exec(`UPDATE Orders SET UID = $1 WHERE UID = $2`, tgUID, vkUID)
-//	if err != nil {
-//		return err
-//	}
-//
-//	// move vkID to tgUID row and drop vkUID row
-//	_, err = db.Exec(`
-//UPDATE Users SET vkID = $1 WHERE id = $2;
-//DELETE FROM Users WHERE id = $3;
-//`, vkID, tgUID, vkUID)
-//	if err != nil {
-//		return err
-//	}
-//	dbLogger.Debugf("Merged records: old UID %d, new UID %d", vkUID, tgUID)
-//	return nil
-//}
-//
-//// searches for key in Synchro table and
-//// returns a pair (id, fromVK) if the key exists
-//// returns (0, false) otherwise
-//func getIdByKey(key string)(int, bool, error){
-//	r, err := db.Query(`SELECT id, fromVK FROM Synchro WHERE SyncKey = $1`, key)
-//	if err != nil {
-//		return 0, false, err
-//	}
-//	if !r.Next() {
-//		dbLogger.Debug("Didn't find a key in Synchro table")
-//		return 0, false, nil
-//	}
-//	var id, vkInt int
-//	err = r.Scan(&id, &vkInt)
-//	if err != nil {
-//		return 0, false, err
-//	}
-//	dbLogger.Debug("Found a key in Synchro table")
-//	return id, vkInt != 0, nil
-//}
-//
-//const SyncKeyDuration = time.Minute * 5
-//var keysToErase = make(chan string, 100)
-//func oldKeysEraser() {
-//	// goroutine that picks keys from chan
-//	// and starts child goroutines
-//	go func() {
-//		for key := range keysToErase {
-//			// child goroutine that sleeps
-//			// and removes the key
-//			go func(key string){
-//				time.Sleep(SyncKeyDuration)
-//				r, err := db.Exec(`DELETE FROM Synchro WHERE SyncKey = $1`, key)
-//				if err != nil {
-//					dbLogger.Errorf("Error deleting a sync key: %s", err)
-//					return
-//				}
-//				if nRows, _ := r.RowsAffected(); nRows != 0 {
-//					dbLogger.Debugf("Deleted a key %s", key)
-//				} else {
-//					dbLogger.Debugf("Key already deleted: %s", key)
-//				}
-//			}(key)
-//		}
-//	}()
-//	dbLogger.Info("Started oldKeysEraser")
-//}
\ No newline at end of file
+// syncKeysEraser periodically deletes the expired sync keys.
+func syncKeysEraser() {
+	for range time.Tick(time.Minute) {
+		r, err := db.Exec(`DELETE FROM Synchro WHERE expires <= $1`, time.Now().Unix())
+		if err != nil {
+			db.Errorf("Error deleting expired sync keys: %s", err)
+			continue
+		}
+		if nRows, _ := r.RowsAffected(); nRows != 0 {
+			db.Debugf("Deleted %d expired sync keys", nRows)
+		}
+	}
+}
+
+func netName(vk bool) string {
+	if vk {
+		return "VK"
+	}
+	return "TG"
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/xopoww/korm/types"
+)
+
+func addTestUser(t *testing.T, id int, vk bool) int {
+	t.Helper()
+	uid, err := AddUser(&User{ID: id, FirstName: "Test", LastName: "User"}, vk)
+	if err != nil {
+		t.Fatalf("add user %d (vk: %t): %s", id, vk, err)
+	}
+	return uid
+}
+
+func linkUsers(t *testing.T, fromID int, fromVK bool, toID int) error {
+	t.Helper()
+	key, err := EmitSyncKey(fromID, fromVK)
+	if err != nil {
+		t.Fatalf("emit sync key: %s", err)
+	}
+	return UseSyncKey(key, toID, !fromVK)
+}
+
+func checkUID(t *testing.T, id int, vk bool, want int) {
+	t.Helper()
+	uid, err := CheckUser(id, vk)
+	if err != nil {
+		t.Fatalf("check user %d (vk: %t): %s", id, vk, err)
+	}
+	if uid != want {
+		t.Errorf("uid of user %d (vk: %t) = %d, want %d", id, vk, uid, want)
+	}
+}
+
+func TestUseSyncKeyAlreadyLinked(t *testing.T) {
+	tgUID := addTestUser(t, 101, false)
+	addTestUser(t, 201, true)
+	if err := linkUsers(t, 201, true, 101); err != nil {
+		t.Fatalf("link users: %s", err)
+	}
+	checkUID(t, 201, true, tgUID)
+
+	// a VK account tries to link to the TG account that already has one
+	otherVkUID := addTestUser(t, 202, true)
+	if err := linkUsers(t, 202, true, 101); !errors.Is(err, ErrAlreadySynced) {
+		t.Errorf("redeem a VK key by a linked TG account: got %v, want ErrAlreadySynced", err)
+	}
+	// a TG account tries to link to the VK account that already has one
+	otherTgUID := addTestUser(t, 102, false)
+	if err := linkUsers(t, 102, false, 201); !errors.Is(err, ErrAlreadySynced) {
+		t.Errorf("redeem a TG key by a linked VK account: got %v, want ErrAlreadySynced", err)
+	}
+
+	// nobody has lost their account
+	checkUID(t, 101, false, tgUID)
+	checkUID(t, 201, true, tgUID)
+	checkUID(t, 202, true, otherVkUID)
+	checkUID(t, 102, false, otherTgUID)
+}
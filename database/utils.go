@@ -9,6 +9,25 @@ import (
 var (
 	ErrBadID = errors.New("no such id")
 	ErrOutOfStock = errors.New("cannot subtract more portions than there is in stock")
+	ErrBadTransition = errors.New("order status cannot be changed this way")
+	ErrCannotCancel = errors.New("order cannot be cancelled after it has been accepted")
+	ErrOfferExpired = errors.New("offer has expired")
+	ErrOfferMismatch = errors.New("order items do not fill the offer slots")
+	ErrBadItems = errors.New("invalid order items")
+	ErrPromoUnknown = errors.New("unknown promo code")
+	ErrPromoExists = errors.New("promo code already exists")
+	ErrPromoExpired = errors.New("promo code has expired or has been disabled")
+	ErrPromoUsedUp = errors.New("promo code usage limit is reached")
+	ErrPromoMinTotal = errors.New("order total is less than required by the promo code")
+	ErrPromoNotApplicable = errors.New("promo code does not apply to the dishes in the order")
+	ErrNotEnoughPoints = errors.New("not enough loyalty points")
+	ErrKindInUse = errors.New("dish kind is used by dishes or offers")
+	ErrKindExists = errors.New("dish kind with this name already exists")
+	ErrNoSession = errors.New("no such session or it has expired")
+	ErrAdminExists = errors.New("admin with this username already exists")
+	ErrUnknownAdmin = errors.New("no such admin")
+	ErrBadRole = errors.New("unknown admin role")
+	ErrLastOwner = errors.New("there must be at least one active owner")
 )
 
 // ======== Utils ========
@@ -20,6 +39,11 @@ func CheckID(id int, table string) error {
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if e := res.Close(); e != nil {
+			db.Errorf("Cannot close a result: %s", e)
+		}
+	}()
 	if !res.Next() {
 		return ErrBadID
 	}
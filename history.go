@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/xopoww/korm/bots"
+	db "github.com/xopoww/korm/database"
+	. "github.com/xopoww/korm/types"
+	"strconv"
+)
+
+// Format of the order time in the history
+const historyTimeFormat = "02.01.2006 15:04"
+
+// Conversation step asking the reason of the order cancellation
+const stepCancelReason = "cancel_reason"
+
+// Actor recorded to the status history when the customer changes the status
+const customerActor = "customer"
+
+// Add the steps of the order management dialogs to conversations.
+func addHistorySteps() {
+	conversations.AddStep(stepCancelReason, func(bot bots.BotHandle, m *bots.Message, data map[string]string) {
+		id, err := strconv.Atoi(data["order"])
+		if err != nil {
+			bot.Errorf("Atoi (string %s): %s", data["order"], err)
+			return
+		}
+		reason := ""
+		if !m.Skipped {
+			reason = m.Text
+		}
+		// customer is notified about the cancellation by the status listener
+		err = db.CancelOrder(id, customerActor, reason)
+		switch {
+		case err == nil:
+			break
+		case errors.Is(err, db.ErrCannotCancel):
+			_, _ = bot.SendMessage(tr(m.From, "cannot_cancel", id), m.From, nil)
+		default:
+			bot.Errorf("Cancel order (id %d): %s", id, err)
+			_, _ = bot.SendMessage(tr(m.From, "error"), m.From, nil)
+		}
+	})
+}
+
+// Ask the customer why they want to cancel the order (the reason may be skipped).
+func askCancelReason(bot bots.BotHandle, cq *bots.CallbackQuery) {
+	id, err := strconv.Atoi(cq.Argument)
+	if err != nil {
+		bot.Errorf("Atoi (string %s): %s", cq.Argument, err)
+		return
+	}
+	order, err := db.GetOrder(id)
+	if err != nil {
+		bot.Errorf("Get order (id %d): %s", id, err)
+		return
+	}
+	if order.UID != cq.From.UID {
+		bot.Errorf("User %d tried to cancel order %d of user %d", cq.From.UID, id, order.UID)
+		return
+	}
+	if order.Status != StatusNew {
+		_, _ = bot.SendMessage(tr(cq.From, "cannot_cancel", id), cq.From, nil)
+		return
+	}
+	err = conversations.Ask(bot, cq.From, stepCancelReason, map[string]string{"order": cq.Argument},
+		tr(cq.From, "ask_cancel_reason", id), nil, tr(cq.From, "btn_skip"))
+	if err != nil {
+		bot.Errorf("Ask cancel reason (uid %d): %s", cq.From.UID, err)
+	}
+}
+
+// Describe the order: its status, items and total.
+func describeOrder(user *User, order *Order) (string, error) {
+	text := tr(user, "history_order", order.ID, order.Created.Format(historyTimeFormat),
+		tr(user, "status_name_" + string(order.Status))) + "\n"
+	for _, item := range order.Items {
+		name := tr(user, "dish_deleted")
+		dish, err := db.GetDishByID(item.DishID)
+		switch {
+		case err == nil:
+			name = dish.Name
+		case errors.Is(err, db.ErrBadID):
+			break
+		default:
+			return "", fmt.Errorf("get dish by id (%d): %w", item.DishID, err)
+		}
+		text += tr(user, "cart_item", name, item.Quantity) + "\n"
+	}
+	if order.OfferID != 0 {
+		offer, err := db.GetOffer(order.OfferID)
+		switch {
+		case err == nil:
+			text += tr(user, "cart_offer", offer.Name, offer.Price) + "\n"
+		case errors.Is(err, db.ErrBadID):
+			break
+		default:
+			return "", fmt.Errorf("get offer (id %d): %w", order.OfferID, err)
+		}
+	}
+	if order.PromoCode != "" {
+		text += tr(user, "history_promo", order.PromoCode) + "\n"
+	}
+	if order.Points != 0 {
+		text += tr(user, "cart_points", order.Points) + "\n"
+	}
+	// the total charged at checkout, not affected by the later price changes
+	total := order.Total
+	text += "\n" + tr(user, "cart_total", total)
+	return text, nil
+}
+
+// 	Show the page of the user's order history (one order per page, newest first).
+// If messageID is 0, a new message is sent, otherwise the message is edited.
+// The page comes from the callback data, so it is clamped to the existing pages.
+func showHistory(bot bots.BotHandle, user *User, page, messageID int) {
+	if page < 0 {
+		page = 0
+	}
+	orders, total, err := db.GetUserOrders(user.UID, page, 1)
+	if err == nil && len(orders) == 0 && total > 0 {
+		page = total - 1
+		orders, total, err = db.GetUserOrders(user.UID, page, 1)
+	}
+	if err != nil {
+		bot.Errorf("Get user orders (uid %d): %s", user.UID, err)
+		return
+	}
+
+	var (
+		text string
+		keys *bots.Keyboard
+	)
+	if len(orders) == 0 {
+		text = tr(user, "history_empty")
+	} else {
+		text, err = describeOrder(user, &orders[0])
+		if err != nil {
+			bot.Errorf("Describe order (id %d): %s", orders[0].ID, err)
+			return
+		}
+		text += "\n\n" + tr(user, "history_page", page + 1, total)
+
+		keys = &bots.Keyboard{}
+		var nav []bots.KeyboardButton
+		if page > 0 {
+			nav = append(nav, bots.KeyboardButton{Label: "◀", Action: "hist", Argument: fmt.Sprint(page - 1)})
+		}
+		if page + 1 < total {
+			nav = append(nav, bots.KeyboardButton{Label: "▶", Action: "hist", Argument: fmt.Sprint(page + 1)})
+		}
+		if len(nav) != 0 {
+			keys.AddRow(nav...)
+		}
+		keys.AddRow(bots.KeyboardButton{
+			Label:    tr(user, "btn_repeat"),
+			Color:    bots.ColorPrimary,
+			Action:   "repeat",
+			Argument: fmt.Sprint(orders[0].ID),
+		})
+		if orders[0].Status == StatusNew {
+			keys.AddRow(bots.KeyboardButton{
+				Label:    tr(user, "btn_cancel_order"),
+				Color:    bots.ColorNegative,
+				Action:   "cancel",
+				Argument: fmt.Sprint(orders[0].ID),
+			})
+		}
+	}
+
+	if messageID == 0 {
+		_, err = bot.SendMessage(text, user, keys)
+	} else {
+		err = bot.EditMessage(user, messageID, text, keys)
+	}
+	if err != nil {
+		bot.Errorf("Show history (uid %d): %s", user.UID, err)
+	}
+}
+
+// 	Copy the items of a past order to the user's cart and show the cart.
+// Items that are no longer in stock are skipped (or their quantity is reduced).
+func repeatOrder(bot bots.BotHandle, cq *bots.CallbackQuery) {
+	uid := cq.From.UID
+	id, err := strconv.Atoi(cq.Argument)
+	if err != nil {
+		bot.Errorf("Atoi (string %s): %s", cq.Argument, err)
+		return
+	}
+	order, err := db.GetOrder(id)
+	if err != nil {
+		bot.Errorf("Get order (id %d): %s", id, err)
+		return
+	}
+	if order.UID != uid {
+		bot.Errorf("User %d tried to repeat order %d of user %d", uid, id, order.UID)
+		return
+	}
+
+	cart, err := db.GetCart(uid)
+	if err != nil {
+		bot.Errorf("Get cart (uid %d): %s", uid, err)
+		return
+	}
+	partial := false
+	for _, item := range order.Items {
+		dish, err := db.GetDishByID(item.DishID)
+		if errors.Is(err, db.ErrBadID) {
+			partial = true
+			continue
+		}
+		if err != nil {
+			bot.Errorf("Get dish by id (%d): %s", item.DishID, err)
+			return
+		}
+		quantity := item.Quantity
+		if left := dish.Quantity - cartQuantity(cart, item.DishID); left < quantity {
+			quantity = left
+			partial = true
+		}
+		if quantity <= 0 {
+			continue
+		}
+		if err = db.AddToCart(uid, item.DishID, quantity); err != nil {
+			bot.Errorf("Add to cart (uid %d, dish id %d): %s", uid, item.DishID, err)
+			return
+		}
+	}
+
+	text, err := listCart(cq.From)
+	if err != nil {
+		bot.Errorf("List cart (uid %d): %s", uid, err)
+		return
+	}
+	if partial {
+		text = tr(cq.From, "repeat_partial") + "\n\n" + text
+	}
+	keys, err := createMenuKeyboard(cq.From)
+	if err != nil {
+		bot.Errorf("Create menu keyboard: %s", err)
+		return
+	}
+	if _, err = bot.SendMessage(text, cq.From, keys); err != nil {
+		bot.Errorf("Send cart (uid %d): %s", uid, err)
+	}
+}
@@ -10,21 +10,22 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/xopoww/korm/admin"
 	"github.com/xopoww/korm/bots"
 	db "github.com/xopoww/korm/database"
+	. "github.com/xopoww/korm/types"
 )
 
-//var locales map[string]*locale
-
 func main() {
 	rand.Seed(time.Now().Unix())
 
 	trace := flag.Bool("trace", false, "set logger level to trace")
-	//vkVerbose := flag.Bool("vk_verb", false, "set vk bot VerboseLogging option")
+	poll := flag.Bool("poll", false, "receive TG updates via long polling even if webhook is configured")
+	insecureCookies := flag.Bool("insecure-cookies", false, "send the admin session cookie without Secure attribute (for local development over HTTP)")
 	flag.Parse()
 	lvl := logrus.DebugLevel
 	if *trace {
@@ -38,35 +39,53 @@ func main() {
 		Level: lvl,
 	}
 
-	//// messages from JSON
-	//var err error
-	//locales, err = loadMessages()
-	//if err != nil {
-	//	panic(err)
-	//}
+	// messages from JSON
+	err := bots.LoadMessages(filepath.Join("bots", "messages.json"))
+	if err != nil {
+		panic(err)
+	}
 
 	// main router
 	router := mux.NewRouter()
 
-	// VK initialization
-	//vbot, err := vk.NewBot(vk.Properties{
-	//		Token: os.Getenv("VK_TOKEN"),
-	//		Version: "5.95",
-	//		Secret: "testing",
-	//		VerboseLogging: *vkVerbose,
-	//	},false)
-	//if err != nil {
-	//	panic(err)
-	//}
-	//router.HandleFunc("/vk", vbot.HTTPHandler())
-	//
-
 	// Bot initialization
-	tbot, err := bots.NewTgBot(os.Getenv("TG_TOKEN"), logger)
+	tgCfg := &bots.TgConfig{Token: os.Getenv("TG_TOKEN")}
+	// webhook is used in production, long polling - for local development
+	if hookURL := os.Getenv("TG_WEBHOOK_URL"); hookURL != "" && !*poll {
+		tgCfg.Webhook = &bots.TgWebhook{
+			URL:    hookURL,
+			Secret: os.Getenv("TG_WEBHOOK_SECRET"),
+			Router: router,
+			Path:   "/tg",
+		}
+	}
+	tbot, err := bots.NewTgBot(tgCfg, logger)
 	if err != nil {
 		panic(err)
 	}
-	err = InitializeBots(tbot)
+	handles := []bots.BotHandle{tbot}
+
+	// VK bot is optional
+	if token := os.Getenv("VK_TOKEN"); token != "" {
+		groupID, err := strconv.Atoi(os.Getenv("VK_GROUP_ID"))
+		if err != nil {
+			panic(fmt.Errorf("VK_GROUP_ID: %w", err))
+		}
+		vbot, err := bots.NewVkBot(&bots.VkConfig{
+			Token:        token,
+			GroupID:      groupID,
+			Secret:       os.Getenv("VK_SECRET"),
+			Confirmation: os.Getenv("VK_CONFIRMATION"),
+			Router:       router,
+			Path:         "/vk",
+		}, logger)
+		if err != nil {
+			panic(err)
+		}
+		handles = append(handles, vbot)
+	}
+
+	err = InitializeBots(handles...)
 	if err != nil {
 		panic(err)
 	}
@@ -80,10 +99,12 @@ func main() {
 	go db.StartWorkers()
 
 	// admin app
+	admin.InsecureCookies = *insecureCookies
 	admin.SetAdminRoutes(router.PathPrefix("/admin").Subrouter())
 	admin.SetApiRoutes(router.PathPrefix("/api").Subrouter())
-	// TODO: get rid of this nonsense
-	_ = db.AddAdmin("admin", "admin", "Arseny")
+	if err = bootstrapOwner(logger); err != nil {
+		panic(err)
+	}
 
 	var waitGroup sync.WaitGroup
 	waitGroup.Add(1)
@@ -93,16 +114,54 @@ func main() {
 			http.ListenAndServe("", router))
 	}()
 
-	go func(){
-		err := tbot.Start()
-		logger.Fatalf("TG bot failed: %s", err)
-	}()
+	for _, bot := range handles {
+		go func(bot bots.BotHandle){
+			err := bot.Start()
+			logger.Fatalf("Bot (vk: %t) failed: %s", bot.IsVK(), err)
+		}(bot)
+	}
 
 	waitGroup.Wait()
 }
 
 // utils
 
+// 	Create the first owner of the admin panel if there are no admins yet.
+// The credentials are taken from ADMIN_USERNAME (default "owner"), ADMIN_PASSWORD and ADMIN_NAME.
+// If ADMIN_PASSWORD is not set, a random password is generated and logged.
+func bootstrapOwner(logger *logrus.Logger) error {
+	n, err := db.CountAdmins()
+	if err != nil || n != 0 {
+		return err
+	}
+
+	username := os.Getenv("ADMIN_USERNAME")
+	if username == "" {
+		username = "owner"
+	}
+	name := os.Getenv("ADMIN_NAME")
+	if name == "" {
+		name = username
+	}
+	password := os.Getenv("ADMIN_PASSWORD")
+	generated := password == ""
+	if generated {
+		if password, err = db.GeneratePassword(); err != nil {
+			return err
+		}
+	}
+
+	if err = db.AddAdmin(username, password, name, RoleOwner); err != nil {
+		return fmt.Errorf("create owner: %w", err)
+	}
+	if generated {
+		logger.Warnf("Created owner %q with password %q. Change the password in the admin panel.", username, password)
+	} else {
+		logger.Infof("Created owner %q.", username)
+	}
+	return nil
+}
+
 func randEmoji()string {
 	emojis := []string{"\U0001f643","\U0001f609","\U0001f914","\U0001f596","\U0001f60a","\U0001f642","\U0000261d"}
 	return emojis[rand.Int() % len(emojis)]
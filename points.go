@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"github.com/xopoww/korm/bots"
+	db "github.com/xopoww/korm/database"
+	. "github.com/xopoww/korm/types"
+)
+
+// Number of the last ledger entries shown by /points
+const pointsHistoryLength = 5
+
+// Show the user's loyalty points balance and the last changes of it.
+func showPoints(bot bots.BotHandle, user *User) {
+	balance, err := db.GetPointsBalance(user.UID)
+	if err != nil {
+		bot.Errorf("Get points balance (uid %d): %s", user.UID, err)
+		_, _ = bot.SendMessage(tr(user, "error"), user, nil)
+		return
+	}
+	entries, err := db.GetPointsHistory(user.UID, pointsHistoryLength)
+	if err != nil {
+		bot.Errorf("Get points history (uid %d): %s", user.UID, err)
+		_, _ = bot.SendMessage(tr(user, "error"), user, nil)
+		return
+	}
+
+	text := tr(user, "points_balance", balance)
+	if len(entries) != 0 {
+		text += "\n\n" + tr(user, "points_history")
+	}
+	for _, entry := range entries {
+		text += "\n" + entry.Time.Format(historyTimeFormat) + "  " + describePointsEntry(user, &entry)
+	}
+	if _, err = bot.SendMessage(text, user, nil); err != nil {
+		bot.Errorf("Send points (uid %d): %s", user.UID, err)
+	}
+}
+
+// Describe the change of the balance to the customer (the reasons entered by the admins are shown as is).
+func describePointsEntry(user *User, entry *PointsEntry) string {
+	reason := entry.Reason
+	if entry.Actor == "" {
+		switch entry.Reason {
+		case db.PointsReasonOrder:
+			reason = tr(user, "points_order", entry.OrderID)
+		case db.PointsReasonCancelled:
+			reason = tr(user, "points_cancelled", entry.OrderID)
+		case db.PointsReasonMerge:
+			reason = tr(user, "points_merge")
+		}
+	}
+	return fmt.Sprintf("%+d: %s", entry.Delta, reason)
+}
+
+// 	Points the user spends on the cart (0 if the user has chosen not to spend them).
+func cartPoints(user *User) (int, error) {
+	use, err := db.GetCartUsePoints(user.UID)
+	if err != nil || !use {
+		return 0, err
+	}
+	return db.GetPointsBalance(user.UID)
+}
+
+// Switch spending of the points on the order and update the confirmation message.
+func toggleUsePoints(bot bots.BotHandle, cq *bots.CallbackQuery) {
+	uid := cq.From.UID
+	if err := db.SetCartUsePoints(uid, cq.Argument == "1"); err != nil {
+		bot.Errorf("Set cart use points (uid %d): %s", uid, err)
+		return
+	}
+	delivery, err := db.GetCartDelivery(uid)
+	if err != nil {
+		bot.Errorf("Get cart delivery (uid %d): %s", uid, err)
+		return
+	}
+	text, keys, err := confirmationMessage(cq.From, delivery)
+	if err != nil {
+		bot.Errorf("Confirmation message (uid %d): %s", uid, err)
+		return
+	}
+	if err = bot.EditMessage(cq.From, cq.MessageID, text, keys); err != nil {
+		bot.Errorf("Edit message (points): %s", err)
+	}
+}
@@ -6,11 +6,17 @@ import (
 )
 
 // User contains general information about a user.
-// User.ID is an internal uid.
+// User.ID is an id of the user in the social network (TG or VK),
+// User.UID is an internal uid (0 if it has not been resolved yet).
 type User struct {
 	FirstName	string
 	LastName	string
+	// TG only
+	Username	string
 	ID			int
+	UID			int
+	// Code of the preferred locale (e.g. "RU"), may be empty
+	Locale		string
 }
 
 // Dish is a full set of information about a dish.
@@ -20,12 +26,22 @@ type Dish struct {
 	Description		string
 	Quantity		int
 	Kind			*DishKind
+	// Price overrides the price of the kind (nil if the kind price is used)
+	Price			*int
 }
 
 func (d Dish) String() string {
 	return fmt.Sprintf("%s (%s)", d.Name, d.Kind.Repr)
 }
 
+// UnitPrice returns the price of a portion of the dish.
+func (d Dish) UnitPrice() int {
+	if d.Price != nil {
+		return *d.Price
+	}
+	return d.Kind.Price
+}
+
 // DishKind represents a kind of dish (e.g. soup, drink)
 type DishKind struct {
 	ID				int
@@ -36,26 +52,184 @@ type DishKind struct {
 type OrderItem struct {
 	DishID		int		`json:"dish_id"`
 	Quantity	int		`json:"quantity"`
+	// unit price charged for the dish (set only for registered orders)
+	Price		int		`json:"price,omitempty"`
+}
+
+// Delivery contains the details the courier needs to deliver an order.
+// Time and Comment are optional.
+type Delivery struct {
+	Address		string	`json:"address"`
+	Phone		string	`json:"phone"`
+	// desired delivery time in free form (e.g. "after 18:00")
+	Time		string	`json:"time"`
+	Comment		string	`json:"comment"`
 }
 
+// OrderStatus is a stage of the order lifecycle.
+type OrderStatus string
+
+const (
+	StatusNew			OrderStatus = "new"
+	StatusAccepted		OrderStatus = "accepted"
+	StatusCooking		OrderStatus = "cooking"
+	StatusDelivering	OrderStatus = "delivering"
+	StatusDelivered		OrderStatus = "delivered"
+	StatusCancelled		OrderStatus = "cancelled"
+)
+
 type Order struct {
+	ID			int
 	UID			int
+	// VK is true if the order was placed via VK bot
+	VK			bool
+	Status		OrderStatus
+	// time the order was placed
+	Created		time.Time
+	// total charged for the order (set only for registered orders)
+	Total		int
 	Items		[]OrderItem
 	// OfferID is an ID of an offer used (0 if it is a regular order)
 	OfferID		int
+	// promo code applied to the order (empty if none)
+	PromoCode	string
+	// number of loyalty points to spend on the order (at most the order total is spent)
+	Points		int
+	Delivery
+}
+
+// BillLine is a priced item of an order.
+type BillLine struct {
+	DishID		int		`json:"dish_id"`
+	Quantity	int		`json:"quantity"`
+	UnitPrice	int		`json:"unit_price"`
+	// UnitPrice * Quantity
+	Price		int		`json:"price"`
+}
+
+// Bill is the result of pricing an order.
+type Bill struct {
+	Lines		[]BillLine	`json:"lines"`
+	// sum of the line prices
+	Subtotal	int			`json:"subtotal"`
+	// Subtotal - Total (negative if the offer costs more than the dishes separately)
+	Discount	int			`json:"discount"`
+	// applied promo code and the discount it gave (included in Discount)
+	PromoCode		string	`json:"promo_code,omitempty"`
+	PromoDiscount	int		`json:"promo_discount,omitempty"`
+	// loyalty points spent on the order (included in Discount)
+	Points			int		`json:"points,omitempty"`
+	Total		int			`json:"total"`
+	// loyalty points that will be credited when the order is delivered (set only when the order is made)
+	PointsEarned	int		`json:"points_earned,omitempty"`
 }
 
-//	A single item of an Offer
+// PointsEntry is a record of the loyalty points ledger.
+type PointsEntry struct {
+	ID		int			`json:"id"`
+	UID		int			`json:"uid"`
+	// points credited (positive) or debited (negative)
+	Delta	int			`json:"delta"`
+	Time	time.Time	`json:"time"`
+	// order the entry relates to (0 if none)
+	OrderID	int			`json:"order_id,omitempty"`
+	// who made the entry (empty for the entries made by the system)
+	Actor	string		`json:"actor,omitempty"`
+	Reason	string		`json:"reason"`
+}
+
+// PromoType defines how the discount of a promo code is computed.
+type PromoType string
+
+const (
+	// Promo.Value is a percentage of the eligible amount
+	PromoPercent	PromoType = "percent"
+	// Promo.Value is a fixed amount
+	PromoFixed		PromoType = "fixed"
+)
+
+// Promo is a discount code.
+type Promo struct {
+	Code			string
+	Type			PromoType
+	Value			int
+	// minimum order total (before the promo discount) required to apply the code
+	MinTotal		int
+	// zero if the code never expires
+	Expires			time.Time
+	// limits of the number of uses in total and by a single user (0 if unlimited)
+	MaxUses			int
+	MaxUsesPerUser	int
+	Disabled		bool
+	// if not empty, the discount applies only to the dishes of these kinds
+	KindIDs			[]int
+	// number of times the code has been used
+	Uses			int
+}
+
+//	A single item of an Offer: a slot for Quantity portions of dishes of the Kind
 type OfferItem struct {
 	Kind			*DishKind
 	Quantity		int
 }
 
-//	A special offer object
+//	A special offer object (combo deal): a set of slots sold for a fixed price
 type Offer struct {
 	ID				int
-	Description		string
+	Name			string
 	Price			int
+	// zero if the offer never expires
 	Expires			time.Time
 	Items			[]OfferItem
-}
\ No newline at end of file
+}
+
+// ConvState is a state of a multi-step conversation with a user.
+type ConvState struct {
+	// name of the step that will handle the next reply of the user
+	Step			string
+	// data collected during the conversation
+	Data			map[string]string
+	Expires			time.Time
+}
+
+// CallbackData is the action and the argument of a button stored apart from the button
+// (because they don't fit in its callback data).
+type CallbackData struct {
+	Action			string
+	Argument		string
+	Expires			time.Time
+}
+
+// AdminRole defines what an admin is allowed to do.
+type AdminRole string
+
+const (
+	// manages everything including other admins
+	RoleOwner		AdminRole = "owner"
+	// manages the menu, orders and sales
+	RoleManager		AdminRole = "manager"
+	// manages the menu and the orders being cooked
+	RoleCook		AdminRole = "cook"
+	// manages the orders being delivered
+	RoleCourier		AdminRole = "courier"
+)
+
+// Admin is an account of the admin panel.
+type Admin struct {
+	Username		string		`json:"username"`
+	Name			string		`json:"name"`
+	Role			AdminRole	`json:"role"`
+	// disabled admins cannot log in
+	Disabled		bool		`json:"disabled"`
+}
+
+// AdminSession is a login session of an admin.
+type AdminSession struct {
+	Username		string
+	// role of the admin at the moment the session was looked up
+	Role			AdminRole
+	// token that must accompany the state-changing requests made in the session
+	CSRFToken		string
+	Created			time.Time
+	LastSeen		time.Time
+}